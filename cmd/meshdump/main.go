@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"meshdump/internal/meshdump"
 )
@@ -51,15 +58,206 @@ func loadEnv() {
 	}
 }
 
+// envBool reports whether the environment variable is set to a true value.
+func envBool(key string) bool {
+	v := strings.ToLower(os.Getenv(key))
+	return v != "" && v != "0" && v != "false" && v != "no"
+}
+
+// envInt returns the integer value of key, or zero when it is unset.
+func envInt(key string) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("config: %s: %v", key, err)
+	}
+	return n
+}
+
+// envDuration returns the duration value of key, or zero when it is unset.
+func envDuration(key string) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("config: %s: invalid duration %q", key, v)
+	}
+	return d
+}
+
+// selectPublisher picks the broker an output publishes to. The embedded broker
+// is preferred unless target is "external".
+func selectPublisher(feature, target string, broker *meshdump.Broker, client *meshdump.MQTTClient) meshdump.Publisher {
+	switch {
+	case broker != nil && target != "external":
+		return broker
+	case client != nil && target != "internal":
+		return client
+	}
+	switch target {
+	case "internal":
+		log.Fatalf("config: %s needs the internal broker (MQTT_SERVER=internal)", feature)
+	case "external":
+		log.Fatalf("config: %s needs an external broker (MQTT_BROKER)", feature)
+	}
+	log.Fatalf("config: %s needs the internal broker (MQTT_SERVER=internal) or an external one (MQTT_BROKER)", feature)
+	return nil
+}
+
+// hashPassword implements the hash-password command which prints a hash for
+// use in the broker accounts file.
+func hashPassword(args []string) {
+	var pass string
+	if len(args) > 0 {
+		pass = args[0]
+	} else {
+		fmt.Fprint(os.Stderr, "password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatalf("hash-password: %v", err)
+		}
+		pass = strings.TrimRight(line, "\r\n")
+	}
+	h, err := meshdump.HashPassword(pass)
+	if err != nil {
+		log.Fatalf("hash-password: %v", err)
+	}
+	fmt.Println(h)
+}
+
+// importNodeDB implements the import-nodedb command which loads a node
+// database saved by a Meshtastic device into the data file.
+func importNodeDB(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: meshdump import-nodedb <file>")
+		os.Exit(2)
+	}
+	b, err := os.ReadFile(args[0])
+	if err != nil {
+		log.Fatalf("import-nodedb: %v", err)
+	}
+	nodes, err := meshdump.ParseNodeDB(b)
+	if err != nil {
+		log.Fatalf("import-nodedb: %s: %v", args[0], err)
+	}
+	loadEnv()
+	path := os.Getenv("DATA_FILE")
+	if path == "" {
+		// an in-memory store would be discarded on exit
+		log.Fatal("import-nodedb: no database, set DATA_FILE")
+	}
+	store, err := meshdump.NewStore(path)
+	if err != nil {
+		log.Fatalf("import-nodedb: %v", err)
+	}
+	defer store.Close()
+	res := meshdump.ImportNodeDB(store, nodes)
+	fmt.Printf("imported %d nodes and %d telemetry entries\n", res.Nodes, res.Telemetry)
+}
+
+// migrateCmd implements the migrate command which applies pending schema
+// migrations to the data file, or only lists them with --dry-run.
+func migrateCmd(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list pending migrations without applying them")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: meshdump migrate [--dry-run] [file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	loadEnv()
+	path := os.Getenv("DATA_FILE")
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	} else if fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+	if path == "" {
+		log.Fatal("migrate: no database, set DATA_FILE or pass a file")
+	}
+	applied, err := meshdump.MigrateSQLite(path, *dryRun)
+	verb := "applied"
+	if *dryRun {
+		verb = "pending"
+	}
+	for _, m := range applied {
+		fmt.Printf("%s %d %s\n", verb, m.Version, m.Name)
+	}
+	if err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+	if len(applied) == 0 {
+		fmt.Println("schema is up to date")
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "hash-password":
+			hashPassword(os.Args[2:])
+			return
+		case "import-nodedb":
+			importNodeDB(os.Args[2:])
+			return
+		case "migrate":
+			migrateCmd(os.Args[2:])
+			return
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
 	loadEnv()
 
 	log.Printf("MeshDump version %s", meshdump.Version)
 
 	dataFile := os.Getenv("DATA_FILE")
 	log.Printf("config: data file=%s", dataFile)
-	store := meshdump.NewStore(dataFile)
+	store, err := meshdump.NewStore(dataFile)
+	if err != nil {
+		log.Fatalf("store: %v", err)
+	}
+	if sq, ok := store.(*meshdump.SQLiteStore); ok {
+		sq.SetCacheSize(envInt("STORE_CACHE_POINTS"))
+		sq.SetWriteBuffer(envInt("STORE_FLUSH_SIZE"), envDuration("STORE_FLUSH_INTERVAL"))
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Printf("store: close: %v", err)
+		}
+	}()
 	server := meshdump.NewServer(store)
+	server.SetNodeThresholds(meshdump.NodeThresholds{
+		StaleAfter:   envDuration("NODE_STALE_AFTER"),
+		OfflineAfter: envDuration("NODE_OFFLINE_AFTER"),
+	})
+	pipeline := meshdump.NewPipeline(store)
+	keys, err := meshdump.ParseChannelKeys(os.Getenv("CHANNEL_KEYS"))
+	if err != nil {
+		log.Fatalf("config: CHANNEL_KEYS: %v", err)
+	}
+	topics, err := meshdump.ParseTopicPatterns(os.Getenv("TOPIC_PATTERNS"))
+	if err != nil {
+		log.Fatalf("config: TOPIC_PATTERNS: %v", err)
+	}
+	decoder := &meshdump.Decoder{Keys: keys, Topics: topics}
+	if path := os.Getenv("JSON_MAPPINGS_FILE"); path != "" {
+		mappings, err := meshdump.LoadJSONMappings(path)
+		if err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		decoder.Mappings = mappings
+		log.Printf("config: %d JSON mappings loaded from %s", len(mappings), path)
+	}
+	pipeline.SetDecoder(decoder)
 
 	mqttBroker := os.Getenv("MQTT_BROKER")
 	mqttTopic := os.Getenv("MQTT_TOPIC")
@@ -71,34 +269,184 @@ func main() {
 	mqttMode := os.Getenv("MQTT_SERVER")
 	log.Printf("config: mqtt broker=%s topic=%s", mqttBroker, mqttTopic)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
+	pipeline.Start(ctx, meshdump.PipelineConfig{
+		QueueSize: envInt("INGEST_QUEUE_SIZE"),
+		Workers:   envInt("INGEST_WORKERS"),
+		BatchSize: envInt("INGEST_BATCH_SIZE"),
+	})
+	server.SetPipeline(pipeline)
+	tiers, err := meshdump.ParseRetention(os.Getenv("RETENTION"))
+	if err != nil {
+		log.Fatalf("config: RETENTION: %v", err)
+	}
+	if len(tiers) > 0 {
+		interval := time.Hour
+		if v := os.Getenv("RETENTION_INTERVAL"); v != "" {
+			if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+				log.Fatalf("config: RETENTION_INTERVAL: invalid duration %q", v)
+			}
+		}
+		go meshdump.RunCompaction(ctx, store, tiers, interval)
+		log.Printf("config: retention %v, compacting every %s", tiers, interval)
+	}
+	var broker *meshdump.Broker
+	var client *meshdump.MQTTClient
 	if mqttMode == "internal" {
 		addr := os.Getenv("MQTT_ADDRESS")
 		if addr == "" {
 			addr = ":1883"
 		}
-		user := mqttUser
-		if user == "" {
-			user = "meshdump"
+		user, pass := mqttUser, mqttPass
+		accountsFile := os.Getenv("MQTT_ACCOUNTS_FILE")
+		if accountsFile == "" {
+			if user == "" {
+				user = "meshdump"
+			}
+			if pass == "" {
+				pass = "meshdump"
+			}
+		} else if user != "" && pass == "" {
+			// the administrative account bypasses the topic rules of the
+			// accounts, so it is never created with a default password
+			log.Fatalf("config: MQTT_USERNAME needs MQTT_PASSWORD when MQTT_ACCOUNTS_FILE is set")
 		}
-		pass := mqttPass
-		if pass == "" {
-			pass = "meshdump"
-		}
-		if err := meshdump.StartMQTTServer(ctx, addr, user, pass); err != nil {
+		b, err := meshdump.StartMQTTServer(ctx, meshdump.BrokerConfig{
+			Address:      addr,
+			TLSAddress:   os.Getenv("MQTT_TLS_ADDRESS"),
+			WSAddress:    os.Getenv("MQTT_WS_ADDRESS"),
+			WSSAddress:   os.Getenv("MQTT_WSS_ADDRESS"),
+			TLSCertFile:  os.Getenv("MQTT_TLS_CERT"),
+			TLSKeyFile:   os.Getenv("MQTT_TLS_KEY"),
+			Username:     user,
+			Password:     pass,
+			AccountsFile: accountsFile,
+			Topic:        mqttTopic,
+		}, pipeline)
+		if err != nil {
 			log.Fatalf("mqtt server: %v", err)
 		}
-		if mqttBroker == "" {
-			mqttBroker = "tcp://localhost" + addr
-		}
+		broker = b
+		server.SetBroker(broker)
 	}
 	if mqttBroker != "" {
-		if err := meshdump.StartMQTT(ctx, mqttBroker, mqttTopic, mqttUser, mqttPass, store); err != nil {
+		cfg := meshdump.MQTTConfig{
+			Broker:     mqttBroker,
+			Topic:      mqttTopic,
+			Username:   mqttUser,
+			Password:   mqttPass,
+			ClientID:   os.Getenv("MQTT_CLIENT_ID"),
+			Persistent: envBool("MQTT_PERSISTENT"),
+		}
+		if v := os.Getenv("MQTT_MAX_RECONNECT_INTERVAL"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				log.Fatalf("config: MQTT_MAX_RECONNECT_INTERVAL: %v", err)
+			}
+			cfg.MaxReconnectInterval = d
+		}
+		c, err := meshdump.StartMQTT(ctx, cfg, pipeline)
+		if err != nil {
 			log.Fatalf("mqtt: %v", err)
 		}
+		client = c
+		server.SetMQTTClient(client)
+	}
+
+	if path := os.Getenv("BRIDGE_CONFIG"); path != "" {
+		if broker == nil {
+			log.Fatalf("config: BRIDGE_CONFIG requires MQTT_SERVER=internal")
+		}
+		cfg, err := meshdump.LoadBridgeConfig(path)
+		if err != nil {
+			log.Fatalf("bridge: %v", err)
+		}
+		cfg.Keys = keys
+		if _, err := meshdump.StartBridge(ctx, cfg, broker); err != nil {
+			log.Fatalf("bridge: %v", err)
+		}
+		log.Printf("config: bridging to %s with %d rules", cfg.Remote, len(cfg.Rules))
+	}
+
+	if addr := os.Getenv("RADIO_ADDRESS"); addr != "" {
+		cfg := meshdump.RadioConfig{Address: addr}
+		if v := os.Getenv("RADIO_BAUD"); v != "" {
+			baud, err := strconv.Atoi(v)
+			if err != nil {
+				log.Fatalf("config: RADIO_BAUD: %v", err)
+			}
+			cfg.Baud = baud
+		}
+		if envBool("RADIO_PROXY_FORWARD") {
+			switch pub := selectPublisher("RADIO_PROXY_FORWARD", os.Getenv("RADIO_PROXY_BROKER"), broker, client).(type) {
+			case *meshdump.Broker:
+				// the embedded broker does not ingest its own publications
+				cfg.ProxyPublisher = meshdump.PublisherFunc(pub.Inject)
+				cfg.ProxySubscriber = pub
+			case *meshdump.MQTTClient:
+				cfg.ProxyPublisher = pub
+				cfg.ProxySubscriber = pub
+			}
+		}
+		if _, err := meshdump.StartRadio(ctx, cfg, pipeline); err != nil {
+			log.Fatalf("radio: %v", err)
+		}
+		log.Printf("config: radio=%s", addr)
+	}
+
+	if envBool("REPUBLISH") || envBool("HA_DISCOVERY") {
+		// outputs run in the pipeline writer, so a slow broker must not block
+		// them
+		pub := meshdump.NewPublishQueue(ctx, selectPublisher("REPUBLISH", os.Getenv("REPUBLISH_BROKER"), broker, client), 0)
+		stateTopic := os.Getenv("REPUBLISH_TOPIC")
+		pipeline.AddSink(meshdump.NewJSONPublisher(pub, meshdump.RepublishConfig{
+			TelemetryTopic: stateTopic,
+			NodeInfoTopic:  os.Getenv("REPUBLISH_NODEINFO_TOPIC"),
+			TextTopic:      os.Getenv("REPUBLISH_TEXT_TOPIC"),
+			Retain:         envBool("REPUBLISH_RETAIN"),
+		}))
+		log.Printf("config: republishing decoded data as JSON")
+		if envBool("HA_DISCOVERY") {
+			ha := meshdump.NewHADiscovery(pub, store, os.Getenv("HA_DISCOVERY_PREFIX"), stateTopic)
+			pipeline.AddSink(ha)
+			go ha.Sync()
+			log.Printf("config: home assistant discovery enabled")
+		}
+	}
+
+	if gw := os.Getenv("MESH_GATEWAY_ID"); gw != "" {
+		root := os.Getenv("MESH_ROOT_TOPIC")
+		if root == "" {
+			root = "msh/EU_868"
+		}
+		pub := selectPublisher("MESH_GATEWAY_ID", os.Getenv("SEND_BROKER"), broker, client)
+		sender, err := meshdump.NewSender(pub, store, meshdump.SendConfig{
+			RootTopic:      root,
+			GatewayID:      gw,
+			Keys:           keys,
+			DefaultChannel: os.Getenv("SEND_CHANNEL"),
+		})
+		if err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		server.SetSender(sender)
+		log.Printf("config: sending enabled as %s on %s", gw, root)
 	}
 
 	log.Println("Starting MeshDump on :8080")
-	log.Fatal(http.ListenAndServe(":8080", server.Router()))
+	httpServer := &http.Server{Addr: ":8080", Handler: server.Router()}
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down")
+		shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// store what is still in flight before the store is flushed and closed
+	cancel()
+	pipeline.Wait()
 }
@@ -7,6 +7,7 @@ toolchain go1.23.8
 require (
 	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/mochi-co/mqtt v1.3.2
+	golang.org/x/sys v0.33.0
 	google.golang.org/protobuf v1.36.6
 	modernc.org/sqlite v1.38.0
 )
@@ -19,7 +20,6 @@ require (
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/rs/xid v1.4.0 // indirect
 	golang.org/x/exp v0.0.0-20250408133849-7e4ce0ab07d0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 	modernc.org/libc v1.65.10 // indirect
 	modernc.org/mathutil v1.7.1 // indirect
 	modernc.org/memory v1.11.0 // indirect
@@ -0,0 +1,96 @@
+package meshdump
+
+import (
+	"time"
+)
+
+// NodeActivity tracks when a node was heard. Times are Unix seconds and zero
+// when unknown. Packets counts the packets received from the node by
+// Meshtastic port, such as "TELEMETRY_APP"; packets of other formats are
+// counted as "UNKNOWN_APP".
+type NodeActivity struct {
+	FirstSeen        int64             `json:"first_seen,omitempty"`
+	LastSeen         int64             `json:"last_seen,omitempty"`
+	LastPositionTime int64             `json:"last_position_time,omitempty"`
+	Packets          map[string]uint64 `json:"packets,omitempty"`
+}
+
+// portPosition is the port of position packets.
+const portPosition = "POSITION_APP"
+
+// record accounts for a received packet.
+func (a *NodeActivity) record(p PacketMeta) {
+	ts := p.Timestamp.Unix()
+	if a.FirstSeen == 0 || ts < a.FirstSeen {
+		a.FirstSeen = ts
+	}
+	if ts > a.LastSeen {
+		a.LastSeen = ts
+	}
+	port := p.Port
+	if port == "" {
+		port = "UNKNOWN_APP"
+	}
+	if port == portPosition && ts > a.LastPositionTime {
+		a.LastPositionTime = ts
+	}
+	if a.Packets == nil {
+		a.Packets = make(map[string]uint64)
+	}
+	a.Packets[port]++
+}
+
+// clone returns a copy of a that shares no memory with it.
+func (a NodeActivity) clone() NodeActivity {
+	if a.Packets != nil {
+		packets := make(map[string]uint64, len(a.Packets))
+		for port, n := range a.Packets {
+			packets[port] = n
+		}
+		a.Packets = packets
+	}
+	return a
+}
+
+// Node states reported by /api/nodes.
+const (
+	NodeOnline  = "online"
+	NodeStale   = "stale"
+	NodeOffline = "offline"
+)
+
+// Default thresholds of NodeThresholds.
+const (
+	defaultStaleAfter   = 2 * time.Hour
+	defaultOfflineAfter = 24 * time.Hour
+)
+
+// NodeThresholds derive the state of a node from the time it was last heard:
+// a node is stale once StaleAfter has passed and offline after OfflineAfter.
+type NodeThresholds struct {
+	StaleAfter   time.Duration
+	OfflineAfter time.Duration
+}
+
+// Status returns the state of a node last heard at the Unix time lastHeard.
+// A node never heard is offline.
+func (th NodeThresholds) Status(lastHeard int64, now time.Time) string {
+	stale, offline := th.StaleAfter, th.OfflineAfter
+	if stale <= 0 {
+		stale = defaultStaleAfter
+	}
+	if offline <= 0 {
+		offline = defaultOfflineAfter
+	}
+	if lastHeard == 0 {
+		return NodeOffline
+	}
+	age := now.Sub(time.Unix(lastHeard, 0))
+	switch {
+	case age >= offline:
+		return NodeOffline
+	case age >= stale:
+		return NodeStale
+	}
+	return NodeOnline
+}
@@ -0,0 +1,79 @@
+package meshdump
+
+import (
+	"testing"
+	"time"
+
+	mpb "github.com/meshtastic/go/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNodeThresholdsStatus(t *testing.T) {
+	now := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) int64 { return now.Add(-d).Unix() }
+	for _, tc := range []struct {
+		th        NodeThresholds
+		lastHeard int64
+		want      string
+	}{
+		{NodeThresholds{}, ago(time.Minute), NodeOnline},
+		{NodeThresholds{}, ago(3 * time.Hour), NodeStale},
+		{NodeThresholds{}, ago(25 * time.Hour), NodeOffline},
+		{NodeThresholds{}, 0, NodeOffline},
+		{NodeThresholds{StaleAfter: 10 * time.Minute, OfflineAfter: time.Hour}, ago(10 * time.Minute), NodeStale},
+		{NodeThresholds{StaleAfter: 10 * time.Minute, OfflineAfter: time.Hour}, ago(time.Hour), NodeOffline},
+		// a clock ahead of ours is still online
+		{NodeThresholds{}, now.Add(time.Minute).Unix(), NodeOnline},
+	} {
+		if got := tc.th.Status(tc.lastHeard, now); got != tc.want {
+			t.Errorf("%+v heard %ds ago: got %s, want %s", tc.th, now.Unix()-tc.lastHeard, got, tc.want)
+		}
+	}
+}
+
+func TestPipelineRecordsActivity(t *testing.T) {
+	st := NewMemoryStore()
+	p := NewPipeline(st)
+	if err := p.HandleMessage("msh/EU_868/2/json/LongFast/!abcd1234", []byte(`{"type":"position","sender":"!abcd1234","payload":{"latitude_i":1,"longitude_i":2}}`)); err != nil {
+		t.Fatal(err)
+	}
+	a, ok := st.Activity("abcd1234")
+	if !ok || a.LastSeen == 0 || a.LastPositionTime != a.LastSeen || a.Packets[portPosition] != 1 {
+		t.Errorf("activity: %+v", a)
+	}
+}
+
+func TestPipelineRecordsUndecodedPackets(t *testing.T) {
+	data, _ := proto.Marshal(&mpb.Data{Portnum: mpb.PortNum_TEXT_MESSAGE_APP, Payload: []byte("hi")})
+	secret := []byte("0123456789abcdef")
+	encrypted, err := cryptPacket(secret, 7, 0xabcd1234, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	neighbors := &mpb.Data{Portnum: mpb.PortNum_NEIGHBORINFO_APP, Payload: []byte{0x08, 0x01}}
+	for _, tc := range []struct {
+		name string
+		pkt  *mpb.MeshPacket
+		port string
+	}{
+		// the channel key is unknown, so the default key fails to decrypt it
+		{"encrypted", &mpb.MeshPacket{Id: 7, From: 0xabcd1234, PayloadVariant: &mpb.MeshPacket_Encrypted{Encrypted: encrypted}}, portEncrypted},
+		{"not decoded", &mpb.MeshPacket{Id: 8, From: 0xabcd1234, PayloadVariant: &mpb.MeshPacket_Decoded{Decoded: neighbors}}, "NEIGHBORINFO_APP"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := NewMemoryStore()
+			p := NewPipeline(st)
+			env, _ := proto.Marshal(&mpb.ServiceEnvelope{Packet: tc.pkt, ChannelId: "Secret", GatewayId: "!00000001"})
+			if err := p.HandleMessage("msh/EU_868/2/e/Secret/!00000001", env); err != nil {
+				t.Fatal(err)
+			}
+			a, ok := st.Activity("abcd1234")
+			if !ok || a.LastSeen == 0 || a.Packets[tc.port] != 1 {
+				t.Errorf("activity: %+v", a)
+			}
+			if ps := st.Packets(nil, 0); len(ps) != 1 || ps[0].NodeID != "abcd1234" || ps[0].Port != tc.port || ps[0].Channel != "Secret" {
+				t.Errorf("packets: %+v", ps)
+			}
+		})
+	}
+}
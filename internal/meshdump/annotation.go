@@ -0,0 +1,64 @@
+package meshdump
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// NodeAnnotation holds what operators record about a node. It is kept apart
+// from NodeInfo so that metadata received from the mesh never overwrites it.
+type NodeAnnotation struct {
+	DisplayName string    `json:"display_name,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Group       string    `json:"group,omitempty"`
+	Location    string    `json:"location,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Notes       string    `json:"notes,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// normalize trims the fields of a and sorts its tags, dropping empty ones and
+// duplicates that differ only in case. The first spelling of a tag is kept.
+func (a NodeAnnotation) normalize() NodeAnnotation {
+	a.DisplayName = strings.TrimSpace(a.DisplayName)
+	a.Group = strings.TrimSpace(a.Group)
+	a.Location = strings.TrimSpace(a.Location)
+	a.Owner = strings.TrimSpace(a.Owner)
+	a.Notes = strings.TrimSpace(a.Notes)
+	seen := make(map[string]bool)
+	var tags []string
+	for _, tag := range a.Tags {
+		tag = strings.TrimSpace(tag)
+		if key := strings.ToLower(tag); tag != "" && !seen[key] {
+			seen[key] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	a.Tags = tags
+	return a
+}
+
+// empty reports whether a records nothing.
+func (a NodeAnnotation) empty() bool {
+	return a.DisplayName == "" && len(a.Tags) == 0 && a.Group == "" && a.Location == "" && a.Owner == "" && a.Notes == ""
+}
+
+// HasTag reports whether a carries tag, ignoring case.
+func (a NodeAnnotation) HasTag(tag string) bool {
+	for _, t := range a.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of a that shares no memory with it.
+func (a NodeAnnotation) clone() NodeAnnotation {
+	if a.Tags != nil {
+		a.Tags = append([]string(nil), a.Tags...)
+	}
+	return a
+}
@@ -0,0 +1,19 @@
+package meshdump
+
+import "testing"
+
+func TestNodeAnnotationNormalize(t *testing.T) {
+	a := NodeAnnotation{Group: " north ", Tags: []string{"solar", "", " backbone ", "solar", "Solar"}, Notes: "\n"}.normalize()
+	if a.Group != "north" || a.Notes != "" {
+		t.Errorf("fields: %+v", a)
+	}
+	if len(a.Tags) != 2 || a.Tags[0] != "backbone" || a.Tags[1] != "solar" {
+		t.Errorf("tags: %q", a.Tags)
+	}
+	if !a.HasTag("BACKBONE") || a.HasTag("spare") {
+		t.Error("HasTag ignores case")
+	}
+	if !(NodeAnnotation{Tags: []string{" "}}).normalize().empty() {
+		t.Error("blank annotation not empty")
+	}
+}
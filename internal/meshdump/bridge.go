@@ -0,0 +1,341 @@
+package meshdump
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mpb "github.com/meshtastic/go/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// Directions of a BridgeRule.
+const (
+	BridgeOut  = "out"
+	BridgeIn   = "in"
+	BridgeBoth = "both"
+)
+
+// BridgeRule selects the messages forwarded between the embedded broker and
+// the upstream broker. A message on LocalPrefix+X is forwarded to
+// RemotePrefix+X (and the other way round for inbound rules) when X matches
+// the Topic filter. The first rule selecting a message decides whether it is
+// forwarded.
+type BridgeRule struct {
+	Direction    string `json:"direction"`
+	Topic        string `json:"topic"`
+	LocalPrefix  string `json:"local_prefix"`
+	RemotePrefix string `json:"remote_prefix"`
+	// RateLimit is the number of messages per second forwarded in each
+	// direction, with bursts of up to Burst messages. Zero is unlimited.
+	RateLimit float64 `json:"rate_limit"`
+	Burst     int     `json:"burst"`
+	// StripPositions drops position packets and map reports. Packets that
+	// cannot be decrypted with the known channel keys are dropped as well
+	// since they may contain a position.
+	StripPositions bool `json:"strip_positions"`
+	// MapReportsOnly forwards nothing but map reports.
+	MapReportsOnly bool `json:"map_reports_only"`
+}
+
+// BridgeConfig configures the connection to an upstream broker.
+type BridgeConfig struct {
+	Remote   string       `json:"remote"`
+	Username string       `json:"username"`
+	Password string       `json:"password"`
+	ClientID string       `json:"client_id"`
+	Rules    []BridgeRule `json:"rules"`
+	// Keys are used to recognise the type of encrypted packets.
+	Keys ChannelKeys `json:"-"`
+}
+
+// LoadBridgeConfig reads a bridge configuration from a JSON file.
+func LoadBridgeConfig(path string) (BridgeConfig, error) {
+	var cfg BridgeConfig
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("bridge %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// rateLimiter is a token bucket. A nil limiter allows everything.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// bridgeRule is a validated rule with the rate limiters of both directions.
+type bridgeRule struct {
+	BridgeRule
+	out, in *rateLimiter
+}
+
+// mapTopic maps topic from the from prefix to the to prefix if it is selected
+// by the rule.
+func (r *bridgeRule) mapTopic(topic, from, to string) (string, bool) {
+	if !strings.HasPrefix(topic, from) {
+		return "", false
+	}
+	rest := topic[len(from):]
+	if !filterCovers(r.Topic, rest) {
+		return "", false
+	}
+	return to + rest, true
+}
+
+// Bridge forwards messages between the embedded broker and an upstream broker.
+type Bridge struct {
+	local   *Broker
+	remote  mqtt.Client
+	decoder *Decoder
+	rules   []*bridgeRule
+
+	mu     sync.Mutex
+	echoes map[[32]byte]time.Time
+}
+
+// echoTTL is how long a forwarded message is remembered to recognise it when
+// the upstream broker delivers it back to an inbound rule.
+const echoTTL = time.Minute
+
+// StartBridge connects to the upstream broker and starts forwarding according
+// to the rules until ctx is cancelled.
+func StartBridge(ctx context.Context, cfg BridgeConfig, local *Broker) (*Bridge, error) {
+	if cfg.Remote == "" {
+		return nil, fmt.Errorf("bridge: no remote broker configured")
+	}
+	if len(cfg.Rules) == 0 {
+		return nil, fmt.Errorf("bridge: no rules configured")
+	}
+	b := &Bridge{local: local, decoder: &Decoder{Keys: cfg.Keys}, echoes: make(map[[32]byte]time.Time)}
+	var filters []string
+	for i, r := range cfg.Rules {
+		if r.Topic == "" {
+			r.Topic = "#"
+		}
+		rule := &bridgeRule{BridgeRule: r}
+		switch r.Direction {
+		case BridgeOut:
+			rule.out = newRateLimiter(r.RateLimit, r.Burst)
+		case BridgeIn:
+			rule.in = newRateLimiter(r.RateLimit, r.Burst)
+		case BridgeBoth:
+			rule.out = newRateLimiter(r.RateLimit, r.Burst)
+			rule.in = newRateLimiter(r.RateLimit, r.Burst)
+		default:
+			return nil, fmt.Errorf("bridge: rule %d: invalid direction %q", i+1, r.Direction)
+		}
+		if r.Direction != BridgeOut {
+			filters = append(filters, r.RemotePrefix+r.Topic)
+		}
+		b.rules = append(b.rules, rule)
+	}
+
+	opts := mqtt.NewClientOptions().AddBroker(cfg.Remote)
+	if cfg.Username != "" {
+		opts.SetUsername(cfg.Username).SetPassword(cfg.Password)
+	}
+	if cfg.ClientID != "" {
+		opts.SetClientID(cfg.ClientID)
+	}
+	opts.SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetDefaultPublishHandler(b.onRemoteMessage).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			log.Printf("bridge: connected to %s", cfg.Remote)
+			if len(filters) == 0 {
+				return
+			}
+			subs := make(map[string]byte, len(filters))
+			for _, f := range filters {
+				subs[f] = 0
+			}
+			if t := c.SubscribeMultiple(subs, nil); t.Wait() && t.Error() != nil {
+				log.Printf("bridge: subscribe: %v", t.Error())
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("bridge: connection to %s lost: %v", cfg.Remote, err)
+		})
+	b.remote = mqtt.NewClient(opts)
+	b.remote.Connect()
+	local.OnPublish(b.onLocalMessage)
+
+	go func() {
+		<-ctx.Done()
+		b.remote.Disconnect(250)
+	}()
+	return b, nil
+}
+
+// onLocalMessage forwards a message published on the embedded broker.
+func (b *Bridge) onLocalMessage(topic string, payload []byte, retain bool) {
+	for _, r := range b.rules {
+		if r.Direction == BridgeIn {
+			continue
+		}
+		remote, ok := r.mapTopic(topic, r.LocalPrefix, r.RemotePrefix)
+		if !ok {
+			continue
+		}
+		if !b.accept(r, topic, payload) || !r.out.allow(time.Now()) {
+			return
+		}
+		if !b.remote.IsConnectionOpen() {
+			return
+		}
+		b.remember(remote, payload)
+		b.remote.Publish(remote, 0, retain, payload)
+		return
+	}
+}
+
+// onRemoteMessage forwards a message received from the upstream broker.
+func (b *Bridge) onRemoteMessage(_ mqtt.Client, msg mqtt.Message) {
+	if b.isEcho(msg.Topic(), msg.Payload()) {
+		return
+	}
+	for _, r := range b.rules {
+		if r.Direction == BridgeOut {
+			continue
+		}
+		local, ok := r.mapTopic(msg.Topic(), r.RemotePrefix, r.LocalPrefix)
+		if !ok {
+			continue
+		}
+		if !b.accept(r, local, msg.Payload()) || !r.in.allow(time.Now()) {
+			return
+		}
+		if err := b.local.Inject(local, msg.Payload(), msg.Retained()); err != nil {
+			log.Printf("bridge: publish %s: %v", local, err)
+		}
+		return
+	}
+}
+
+// accept applies the content filters of a rule.
+func (b *Bridge) accept(r *bridgeRule, topic string, payload []byte) bool {
+	if !r.StripPositions && !r.MapReportsOnly {
+		return true
+	}
+	port, known := b.portnum(payload)
+	if r.MapReportsOnly && !strings.Contains(topic, "/2/map/") && port != mpb.PortNum_MAP_REPORT_APP {
+		return false
+	}
+	if r.StripPositions && (!known || port == mpb.PortNum_POSITION_APP || port == mpb.PortNum_MAP_REPORT_APP) {
+		return false
+	}
+	return true
+}
+
+// portnum determines the application of a Meshtastic message. The result is
+// false when the payload is not recognised or cannot be decrypted.
+func (b *Bridge) portnum(payload []byte) (mpb.PortNum, bool) {
+	if trimmed := strings.TrimSpace(string(payload)); strings.HasPrefix(trimmed, "{") {
+		var msg struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal([]byte(trimmed), &msg); err != nil {
+			return 0, false
+		}
+		if msg.Type == "position" {
+			return mpb.PortNum_POSITION_APP, true
+		}
+		return mpb.PortNum_UNKNOWN_APP, true
+	}
+	var env mpb.ServiceEnvelope
+	if err := proto.Unmarshal(payload, &env); err != nil || env.GetPacket() == nil {
+		return 0, false
+	}
+	pkt := env.GetPacket()
+	data := pkt.GetDecoded()
+	if data == nil {
+		data = b.decoder.decrypt(pkt, env.GetChannelId())
+	}
+	if data == nil {
+		return 0, false
+	}
+	return data.GetPortnum(), true
+}
+
+func echoKey(topic string, payload []byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(payload)
+	var k [32]byte
+	h.Sum(k[:0])
+	return k
+}
+
+// remember records an outbound message so it is not forwarded back when the
+// upstream broker delivers it to an inbound subscription.
+func (b *Bridge) remember(topic string, payload []byte) {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.echoes) >= 1024 {
+		for k, t := range b.echoes {
+			if now.Sub(t) > echoTTL {
+				delete(b.echoes, k)
+			}
+		}
+	}
+	b.echoes[echoKey(topic, payload)] = now
+}
+
+func (b *Bridge) isEcho(topic string, payload []byte) bool {
+	k := echoKey(topic, payload)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.echoes[k]
+	if ok {
+		delete(b.echoes, k)
+	}
+	return ok && time.Since(t) <= echoTTL
+}
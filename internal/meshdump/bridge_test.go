@@ -0,0 +1,148 @@
+package meshdump
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mpb "github.com/meshtastic/go/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// startBridgeBrokers starts a local broker ingesting into st and a remote
+// broker whose published messages are recorded.
+func startBridgeBrokers(ctx context.Context, t *testing.T, st Store) (local, remote *Broker, localAddr, remoteAddr string, rec *fakePublisher) {
+	t.Helper()
+	localAddr, remoteAddr = freeAddr(t), freeAddr(t)
+	local, err := StartMQTTServer(ctx, testBrokerConfig(localAddr), NewPipeline(st))
+	if err != nil {
+		t.Fatalf("local: %v", err)
+	}
+	remote, err = StartMQTTServer(ctx, testBrokerConfig(remoteAddr), nil)
+	if err != nil {
+		t.Fatalf("remote: %v", err)
+	}
+	rec = &fakePublisher{}
+	remote.OnPublish(func(topic string, payload []byte, retain bool) { rec.Publish(topic, payload, retain) })
+	return local, remote, localAddr, remoteAddr, rec
+}
+
+func envelope(t *testing.T, port mpb.PortNum, payload []byte) []byte {
+	t.Helper()
+	b, err := proto.Marshal(&mpb.ServiceEnvelope{ChannelId: "LongFast", GatewayId: "!00000001",
+		Packet: &mpb.MeshPacket{From: 1, Id: 7,
+			PayloadVariant: &mpb.MeshPacket_Decoded{Decoded: &mpb.Data{Portnum: port, Payload: payload}}}})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return b
+}
+
+func TestBridgeForwarding(t *testing.T) {
+	st := NewMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	local, remote, localAddr, remoteAddr, rec := startBridgeBrokers(ctx, t, st)
+
+	_, err := StartBridge(ctx, BridgeConfig{
+		Remote:   "tcp://" + remoteAddr,
+		Username: "meshdump",
+		Password: "meshdump",
+		Rules: []BridgeRule{
+			{Direction: BridgeOut, Topic: "2/map/#", LocalPrefix: "msh/EU_868/", RemotePrefix: "msh/EU_868/", MapReportsOnly: true},
+			{Direction: BridgeOut, Topic: "2/e/#", LocalPrefix: "msh/EU_868/", RemotePrefix: "upstream/EU_868/", StripPositions: true},
+			{Direction: BridgeIn, Topic: "#", LocalPrefix: "remote/", RemotePrefix: "msh/US/", RateLimit: 0.001, Burst: 2},
+		},
+	}, local)
+	if err != nil {
+		t.Fatalf("bridge: %v", err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return len(remote.srv.Topics.Subscribers("msh/US/x")) > 0 }) {
+		t.Fatalf("bridge did not subscribe upstream")
+	}
+
+	pos, _ := proto.Marshal(&mpb.Position{LatitudeI: proto.Int32(450000000)})
+	text := envelope(t, mpb.PortNum_TEXT_MESSAGE_APP, []byte("hi"))
+	publish(t, localAddr, "msh/EU_868/2/e/LongFast/!00000001", envelope(t, mpb.PortNum_POSITION_APP, pos))
+	publish(t, localAddr, "msh/EU_868/2/e/LongFast/!00000001", text)
+	publish(t, localAddr, "msh/EU_868/2/map/!00000001", []byte("report"))
+	publish(t, localAddr, "msh/EU_868/2/json/LongFast/!00000001", []byte(`{"type":"text"}`))
+	if !waitFor(t, 5*time.Second, func() bool { return len(rec.messages()) >= 2 }) {
+		t.Fatalf("messages not forwarded: %+v", rec.messages())
+	}
+	time.Sleep(100 * time.Millisecond)
+	msgs := rec.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 forwarded messages, got %+v", msgs)
+	}
+	if msgs[0].topic != "upstream/EU_868/2/e/LongFast/!00000001" || string(msgs[0].payload) != string(text) {
+		t.Errorf("unexpected mapped message: %s", msgs[0].topic)
+	}
+	if msgs[1].topic != "msh/EU_868/2/map/!00000001" {
+		t.Errorf("unexpected map report topic: %s", msgs[1].topic)
+	}
+
+	// inbound messages are published locally and ingested, subject to the rate limit
+	for i := 0; i < 3; i++ {
+		publish(t, remoteAddr, "msh/US/2/json/LongFast/!00000002", []byte(`{"NodeID":"00000002","DataType":"voltage","Value":4}`))
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return len(st.Get("00000002")) == 2 }) {
+		t.Fatalf("inbound messages not ingested: %v", st.Get("00000002"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(st.Get("00000002")); n != 2 {
+		t.Errorf("rate limit not applied: %d messages", n)
+	}
+}
+
+func TestBridgeNoEcho(t *testing.T) {
+	st := NewMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	local, remote, localAddr, remoteAddr, rec := startBridgeBrokers(ctx, t, st)
+
+	_, err := StartBridge(ctx, BridgeConfig{
+		Remote:   "tcp://" + remoteAddr,
+		Username: "meshdump",
+		Password: "meshdump",
+		Rules:    []BridgeRule{{Direction: BridgeBoth, Topic: "msh/#"}},
+	}, local)
+	if err != nil {
+		t.Fatalf("bridge: %v", err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return len(remote.srv.Topics.Subscribers("msh/x")) > 0 }) {
+		t.Fatalf("bridge did not subscribe upstream")
+	}
+
+	publish(t, localAddr, "msh/EU_868/2/json/LongFast/!00000001", []byte(`{"NodeID":"00000001","DataType":"voltage","Value":4}`))
+	if !waitFor(t, 5*time.Second, func() bool { return len(rec.messages()) == 1 }) {
+		t.Fatalf("message not forwarded")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := len(st.Get("00000001")); n != 1 {
+		t.Errorf("forwarded message came back: %d copies stored", n)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	now := time.Unix(1700000000, 0)
+	if !l.allow(now) || !l.allow(now) || l.allow(now) {
+		t.Fatalf("burst not applied")
+	}
+	if !l.allow(now.Add(time.Second)) || l.allow(now.Add(time.Second)) {
+		t.Errorf("tokens not refilled at the configured rate")
+	}
+	var unlimited *rateLimiter
+	if !unlimited.allow(now) {
+		t.Errorf("nil limiter should allow everything")
+	}
+}
+
+func TestStartBridgeInvalidDirection(t *testing.T) {
+	_, err := StartBridge(context.Background(), BridgeConfig{Remote: "tcp://localhost:1",
+		Rules: []BridgeRule{{Direction: "sideways"}}}, nil)
+	if err == nil {
+		t.Fatalf("expected error for invalid direction")
+	}
+}
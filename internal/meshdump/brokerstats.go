@@ -0,0 +1,120 @@
+package meshdump
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/events"
+)
+
+// BrokerClient describes a client connected to the embedded broker.
+type BrokerClient struct {
+	ID          string    `json:"client_id"`
+	Username    string    `json:"username"`
+	Remote      string    `json:"remote"`
+	Listener    string    `json:"listener"`
+	ConnectedAt time.Time `json:"connected_at"`
+	MessagesIn  int64     `json:"messages_in"`
+	MessagesOut int64     `json:"messages_out"`
+}
+
+// BrokerStats is the state of the embedded broker reported by /api/broker.
+type BrokerStats struct {
+	State         string         `json:"state"`
+	Started       *time.Time     `json:"started_at,omitempty"`
+	Clients       []BrokerClient `json:"clients"`
+	Retained      int64          `json:"retained"`
+	Subscriptions int64          `json:"subscriptions"`
+	MessagesIn    int64          `json:"messages_in"`
+	MessagesOut   int64          `json:"messages_out"`
+}
+
+// brokerClient holds the counters of a connected client.
+type brokerClient struct {
+	info        BrokerClient
+	messagesIn  atomic.Int64
+	messagesOut atomic.Int64
+}
+
+// clientTracker keeps the list of connected clients and their message counts.
+type clientTracker struct {
+	mu      sync.RWMutex
+	clients map[string]*brokerClient
+}
+
+func (t *clientTracker) onConnect(cl events.Client, _ events.Packet) {
+	c := &brokerClient{info: BrokerClient{
+		ID:          cl.ID,
+		Username:    string(cl.Username),
+		Remote:      cl.Remote,
+		Listener:    cl.Listener,
+		ConnectedAt: time.Now(),
+	}}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clients == nil {
+		t.clients = make(map[string]*brokerClient)
+	}
+	t.clients[cl.ID] = c
+}
+
+func (t *clientTracker) onDisconnect(cl events.Client, _ error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// a client taking over the session of the same ID connects before the
+	// old connection is reported as closed
+	if c, ok := t.clients[cl.ID]; ok && c.info.Remote == cl.Remote {
+		delete(t.clients, cl.ID)
+	}
+}
+
+func (t *clientTracker) countIn(id string) {
+	t.mu.RLock()
+	c := t.clients[id]
+	t.mu.RUnlock()
+	if c != nil {
+		c.messagesIn.Add(1)
+	}
+}
+
+// countOut counts a message delivered to the subscribers of its topic.
+func (t *clientTracker) countOut(subscribers map[string]byte) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for id := range subscribers {
+		if c := t.clients[id]; c != nil {
+			c.messagesOut.Add(1)
+		}
+	}
+}
+
+func (t *clientTracker) list() []BrokerClient {
+	t.mu.RLock()
+	out := make([]BrokerClient, 0, len(t.clients))
+	for _, c := range t.clients {
+		info := c.info
+		info.MessagesIn = c.messagesIn.Load()
+		info.MessagesOut = c.messagesOut.Load()
+		out = append(out, info)
+	}
+	t.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Stats returns the connected clients and message counters of the broker.
+func (b *Broker) Stats() BrokerStats {
+	sys := b.srv.System
+	started := time.Unix(atomic.LoadInt64(&sys.Started), 0)
+	return BrokerStats{
+		State:         "running",
+		Started:       &started,
+		Clients:       b.clients.list(),
+		Retained:      atomic.LoadInt64(&sys.Retained),
+		Subscriptions: atomic.LoadInt64(&sys.Subscriptions),
+		MessagesIn:    atomic.LoadInt64(&sys.PublishRecv),
+		MessagesOut:   atomic.LoadInt64(&sys.PublishSent),
+	}
+}
@@ -0,0 +1,140 @@
+package meshdump
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultCachePoints is the number of recent points SQLiteStore keeps in
+// memory for every node and data type.
+const defaultCachePoints = 500
+
+// recentCache keeps the most recent points of every node and data type so
+// queries for recent data are answered without reading the database.
+//
+// A series holds every stored point at or after its from time. Series start
+// at the cache floor: the time the store was opened, raised by compaction to
+// the raw tier cutoff. Points older than that were not seen by the cache, and
+// rollups only exist before it. Points stored by an earlier run are assumed to
+// be older than the time the store was opened.
+type recentCache struct {
+	mu     sync.Mutex
+	limit  int
+	floor  time.Time
+	series map[string]map[string]*recentSeries
+}
+
+type recentSeries struct {
+	from   time.Time
+	points []Telemetry // oldest first
+}
+
+func newRecentCache(limit int, floor time.Time) *recentCache {
+	return &recentCache{limit: limit, floor: floor, series: make(map[string]map[string]*recentSeries)}
+}
+
+// setLimit changes the number of points kept per series. Shrinking the cache
+// drops the oldest points.
+func (c *recentCache) setLimit(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = n
+	for _, byType := range c.series {
+		for _, rs := range byType {
+			c.trim(rs)
+		}
+	}
+}
+
+// add records stored points.
+func (c *recentCache) add(entries []Telemetry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range entries {
+		byType := c.series[t.NodeID]
+		if byType == nil {
+			byType = make(map[string]*recentSeries)
+			c.series[t.NodeID] = byType
+		}
+		rs := byType[t.DataType]
+		if rs == nil {
+			rs = &recentSeries{from: c.floor}
+			byType[t.DataType] = rs
+		}
+		if t.Timestamp.Before(rs.from) {
+			continue
+		}
+		// points normally arrive in order, so this is an append
+		i := sort.Search(len(rs.points), func(i int) bool { return rs.points[i].Timestamp.After(t.Timestamp) })
+		rs.points = append(rs.points, Telemetry{})
+		copy(rs.points[i+1:], rs.points[i:])
+		rs.points[i] = t
+		c.trim(rs)
+	}
+}
+
+// trim drops the oldest points beyond the limit. The caller must hold c.mu.
+func (c *recentCache) trim(rs *recentSeries) {
+	if n := len(rs.points) - c.limit; n > 0 {
+		rs.from = rs.points[n-1].Timestamp.Add(time.Nanosecond)
+		rs.points = append([]Telemetry(nil), rs.points[n:]...)
+	}
+}
+
+// query returns the cached points of a node that may match q and reports
+// whether they cover the whole query. Queries without a start time or
+// reaching back beyond a series are not covered.
+func (c *recentCache) query(nodeID string, q TelemetryQuery) ([]Telemetry, bool) {
+	if q.From.IsZero() {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if q.From.Before(c.floor) {
+		return nil, false
+	}
+	byType := c.series[nodeID]
+	var series []*recentSeries
+	if len(q.Types) == 0 {
+		for _, rs := range byType {
+			series = append(series, rs)
+		}
+	} else {
+		for _, dt := range q.Types {
+			if rs := byType[dt]; rs != nil {
+				series = append(series, rs)
+			}
+		}
+	}
+	var out []Telemetry
+	for _, rs := range series {
+		if q.From.Before(rs.from) {
+			return nil, false
+		}
+		i := sort.Search(len(rs.points), func(i int) bool { return !rs.points[i].Timestamp.Before(q.From) })
+		out = append(out, rs.points[i:]...)
+	}
+	return out, true
+}
+
+// expire drops the points before cutoff, which compaction moved out of the
+// raw tier.
+func (c *recentCache) expire(cutoff time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cutoff.After(c.floor) {
+		c.floor = cutoff
+	}
+	for _, byType := range c.series {
+		for _, rs := range byType {
+			if rs.from.Before(cutoff) {
+				rs.from = cutoff
+			}
+			i := sort.Search(len(rs.points), func(i int) bool { return !rs.points[i].Timestamp.Before(cutoff) })
+			if i > 0 {
+				rs.points = append([]Telemetry(nil), rs.points[i:]...)
+			}
+		}
+	}
+}
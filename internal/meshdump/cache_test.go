@@ -0,0 +1,96 @@
+package meshdump
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecentCache(t *testing.T) {
+	floor := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+	c := newRecentCache(3, floor)
+	at := func(m int) time.Time { return floor.Add(time.Duration(m) * time.Minute) }
+	c.add([]Telemetry{
+		{NodeID: "n1", DataType: "voltage", Value: 1, Timestamp: at(1)},
+		{NodeID: "n1", DataType: "voltage", Value: 3, Timestamp: at(3)},
+		{NodeID: "n1", DataType: "voltage", Value: 2, Timestamp: at(2)},
+		{NodeID: "n1", DataType: "voltage", Value: 0, Timestamp: at(-1)}, // before the floor
+		{NodeID: "n1", DataType: "temperature", Value: 20, Timestamp: at(1)},
+	})
+
+	if _, ok := c.query("n1", TelemetryQuery{}); ok {
+		t.Error("open range must not be covered")
+	}
+	if _, ok := c.query("n1", TelemetryQuery{From: at(-2)}); ok {
+		t.Error("range before the floor must not be covered")
+	}
+	got, ok := c.query("n1", TelemetryQuery{From: at(2), Types: []string{"voltage"}})
+	if !ok || len(got) != 2 || got[0].Value != 2 || got[1].Value != 3 {
+		t.Errorf("voltage since 2: %v %v", got, ok)
+	}
+
+	// the fourth voltage point pushes out the oldest one
+	c.add([]Telemetry{{NodeID: "n1", DataType: "voltage", Value: 4, Timestamp: at(4)}})
+	if _, ok := c.query("n1", TelemetryQuery{From: at(1), Types: []string{"voltage"}}); ok {
+		t.Error("trimmed range must not be covered")
+	}
+	if got, ok := c.query("n1", TelemetryQuery{From: at(1), Types: []string{"temperature"}}); !ok || len(got) != 1 {
+		t.Errorf("temperature: %v %v", got, ok)
+	}
+	if got, ok := c.query("n2", TelemetryQuery{From: at(0)}); !ok || len(got) != 0 {
+		t.Errorf("node without recent data: %v %v", got, ok)
+	}
+
+	c.expire(at(3))
+	if _, ok := c.query("n1", TelemetryQuery{From: at(2)}); ok {
+		t.Error("expired range must not be covered")
+	}
+	if got, ok := c.query("n1", TelemetryQuery{From: at(3), Types: []string{"voltage"}}); !ok || len(got) != 2 {
+		t.Errorf("after expiry: %v %v", got, ok)
+	}
+}
+
+func TestSQLiteStoreOnDemand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	s, err := OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	for i := 0; i < 10; i++ {
+		s.Add(Telemetry{NodeID: "n1", DataType: "voltage", Value: float64(i), Timestamp: old.Add(time.Duration(i) * time.Minute)})
+	}
+	s.Close()
+
+	s, err = OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetCacheSize(2)
+	if n, ok := s.Node("n1"); !ok || !n.HasData {
+		t.Errorf("node after reopen: %+v", n)
+	}
+	recent := time.Now()
+	for i := 0; i < 3; i++ {
+		s.Add(Telemetry{NodeID: "n1", DataType: "voltage", Value: float64(100 + i), Timestamp: recent.Add(time.Duration(i) * time.Second)})
+	}
+
+	if got := s.Query("n1", TelemetryQuery{}); len(got) != 13 {
+		t.Errorf("full history: %d points", len(got))
+	}
+	if got := s.Query("n1", TelemetryQuery{From: old.Add(5 * time.Minute), To: old.Add(7 * time.Minute)}); len(got) != 3 || got[0].Value != 5 {
+		t.Errorf("old range from disk: %v", got)
+	}
+	// a point written behind the store's back is only seen when reading the database
+	if _, err := s.db.Exec("INSERT INTO telemetry (node_id, metric_id, value, ts) SELECT 'n1', id, 999, ? FROM metrics WHERE name = 'voltage'",
+		recent.Add(1500*time.Millisecond).UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Query("n1", TelemetryQuery{From: recent.Add(time.Second)}); len(got) != 2 || got[0].Value != 101 {
+		t.Errorf("cached range: %v", got)
+	}
+	if got := s.Query("n1", TelemetryQuery{From: recent}); len(got) != 4 {
+		t.Errorf("range beyond the cache: %v", got)
+	}
+}
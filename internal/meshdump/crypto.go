@@ -0,0 +1,99 @@
+package meshdump
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// defaultPSK is the well-known key Meshtastic uses for channels configured
+// with the single byte PSK 0x01 ("AQ==").
+var defaultPSK = []byte{
+	0xd4, 0xf1, 0xbb, 0x3a, 0x20, 0x29, 0x07, 0x59,
+	0xf0, 0xbc, 0xff, 0xab, 0xcf, 0x4e, 0x69, 0x01,
+}
+
+// ChannelKeys maps channel names to their expanded AES keys. A nil key means
+// the channel is not encrypted.
+type ChannelKeys map[string][]byte
+
+// ExpandPSK converts a base64 channel PSK as shown by the Meshtastic apps into
+// an AES key. Single byte PSKs select a variant of the default key, zero means
+// no encryption.
+func ExpandPSK(psk string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(psk)
+	if err != nil {
+		return nil, fmt.Errorf("psk: %v", err)
+	}
+	switch len(b) {
+	case 0:
+		return nil, nil
+	case 1:
+		if b[0] == 0 {
+			return nil, nil
+		}
+		key := append([]byte(nil), defaultPSK...)
+		key[len(key)-1] += b[0] - 1
+		return key, nil
+	case 16, 32:
+		return b, nil
+	}
+	return nil, fmt.Errorf("psk: invalid length %d", len(b))
+}
+
+// ParseChannelKeys parses a comma separated list of name=psk pairs, for example
+// "LongFast=AQ==,Private=<base64>".
+func ParseChannelKeys(s string) (ChannelKeys, error) {
+	keys := ChannelKeys{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("channel key %q: expected name=psk", part)
+		}
+		key, err := ExpandPSK(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("channel %s: %v", kv[0], err)
+		}
+		keys[strings.TrimSpace(kv[0])] = key
+	}
+	return keys, nil
+}
+
+// channelHash computes the channel number carried in MeshPacket.channel for
+// encrypted packets: the XOR of the channel name and key bytes.
+func channelHash(name string, key []byte) uint32 {
+	var h byte
+	for i := 0; i < len(name); i++ {
+		h ^= name[i]
+	}
+	for _, b := range key {
+		h ^= b
+	}
+	return uint32(h)
+}
+
+// cryptPacket encrypts or decrypts a packet payload with AES-CTR. The nonce is
+// built from the packet ID and the sending node number as done by the
+// firmware. Without a key the payload is returned unchanged.
+func cryptPacket(key []byte, packetID, from uint32, payload []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return payload, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aes.BlockSize)
+	binary.LittleEndian.PutUint64(nonce[0:8], uint64(packetID))
+	binary.LittleEndian.PutUint32(nonce[8:12], from)
+	out := make([]byte, len(payload))
+	cipher.NewCTR(block, nonce).XORKeyStream(out, payload)
+	return out, nil
+}
@@ -12,43 +12,129 @@ import (
 	pproto "meshdump/internal/proto"
 )
 
-// Decoded holds telemetry entries or node info extracted from a payload.
+// Decoded holds telemetry entries, node info, a text message or a routing
+// acknowledgement extracted from a payload.
 type Decoded struct {
 	Telemetry []Telemetry
 	NodeInfo  *NodeInfo
+	Text      *TextMessage
+	Ack       *Ack
+	// Packet describes where the message came from.
+	Packet *PacketMeta
+	// Port is the Meshtastic port the message was decoded from, empty for
+	// formats without one.
+	Port string
+	// Source is where NodeInfo came from, one of the Source constants.
+	Source string
+	// From is the node that sent the packet the message was decoded from,
+	// known even when its payload could not be decoded.
+	From string
 }
 
+// sender returns the node the decoded message originates from.
+func (d *Decoded) sender() string {
+	switch {
+	case len(d.Telemetry) > 0:
+		return d.Telemetry[0].NodeID
+	case d.NodeInfo != nil:
+		return d.NodeInfo.ID
+	case d.Text != nil:
+		return d.Text.From
+	case d.Ack != nil:
+		return d.Ack.From
+	}
+	return d.From
+}
+
+// Ack is a routing response to a packet that requested an acknowledgement.
+// Error is empty for a successful delivery.
+type Ack struct {
+	RequestID uint32
+	From      string
+	Error     string
+}
+
+// Decoder decodes MQTT payloads. Keys holds the PSKs of encrypted channels by
+// name; packets of channels without a configured key are tried with the
+// default Meshtastic key. Mappings decode plain JSON from other sensors and
+// take precedence over the built-in JSON formats on the topics they match.
+// Topics extracts region, channel and gateway from topics; nil selects the
+// Meshtastic layouts only.
+type Decoder struct {
+	Keys     ChannelKeys
+	Mappings []JSONMapping
+	Topics   *TopicParser
+}
+
+var defaultDecoder = &Decoder{}
+
 // DecodeMessage attempts to decode an MQTT payload that may contain JSON or
 // protobuf encoded data. The topic is used to infer the node ID when missing.
 func DecodeMessage(topic, payload string) (*Decoded, error) {
+	return defaultDecoder.Decode(topic, payload)
+}
+
+// Decode decodes payload like DecodeMessage using the decoder's channel keys.
+func (d *Decoder) Decode(topic, payload string) (*Decoded, error) {
+	parser := d.Topics
+	if parser == nil {
+		parser = defaultTopicParser
+	}
+	info, known := parser.Parse(topic)
+	// topics of unknown layouts fall back to the first level that looks
+	// like a node ID
+	var topicNode string
+	if known {
+		topicNode, _ = info.NodeID()
+	} else if id, ok := nodeIDFromTopic(topic); ok {
+		topicNode = id
+	}
+
+	dec, err := d.decode(topic, topicNode, payload)
+	if err != nil {
+		return nil, err
+	}
+	dec.Packet = &PacketMeta{TopicInfo: info, Topic: topic, NodeID: dec.sender(), Port: dec.Port, Timestamp: time.Now()}
+	return dec, nil
+}
+
+func (d *Decoder) decode(topic, topicNode, payload string) (*Decoded, error) {
 	trimmed := strings.TrimSpace(payload)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		for _, m := range d.Mappings {
+			if dec, ok := m.decode(topic, []byte(trimmed)); ok {
+				return dec, nil
+			}
+		}
+	}
 	if strings.HasPrefix(trimmed, "{") {
-		if d, ok := decodeJSON(topic, []byte(trimmed)); ok {
-			return d, nil
+		if dec, ok := decodeJSON(topicNode, []byte(trimmed)); ok {
+			return dec, nil
 		}
 	}
 
-	raw := []byte(trimmed)
+	// binary payloads are used untrimmed: 0x0a is a valid leading tag byte
+	raw := []byte(payload)
 	if b, err := base64.StdEncoding.DecodeString(trimmed); err == nil {
 		raw = b
 	}
-	if d, ok := decodeProtoMessage(topic, raw); ok {
-		return d, nil
+	if dec, ok := d.decodeProtoMessage(topicNode, raw); ok {
+		return dec, nil
 	}
 	return nil, fmt.Errorf("unknown payload format")
 }
 
-func decodeJSON(topic string, data []byte) (*Decoded, bool) {
+// decodeJSON decodes the JSON formats. topicNode is the node named by the
+// topic, if any, and used when the payload does not name one.
+func decodeJSON(topicNode string, data []byte) (*Decoded, bool) {
 	var tel Telemetry
 	if err := json.Unmarshal(data, &tel); err == nil {
 		if tel.NodeID == "" {
-			if id, ok := nodeIDFromTopic(topic); ok {
-				tel.NodeID = id
-			}
+			tel.NodeID = topicNode
 		} else {
 			tel.NodeID = strings.ToLower(tel.NodeID)
 		}
-		if tel.NodeID != "" {
+		if tel.NodeID != "" && tel.DataType != "" {
 			return &Decoded{Telemetry: []Telemetry{tel}}, true
 		}
 	}
@@ -60,9 +146,7 @@ func decodeJSON(topic string, data []byte) (*Decoded, bool) {
 			id = fmt.Sprintf("%08x", pos.From)
 		}
 		if id == "" {
-			if tID, ok := nodeIDFromTopic(topic); ok {
-				id = tID
-			}
+			id = topicNode
 		}
 		if id == "" {
 			return nil, false
@@ -79,66 +163,145 @@ func decodeJSON(topic string, data []byte) (*Decoded, bool) {
 		return &Decoded{Telemetry: []Telemetry{
 			{NodeID: id, DataType: "latitude", Value: lat, Timestamp: ts},
 			{NodeID: id, DataType: "longitude", Value: lon, Timestamp: ts},
-		}}, true
+		}, Port: portPosition}, true
 	}
 
 	return nil, false
 }
 
-func decodeProtoMessage(topic string, payload []byte) (*Decoded, bool) {
+func (d *Decoder) decodeProtoMessage(topicNode string, payload []byte) (*Decoded, bool) {
 	var env mpb.ServiceEnvelope
 	if err := proto.Unmarshal(payload, &env); err == nil {
 		if pkt := env.GetPacket(); pkt != nil {
-			id := fmt.Sprintf("%08x", pkt.GetFrom())
-			if data := pkt.GetDecoded(); data != nil {
-				switch data.GetPortnum() {
-				case mpb.PortNum_TELEMETRY_APP:
-					var tm mpb.Telemetry
-					if err := proto.Unmarshal(data.GetPayload(), &tm); err == nil {
-						return &Decoded{Telemetry: telemetryFromProto(id, &tm)}, true
-					}
-				case mpb.PortNum_NODEINFO_APP:
-					var ni mpb.NodeInfo
-					if err := proto.Unmarshal(data.GetPayload(), &ni); err == nil {
-						info := NodeInfo{ID: fmt.Sprintf("%08x", ni.GetNum())}
-						if u := ni.GetUser(); u != nil {
-							info.LongName = u.GetLongName()
-							info.ShortName = u.GetShortName()
-						}
-						return &Decoded{NodeInfo: &info}, true
-					}
-				case mpb.PortNum_POSITION_APP:
-					var pos mpb.Position
-					if err := proto.Unmarshal(data.GetPayload(), &pos); err == nil {
-						ts := time.Now()
-						if pos.GetTime() != 0 {
-							ts = time.Unix(int64(pos.GetTime()), 0)
-						} else if pos.GetTimestamp() != 0 {
-							ts = time.Unix(int64(pos.GetTimestamp()), 0)
-						}
-						lat := float64(pos.GetLatitudeI()) / 1e7
-						lon := float64(pos.GetLongitudeI()) / 1e7
-						tel := []Telemetry{
-							{NodeID: id, DataType: "latitude", Value: lat, Timestamp: ts},
-							{NodeID: id, DataType: "longitude", Value: lon, Timestamp: ts},
-						}
-						if alt := pos.GetAltitude(); alt != 0 {
-							tel = append(tel, Telemetry{NodeID: id, DataType: "altitude", Value: float64(alt), Timestamp: ts})
-						}
-						return &Decoded{Telemetry: tel}, true
-					}
-				}
+			// an envelope names its gateway; other protobufs, such as map
+			// reports, may parse as an envelope without one
+			if dec, ok := d.DecodePacket(pkt, env.GetChannelId()); ok || env.GetGatewayId() != "" {
+				return dec, true
 			}
 		}
 	}
 
 	var mr pproto.MapReport
 	if err := proto.Unmarshal(payload, &mr); err == nil {
-		if id, ok := nodeIDFromTopic(topic); ok {
-			info := NodeInfo{ID: id, LongName: mr.GetLongName(), ShortName: mr.GetShortName(), Firmware: mr.GetFirmwareVersion()}
-			return &Decoded{NodeInfo: &info}, true
+		if topicNode != "" {
+			info := NodeInfo{ID: topicNode, LongName: mr.GetLongName(), ShortName: mr.GetShortName(), Firmware: mr.GetFirmwareVersion(),
+				Role: mpb.Config_DeviceConfig_Role(mr.GetRole()).String()}
+			return &Decoded{NodeInfo: &info, Port: mpb.PortNum_MAP_REPORT_APP.String(), Source: SourceMapReport}, true
 		}
 	}
 
 	return nil, false
 }
+
+// decrypt returns the decrypted payload of an encrypted packet sent on channel.
+func (d *Decoder) decrypt(pkt *mpb.MeshPacket, channel string) *mpb.Data {
+	key, ok := d.Keys[channel]
+	if !ok {
+		key = defaultPSK
+	}
+	if len(key) == 0 {
+		return nil
+	}
+	plain, err := cryptPacket(key, pkt.GetId(), pkt.GetFrom(), pkt.GetEncrypted())
+	if err != nil {
+		return nil
+	}
+	var data mpb.Data
+	if err := proto.Unmarshal(plain, &data); err != nil || data.GetPortnum() == mpb.PortNum_UNKNOWN_APP {
+		return nil
+	}
+	return &data
+}
+
+// portEncrypted is the port of packets that could not be decrypted.
+const portEncrypted = "ENCRYPTED"
+
+// DecodePacket decodes a single MeshPacket received on channel. Encrypted
+// packets are decrypted with the channel key when possible. The result is
+// never nil: when the payload cannot be decoded, ok is false and it only
+// names the sender and the port, ENCRYPTED for packets that could not be
+// decrypted, so the packet still counts towards the node's activity.
+func (d *Decoder) DecodePacket(pkt *mpb.MeshPacket, channel string) (*Decoded, bool) {
+	from := fmt.Sprintf("%08x", pkt.GetFrom())
+	data := pkt.GetDecoded()
+	if data == nil && len(pkt.GetEncrypted()) > 0 {
+		data = d.decrypt(pkt, channel)
+	}
+	if data == nil {
+		return &Decoded{From: from, Port: portEncrypted}, false
+	}
+	dec, ok := decodeData(pkt, data, channel)
+	if !ok {
+		dec = &Decoded{}
+	}
+	dec.From = from
+	dec.Port = data.GetPortnum().String()
+	return dec, ok
+}
+
+// decodeData decodes the payload of a packet by its port.
+func decodeData(pkt *mpb.MeshPacket, data *mpb.Data, channel string) (*Decoded, bool) {
+	id := fmt.Sprintf("%08x", pkt.GetFrom())
+	switch data.GetPortnum() {
+	case mpb.PortNum_TELEMETRY_APP:
+		var tm mpb.Telemetry
+		if err := proto.Unmarshal(data.GetPayload(), &tm); err == nil {
+			return &Decoded{Telemetry: telemetryFromProto(id, &tm)}, true
+		}
+	case mpb.PortNum_NODEINFO_APP:
+		var ni mpb.NodeInfo
+		if err := proto.Unmarshal(data.GetPayload(), &ni); err == nil {
+			info := NodeInfo{ID: fmt.Sprintf("%08x", ni.GetNum())}
+			if u := ni.GetUser(); u != nil {
+				info.LongName = u.GetLongName()
+				info.ShortName = u.GetShortName()
+				info.Hardware = hardwareName(u.GetHwModel())
+				info.Role = u.GetRole().String()
+			}
+			return &Decoded{NodeInfo: &info, Source: SourceNodeInfo}, true
+		}
+	case mpb.PortNum_TEXT_MESSAGE_APP:
+		ts := time.Now()
+		if pkt.GetRxTime() != 0 {
+			ts = time.Unix(int64(pkt.GetRxTime()), 0)
+		}
+		msg := TextMessage{
+			From:      id,
+			To:        fmt.Sprintf("%08x", pkt.GetTo()),
+			Channel:   channel,
+			Text:      string(data.GetPayload()),
+			Timestamp: ts,
+		}
+		return &Decoded{Text: &msg}, true
+	case mpb.PortNum_ROUTING_APP:
+		var r mpb.Routing
+		if err := proto.Unmarshal(data.GetPayload(), &r); err == nil && data.GetRequestId() != 0 {
+			ack := Ack{RequestID: data.GetRequestId(), From: id}
+			if e := r.GetErrorReason(); e != mpb.Routing_NONE {
+				ack.Error = e.String()
+			}
+			return &Decoded{Ack: &ack}, true
+		}
+	case mpb.PortNum_POSITION_APP:
+		var pos mpb.Position
+		if err := proto.Unmarshal(data.GetPayload(), &pos); err == nil {
+			ts := time.Now()
+			if pos.GetTime() != 0 {
+				ts = time.Unix(int64(pos.GetTime()), 0)
+			} else if pos.GetTimestamp() != 0 {
+				ts = time.Unix(int64(pos.GetTimestamp()), 0)
+			}
+			lat := float64(pos.GetLatitudeI()) / 1e7
+			lon := float64(pos.GetLongitudeI()) / 1e7
+			tel := []Telemetry{
+				{NodeID: id, DataType: "latitude", Value: lat, Timestamp: ts},
+				{NodeID: id, DataType: "longitude", Value: lon, Timestamp: ts},
+			}
+			if alt := pos.GetAltitude(); alt != 0 {
+				tel = append(tel, Telemetry{NodeID: id, DataType: "altitude", Value: float64(alt), Timestamp: ts})
+			}
+			return &Decoded{Telemetry: tel}, true
+		}
+	}
+	return nil, false
+}
@@ -42,19 +42,25 @@ func TestDecodeMessageProto(t *testing.T) {
 	if dec.Telemetry[0].NodeID != "00000001" {
 		t.Errorf("unexpected node id: %s", dec.Telemetry[0].NodeID)
 	}
+	if dec.Port != "TELEMETRY_APP" || dec.Packet.Port != "TELEMETRY_APP" {
+		t.Errorf("unexpected port: %q %+v", dec.Port, dec.Packet)
+	}
 }
 
 func TestDecodeMessageMapReport(t *testing.T) {
-	mr := &pproto.MapReport{LongName: "Node", FirmwareVersion: "1.0"}
+	mr := &pproto.MapReport{LongName: "Node", FirmwareVersion: "1.0", Role: int32(mpb.Config_DeviceConfig_ROUTER)}
 	raw, _ := proto.Marshal(mr)
 	enc := base64.StdEncoding.EncodeToString(raw)
 	dec, err := DecodeMessage("msh/12345678", enc)
 	if err != nil {
 		t.Fatalf("decode: %v", err)
 	}
-	if dec.NodeInfo == nil || dec.NodeInfo.LongName != "Node" {
+	if dec.NodeInfo == nil || dec.NodeInfo.LongName != "Node" || dec.NodeInfo.Role != "ROUTER" {
 		t.Fatalf("unexpected node info: %+v", dec.NodeInfo)
 	}
+	if dec.Source != SourceMapReport {
+		t.Errorf("unexpected source: %q", dec.Source)
+	}
 }
 
 func TestDecodeMessageProtoPosition(t *testing.T) {
@@ -92,3 +98,18 @@ func TestDecodeMessageJSONUppercase(t *testing.T) {
 		t.Errorf("expected lowercase id, got %s", dec.Telemetry[0].NodeID)
 	}
 }
+
+func TestDecodeMessageProtoText(t *testing.T) {
+	pkt := &mpb.MeshPacket{From: 3, To: 0xffffffff, RxTime: 1700000000,
+		PayloadVariant: &mpb.MeshPacket_Decoded{Decoded: &mpb.Data{Portnum: mpb.PortNum_TEXT_MESSAGE_APP, Payload: []byte("hello mesh")}}}
+	env := &mpb.ServiceEnvelope{Packet: pkt, ChannelId: "LongFast"}
+	raw, _ := proto.Marshal(env)
+	dec, err := DecodeMessage("msh/EU_868/2/e/LongFast/!00000003", base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if dec.Text == nil || dec.Text.Text != "hello mesh" || dec.Text.From != "00000003" ||
+		dec.Text.To != "ffffffff" || dec.Text.Channel != "LongFast" {
+		t.Fatalf("unexpected text: %+v", dec.Text)
+	}
+}
@@ -0,0 +1,250 @@
+package meshdump
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultHADiscoveryPrefix is the topic prefix Home Assistant listens on for
+// MQTT discovery messages.
+const DefaultHADiscoveryPrefix = "homeassistant"
+
+// haSensorClass holds the Home Assistant device class and unit of a metric.
+type haSensorClass struct {
+	deviceClass string
+	unit        string
+}
+
+// haSensorClasses maps telemetry data types to Home Assistant sensor classes.
+// Data types not listed here are exposed as plain sensors without a class.
+var haSensorClasses = map[string]haSensorClass{
+	"batteryLevel":       {"battery", "%"},
+	"voltage":            {"voltage", "V"},
+	"current":            {"current", "mA"},
+	"temperature":        {"temperature", "°C"},
+	"relativeHumidity":   {"humidity", "%"},
+	"barometricPressure": {"pressure", "hPa"},
+	"lux":                {"illuminance", "lx"},
+	"iaq":                {"aqi", ""},
+	"pm10Standard":       {"pm1", "µg/m³"},
+	"pm25Standard":       {"pm25", "µg/m³"},
+	"pm100Standard":      {"pm10", "µg/m³"},
+	"co2":                {"carbon_dioxide", "ppm"},
+	"windSpeed":          {"wind_speed", "m/s"},
+	"weight":             {"weight", "kg"},
+	"distance":           {"distance", "mm"},
+	"altitude":           {"distance", "m"},
+	"uptimeSeconds":      {"duration", "s"},
+	"channelUtilization": {"", "%"},
+	"airUtilTx":          {"", "%"},
+	"latitude":           {"", "°"},
+	"longitude":          {"", "°"},
+}
+
+// sensorClass returns the Home Assistant class for a data type. Numbered power
+// channels such as ch1Voltage share the class of their base metric.
+func sensorClass(dataType string) haSensorClass {
+	if c, ok := haSensorClasses[dataType]; ok {
+		return c
+	}
+	lower := strings.ToLower(dataType)
+	switch {
+	case strings.HasSuffix(lower, "voltage"):
+		return haSensorClasses["voltage"]
+	case strings.HasSuffix(lower, "current"):
+		return haSensorClasses["current"]
+	}
+	return haSensorClass{}
+}
+
+// haDevice is the device block of a discovery payload.
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// haSensorConfig is the discovery payload of a single sensor.
+type haSensorConfig struct {
+	Name          string   `json:"name"`
+	UniqueID      string   `json:"unique_id"`
+	ObjectID      string   `json:"object_id"`
+	StateTopic    string   `json:"state_topic"`
+	ValueTemplate string   `json:"value_template"`
+	DeviceClass   string   `json:"device_class,omitempty"`
+	Unit          string   `json:"unit_of_measurement,omitempty"`
+	StateClass    string   `json:"state_class"`
+	Device        haDevice `json:"device"`
+}
+
+// HADiscovery announces nodes and their metrics to Home Assistant. Every node
+// becomes a device and every data type seen for it a sensor whose state is
+// read from the topics written by JSONPublisher. Configs are published when a
+// new metric appears and again when the node's metadata changes.
+type HADiscovery struct {
+	pub        Publisher
+	store      Store
+	prefix     string
+	stateTopic string
+
+	mu    sync.Mutex
+	seen  map[string]map[string]bool // node -> data types announced
+	infos map[string]NodeInfo        // node metadata last announced
+}
+
+// NewHADiscovery returns a discovery publisher. stateTopic is the telemetry
+// topic template used by the JSON republisher.
+func NewHADiscovery(pub Publisher, store Store, prefix, stateTopic string) *HADiscovery {
+	if prefix == "" {
+		prefix = DefaultHADiscoveryPrefix
+	}
+	if stateTopic == "" {
+		stateTopic = DefaultTelemetryTopic
+	}
+	return &HADiscovery{
+		pub:        pub,
+		store:      store,
+		prefix:     strings.TrimSuffix(prefix, "/"),
+		stateTopic: stateTopic,
+		seen:       make(map[string]map[string]bool),
+		infos:      make(map[string]NodeInfo),
+	}
+}
+
+// haConfig is a discovery config waiting to be published.
+type haConfig struct {
+	topic   string
+	payload []byte
+}
+
+// Consume announces metrics that have not been seen before and refreshes the
+// device of nodes whose metadata changed.
+func (h *HADiscovery) Consume(dec *Decoded) {
+	h.mu.Lock()
+	var configs []haConfig
+	for _, t := range dec.Telemetry {
+		if h.seen[t.NodeID][t.DataType] {
+			continue
+		}
+		h.markSeen(t.NodeID, t.DataType)
+		configs = h.appendSensor(configs, t.NodeID, t.DataType)
+	}
+	if dec.NodeInfo != nil {
+		id := dec.NodeInfo.ID
+		if prev, ok := h.infos[id]; !ok || prev != h.nodeInfo(id) {
+			for _, dt := range h.dataTypes(id) {
+				configs = h.appendSensor(configs, id, dt)
+			}
+		}
+	}
+	h.mu.Unlock()
+	h.publish(configs)
+}
+
+// Sync announces every node and data type already present in the store. It is
+// meant to be called once at startup so existing history shows up in Home
+// Assistant without waiting for new packets.
+func (h *HADiscovery) Sync() {
+	types := make(map[string][]string)
+	nodes := h.store.Nodes()
+	for _, n := range nodes {
+		types[n.ID] = h.store.DataTypes(n.ID)
+	}
+	h.mu.Lock()
+	var configs []haConfig
+	for _, n := range nodes {
+		for _, dt := range types[n.ID] {
+			h.markSeen(n.ID, dt)
+		}
+		for _, dt := range h.dataTypes(n.ID) {
+			configs = h.appendSensor(configs, n.ID, dt)
+		}
+	}
+	h.mu.Unlock()
+	h.publish(configs)
+}
+
+func (h *HADiscovery) markSeen(node, dataType string) {
+	if h.seen[node] == nil {
+		h.seen[node] = make(map[string]bool)
+	}
+	h.seen[node][dataType] = true
+}
+
+func (h *HADiscovery) dataTypes(node string) []string {
+	types := make([]string, 0, len(h.seen[node]))
+	for dt := range h.seen[node] {
+		types = append(types, dt)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (h *HADiscovery) nodeInfo(id string) NodeInfo {
+	info, ok := h.store.Node(id)
+	if !ok {
+		info = NodeInfo{ID: id}
+	}
+	info.HasData = false
+	return info
+}
+
+// sensorConfig builds the discovery payload for a node's data type.
+func (h *HADiscovery) sensorConfig(info NodeInfo, dataType string) haSensorConfig {
+	name := info.LongName
+	if name == "" {
+		name = info.ShortName
+	}
+	if name == "" {
+		name = info.ID
+	}
+	class := sensorClass(dataType)
+	objectID := "meshdump_" + info.ID + "_" + strings.ToLower(dataType)
+	return haSensorConfig{
+		Name:          dataType,
+		UniqueID:      objectID,
+		ObjectID:      objectID,
+		StateTopic:    expandTopic(h.stateTopic, info.ID, dataType),
+		ValueTemplate: "{{ value_json.value }}",
+		DeviceClass:   class.deviceClass,
+		Unit:          class.unit,
+		StateClass:    "measurement",
+		Device: haDevice{
+			Identifiers:  []string{"meshdump_" + info.ID},
+			Name:         name,
+			Manufacturer: "Meshtastic",
+			SWVersion:    info.Firmware,
+		},
+	}
+}
+
+// appendSensor appends the discovery config of a node's data type to configs.
+// The caller must hold h.mu.
+func (h *HADiscovery) appendSensor(configs []haConfig, node, dataType string) []haConfig {
+	info := h.nodeInfo(node)
+	h.infos[node] = info
+	cfg := h.sensorConfig(info, dataType)
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		log.Printf("homeassistant: %v", err)
+		return configs
+	}
+	return append(configs, haConfig{topic: h.prefix + "/sensor/" + cfg.ObjectID + "/config", payload: b})
+}
+
+// publish sends configs. It is called without h.mu held so that a slow broker
+// does not hold up other messages.
+func (h *HADiscovery) publish(configs []haConfig) {
+	for _, c := range configs {
+		// a PublishQueue logs the messages it drops itself
+		if err := h.pub.Publish(c.topic, c.payload, true); err != nil && !errors.Is(err, ErrPublishQueueFull) {
+			log.Printf("homeassistant %s: %v", c.topic, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package meshdump
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHADiscovery(t *testing.T) {
+	fp := &fakePublisher{}
+	st := NewMemoryStore()
+	p := NewPipeline(st)
+	p.AddSink(NewHADiscovery(fp, st, "", ""))
+
+	ts := time.Unix(1700000000, 0)
+	p.Handle(&Decoded{Telemetry: []Telemetry{
+		{NodeID: "abcdef12", DataType: "batteryLevel", Value: 80, Timestamp: ts},
+		{NodeID: "abcdef12", DataType: "voltage", Value: 4.1, Timestamp: ts},
+	}})
+	// already announced metrics are not published again
+	p.Handle(&Decoded{Telemetry: []Telemetry{{NodeID: "abcdef12", DataType: "voltage", Value: 4.0, Timestamp: ts}}})
+
+	msgs := fp.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 discovery messages, got %d", len(msgs))
+	}
+	if msgs[0].topic != "homeassistant/sensor/meshdump_abcdef12_batterylevel/config" || !msgs[0].retain {
+		t.Errorf("unexpected discovery message: %+v", msgs[0])
+	}
+	var cfg haSensorConfig
+	if err := json.Unmarshal(msgs[1].payload, &cfg); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if cfg.DeviceClass != "voltage" || cfg.Unit != "V" || cfg.StateTopic != "meshdump/abcdef12/voltage" ||
+		cfg.Device.Identifiers[0] != "meshdump_abcdef12" || cfg.Device.Name != "abcdef12" {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+
+	// a node info update refreshes the device of every sensor
+	p.Handle(&Decoded{NodeInfo: &NodeInfo{ID: "abcdef12", LongName: "Garden", Firmware: "2.5"}})
+	msgs = fp.messages()
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 discovery messages, got %d", len(msgs))
+	}
+	if err := json.Unmarshal(msgs[3].payload, &cfg); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if cfg.Device.Name != "Garden" || cfg.Device.SWVersion != "2.5" {
+		t.Errorf("device not updated: %+v", cfg.Device)
+	}
+
+	// unchanged node info is ignored
+	p.Handle(&Decoded{NodeInfo: &NodeInfo{ID: "abcdef12", LongName: "Garden", Firmware: "2.5"}})
+	if n := len(fp.messages()); n != 4 {
+		t.Errorf("expected no new messages, got %d", n-4)
+	}
+}
+
+func TestHADiscoveryPublishesWithoutLock(t *testing.T) {
+	bp := &blockingPublisher{release: make(chan struct{})}
+	defer close(bp.release)
+	st := NewMemoryStore()
+	ts := time.Unix(1700000000, 0)
+	st.Add(Telemetry{NodeID: "abcdef12", DataType: "voltage", Value: 4.1, Timestamp: ts})
+	h := NewHADiscovery(bp, st, "", "")
+
+	// Sync blocks publishing the config of voltage
+	go h.Sync()
+	if !waitFor(t, time.Second, func() bool {
+		if !h.mu.TryLock() {
+			return false
+		}
+		defer h.mu.Unlock()
+		return h.seen["abcdef12"]["voltage"]
+	}) {
+		t.Fatal("Sync holds the lock while publishing")
+	}
+	done := make(chan struct{})
+	go func() {
+		h.Consume(&Decoded{Telemetry: []Telemetry{{NodeID: "abcdef12", DataType: "voltage", Value: 4.0, Timestamp: ts}}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Consume waited for Sync to publish")
+	}
+}
+
+func TestSensorClass(t *testing.T) {
+	if c := sensorClass("ch2Voltage"); c.deviceClass != "voltage" {
+		t.Errorf("unexpected class for ch2Voltage: %+v", c)
+	}
+	if c := sensorClass("numPacketsTx"); c.deviceClass != "" || c.unit != "" {
+		t.Errorf("unexpected class for unknown metric: %+v", c)
+	}
+}
@@ -0,0 +1,362 @@
+package meshdump
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sink receives every decoded message after it has been stored.
+type Sink interface {
+	Consume(dec *Decoded)
+}
+
+// Publisher sends a message to an MQTT broker. It is implemented by the
+// embedded broker and by MQTTClient so outputs can target either one.
+type Publisher interface {
+	Publish(topic string, payload []byte, retain bool) error
+}
+
+// PublisherFunc adapts a function to the Publisher interface, for example
+// Broker.Inject.
+type PublisherFunc func(topic string, payload []byte, retain bool) error
+
+// Publish calls f.
+func (f PublisherFunc) Publish(topic string, payload []byte, retain bool) error {
+	return f(topic, payload, retain)
+}
+
+// Subscriber delivers the messages published on an MQTT broker. It is
+// implemented by the embedded broker and by MQTTClient.
+type Subscriber interface {
+	// Subscribe calls fn with every message published on a topic matching
+	// filter.
+	Subscribe(filter string, fn func(topic string, payload []byte)) error
+}
+
+// PipelineConfig sizes the asynchronous ingest path started by
+// Pipeline.Start.
+type PipelineConfig struct {
+	// QueueSize is the number of raw messages waiting to be decoded, split
+	// evenly between the workers. When the queue of a worker is full further
+	// messages for it are dropped. Zero selects 1024.
+	QueueSize int
+	// Workers is the number of decoding goroutines. Every topic is decoded
+	// by the same worker, so messages of one topic are stored in the order
+	// they arrived. Zero selects 2.
+	Workers int
+	// BatchSize is the maximum number of decoded messages written to the
+	// store at once. Zero selects 100.
+	BatchSize int
+	// FlushInterval is how long decoded messages wait for a batch to fill.
+	// Zero selects 200ms.
+	FlushInterval time.Duration
+}
+
+// PipelineStats are the counters reported by /api/status/pipeline. Latency is
+// measured from the arrival of a message until it has been stored.
+type PipelineStats struct {
+	Async         bool    `json:"async"`
+	QueueDepth    int     `json:"queue_depth"`
+	QueueCapacity int     `json:"queue_capacity"`
+	Received      uint64  `json:"received"`
+	Dropped       uint64  `json:"dropped"`
+	DecodeErrors  uint64  `json:"decode_errors"`
+	Processed     uint64  `json:"processed"`
+	LatencyAvgMs  float64 `json:"latency_avg_ms"`
+	LatencyMaxMs  float64 `json:"latency_max_ms"`
+}
+
+// rawMessage is a message waiting in the ingest queue.
+type rawMessage struct {
+	topic    string
+	payload  []byte
+	received time.Time
+}
+
+// decodedMessage is a decoded message waiting for the batched writer.
+type decodedMessage struct {
+	dec      *Decoded
+	received time.Time
+}
+
+// Pipeline decodes incoming payloads, stores the results and forwards them to
+// the registered sinks.
+type Pipeline struct {
+	store   Store
+	decoder *Decoder
+	debug   bool
+
+	mu    sync.RWMutex
+	sinks []Sink
+
+	// queues hold the raw messages of every decode worker
+	queues  []chan rawMessage
+	decoded chan decodedMessage
+	// stopped is closed when the writer has stored its last batch
+	stopped chan struct{}
+
+	received     atomic.Uint64
+	dropped      atomic.Uint64
+	decodeErrors atomic.Uint64
+	processed    atomic.Uint64
+
+	latencyMu    sync.Mutex
+	latencyTotal time.Duration
+	latencyMax   time.Duration
+}
+
+// NewPipeline returns a pipeline writing to store.
+func NewPipeline(store Store) *Pipeline {
+	return &Pipeline{store: store, decoder: defaultDecoder, debug: debugEnabled()}
+}
+
+// SetDecoder replaces the decoder used by HandleMessage, for example to add
+// channel keys.
+func (p *Pipeline) SetDecoder(d *Decoder) {
+	p.decoder = d
+}
+
+// AddSink registers a sink that is notified about every decoded message.
+func (p *Pipeline) AddSink(s Sink) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sinks = append(p.sinks, s)
+}
+
+// Start switches Submit to the asynchronous path: messages are queued, decoded
+// by a pool of workers and written to the store in batches until ctx is
+// cancelled. It must be called before messages are submitted.
+func (p *Pipeline) Start(ctx context.Context, cfg PipelineConfig) {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1024
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 2
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 200 * time.Millisecond
+	}
+	size := max(1, (cfg.QueueSize+cfg.Workers-1)/cfg.Workers)
+	p.queues = make([]chan rawMessage, cfg.Workers)
+	p.decoded = make(chan decodedMessage, cfg.BatchSize)
+	p.stopped = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range p.queues {
+		queue := make(chan rawMessage, size)
+		p.queues[i] = queue
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.decodeWorker(ctx, queue)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(p.decoded)
+	}()
+	go p.writer(cfg.BatchSize, cfg.FlushInterval)
+}
+
+// Submit hands a raw message to the pipeline without waiting for it to be
+// processed. When the queue is full the message is dropped. Without Start the
+// message is processed synchronously.
+func (p *Pipeline) Submit(topic string, payload []byte) {
+	p.received.Add(1)
+	msg := rawMessage{topic: topic, payload: payload, received: time.Now()}
+	if p.queues == nil {
+		if dec, err := p.decode(msg); err == nil {
+			p.handleBatch([]decodedMessage{{dec: dec, received: msg.received}})
+		}
+		return
+	}
+	// the caller may reuse its buffer once Submit returns
+	msg.payload = append([]byte(nil), payload...)
+	select {
+	case p.queues[p.shard(topic)] <- msg:
+	default:
+		if n := p.dropped.Add(1); n == 1 || n%1000 == 0 {
+			log.Printf("ingest: queue full, %d messages dropped", n)
+		}
+	}
+}
+
+// shard returns the index of the worker decoding the messages of topic.
+func (p *Pipeline) shard(topic string) int {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// decodeWorker decodes the messages of queue until ctx is cancelled, then
+// decodes the messages still queued and returns.
+func (p *Pipeline) decodeWorker(ctx context.Context, queue <-chan rawMessage) {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case msg := <-queue:
+					p.decodeMessage(msg)
+				default:
+					return
+				}
+			}
+		case msg := <-queue:
+			p.decodeMessage(msg)
+		}
+	}
+}
+
+// decodeMessage decodes msg and passes it on to the writer.
+func (p *Pipeline) decodeMessage(msg rawMessage) {
+	if dec, err := p.decode(msg); err == nil {
+		p.decoded <- decodedMessage{dec: dec, received: msg.received}
+	}
+}
+
+// decode decodes a raw message and counts failures.
+func (p *Pipeline) decode(msg rawMessage) (*Decoded, error) {
+	dec, err := p.decoder.Decode(msg.topic, string(msg.payload))
+	if err != nil {
+		p.decodeErrors.Add(1)
+		if p.debug {
+			b := msg.payload
+			if len(b) > 200 {
+				b = append(b[:200:200], '.', '.', '.')
+			}
+			log.Printf("debug: decode failed topic=%s payload=%q err=%v", msg.topic, b, err)
+		}
+		return nil, err
+	}
+	return dec, nil
+}
+
+// Wait blocks until a pipeline started with Start has stored the messages
+// decoded before its context was cancelled. It returns immediately for a
+// synchronous pipeline.
+func (p *Pipeline) Wait() {
+	if p.stopped != nil {
+		<-p.stopped
+	}
+}
+
+// writer collects decoded messages and stores them in batches.
+func (p *Pipeline) writer(batchSize int, interval time.Duration) {
+	defer close(p.stopped)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	batch := make([]decodedMessage, 0, batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			p.handleBatch(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case m, ok := <-p.decoded:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, m)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+// HandleMessage decodes a raw payload received on topic and processes the
+// result synchronously.
+func (p *Pipeline) HandleMessage(topic string, payload []byte) error {
+	p.received.Add(1)
+	msg := rawMessage{topic: topic, payload: payload, received: time.Now()}
+	dec, err := p.decode(msg)
+	if err != nil {
+		return err
+	}
+	p.handleBatch([]decodedMessage{{dec: dec, received: msg.received}})
+	return nil
+}
+
+// Handle stores decoded telemetry and node info, updates the delivery state of
+// sent messages and passes the message on to the sinks.
+func (p *Pipeline) Handle(dec *Decoded) {
+	p.handleBatch([]decodedMessage{{dec: dec, received: time.Now()}})
+}
+
+func (p *Pipeline) handleBatch(batch []decodedMessage) {
+	var tel []Telemetry
+	var packets []PacketMeta
+	for _, m := range batch {
+		for _, t := range m.dec.Telemetry {
+			log.Printf("mqtt: message from %s type=%s value=%f", t.NodeID, t.DataType, t.Value)
+			tel = append(tel, t)
+		}
+		if m.dec.Packet != nil {
+			packets = append(packets, *m.dec.Packet)
+		}
+	}
+	p.store.AddBatch(tel)
+	p.store.AddPackets(packets)
+
+	p.mu.RLock()
+	sinks := p.sinks
+	p.mu.RUnlock()
+	now := time.Now()
+	for _, m := range batch {
+		dec := m.dec
+		if dec.NodeInfo != nil {
+			p.store.SetNodeInfo(*dec.NodeInfo, dec.Source)
+		}
+		if dec.Ack != nil && p.store.AckSentMessage(dec.Ack.RequestID, dec.Ack.Error) {
+			log.Printf("send: message %08x acknowledged by %s %s", dec.Ack.RequestID, dec.Ack.From, dec.Ack.Error)
+		}
+		for _, s := range sinks {
+			s.Consume(dec)
+		}
+		p.observe(now.Sub(m.received))
+	}
+}
+
+func (p *Pipeline) observe(d time.Duration) {
+	p.processed.Add(1)
+	p.latencyMu.Lock()
+	p.latencyTotal += d
+	if d > p.latencyMax {
+		p.latencyMax = d
+	}
+	p.latencyMu.Unlock()
+}
+
+// Stats returns the queue state and message counters of the pipeline.
+func (p *Pipeline) Stats() PipelineStats {
+	st := PipelineStats{
+		Async:        p.queues != nil,
+		Received:     p.received.Load(),
+		Dropped:      p.dropped.Load(),
+		DecodeErrors: p.decodeErrors.Load(),
+		Processed:    p.processed.Load(),
+	}
+	for _, q := range p.queues {
+		st.QueueDepth += len(q)
+		st.QueueCapacity += cap(q)
+	}
+	p.latencyMu.Lock()
+	if st.Processed > 0 {
+		st.LatencyAvgMs = float64(p.latencyTotal) / float64(st.Processed) / float64(time.Millisecond)
+	}
+	st.LatencyMaxMs = float64(p.latencyMax) / float64(time.Millisecond)
+	p.latencyMu.Unlock()
+	return st
+}
@@ -0,0 +1,118 @@
+package meshdump
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipelineAsync(t *testing.T) {
+	st, err := NewStore(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	p := NewPipeline(st)
+	fp := &fakePublisher{}
+	p.AddSink(NewJSONPublisher(fp, RepublishConfig{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.Start(ctx, PipelineConfig{Workers: 4, BatchSize: 10, FlushInterval: 20 * time.Millisecond})
+
+	const n = 250
+	for i := 0; i < n; i++ {
+		p.Submit("msh/test", []byte(fmt.Sprintf(`{"NodeID":"00000001","DataType":"voltage","Value":%d}`, i)))
+	}
+	p.Submit("msh/test", []byte("not a meshtastic message"))
+	if !waitFor(t, 5*time.Second, func() bool { return len(st.Get("00000001")) == n }) {
+		t.Fatalf("stored %d of %d messages", len(st.Get("00000001")), n)
+	}
+	if !waitFor(t, time.Second, func() bool { return len(fp.messages()) == n }) {
+		t.Errorf("sinks saw %d of %d messages", len(fp.messages()), n)
+	}
+	// one topic is decoded by one worker and keeps its order
+	for i, m := range fp.messages() {
+		if want := fmt.Sprintf(`"value":%d,`, i); !strings.Contains(string(m.payload), want) {
+			t.Fatalf("message %d out of order: %s", i, m.payload)
+		}
+	}
+	stats := p.Stats()
+	if !stats.Async || stats.Received != n+1 || stats.Processed != n || stats.DecodeErrors != 1 ||
+		stats.Dropped != 0 || stats.QueueCapacity != 1024 || stats.LatencyMaxMs <= 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPipelineWait(t *testing.T) {
+	st := NewMemoryStore()
+	p := NewPipeline(st)
+	p.Wait() // not started
+	ctx, cancel := context.WithCancel(context.Background())
+	p.Start(ctx, PipelineConfig{FlushInterval: time.Hour})
+	p.Submit("msh/test", []byte(`{"NodeID":"00000001","DataType":"voltage","Value":1}`))
+	if !waitFor(t, 5*time.Second, func() bool { return p.Stats().QueueDepth == 0 }) {
+		t.Fatal("message not decoded")
+	}
+	cancel()
+	p.Wait()
+	if got := st.Get("00000001"); len(got) != 1 {
+		t.Errorf("stored %v after Wait", got)
+	}
+}
+
+func TestPipelineDrainsOnShutdown(t *testing.T) {
+	st := NewMemoryStore()
+	p := NewPipeline(st)
+	ctx, cancel := context.WithCancel(context.Background())
+	p.Start(ctx, PipelineConfig{FlushInterval: time.Hour})
+	const n = 200
+	for i := 0; i < n; i++ {
+		p.Submit(fmt.Sprintf("msh/test/%d", i%7), []byte(fmt.Sprintf(`{"NodeID":"00000001","DataType":"voltage","Value":%d}`, i)))
+	}
+	cancel()
+	p.Wait()
+	if got := len(st.Get("00000001")); got != n {
+		t.Errorf("stored %d of %d queued messages", got, n)
+	}
+}
+
+func TestPipelineDropsWhenFull(t *testing.T) {
+	p := NewPipeline(NewMemoryStore())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.Start(ctx, PipelineConfig{QueueSize: 2, Workers: 1})
+	p.Wait() // no worker drains the queue any more
+	for i := 0; i < 5; i++ {
+		p.Submit("msh/test", []byte(`{"NodeID":"00000001","DataType":"voltage","Value":1}`))
+	}
+	if st := p.Stats(); st.Dropped != 3 || st.QueueDepth != 2 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestStoreAddBatchPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	st, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	st.AddBatch([]Telemetry{
+		{NodeID: "00000001", DataType: "voltage", Value: 4.1, Timestamp: now},
+		{NodeID: "00000001", DataType: "temperature", Value: 21, Timestamp: now},
+		{NodeID: "00000002", DataType: "voltage", Value: 3.9, Timestamp: now},
+	})
+	st.Close()
+
+	st, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if len(st.Get("00000001")) != 2 || len(st.Get("00000002")) != 1 || len(st.Nodes()) != 2 {
+		t.Errorf("batch not persisted: %v %v", st.Get("00000001"), st.Nodes())
+	}
+}
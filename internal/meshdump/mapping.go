@@ -0,0 +1,173 @@
+package meshdump
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldMapping maps a value of a JSON payload to a telemetry data type. The
+// value is multiplied by Scale when it is non-zero.
+type FieldMapping struct {
+	Path     string  `json:"path"`
+	DataType string  `json:"data_type"`
+	Scale    float64 `json:"scale"`
+}
+
+// JSONMapping decodes plain JSON payloads published on topics matching the
+// Topic filter, for sensors that do not speak the Meshtastic formats. The node
+// ID is taken from the NodeSegment-th level of the topic (counting from 1) or
+// from the value at NodePath. Paths are dot separated object keys and array
+// indexes such as "sensors.0.value".
+type JSONMapping struct {
+	Topic         string         `json:"topic"`
+	NodeSegment   int            `json:"node_segment"`
+	NodePath      string         `json:"node_path"`
+	TimestampPath string         `json:"timestamp_path"`
+	Fields        []FieldMapping `json:"fields"`
+}
+
+// LoadJSONMappings reads mapping rules from a JSON file containing a list of
+// JSONMapping objects.
+func LoadJSONMappings(path string) ([]JSONMapping, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ms []JSONMapping
+	if err := json.Unmarshal(b, &ms); err != nil {
+		return nil, fmt.Errorf("mappings %s: %v", path, err)
+	}
+	for i, m := range ms {
+		if err := m.validate(); err != nil {
+			return nil, fmt.Errorf("mappings %s: rule %d: %v", path, i+1, err)
+		}
+	}
+	return ms, nil
+}
+
+func (m JSONMapping) validate() error {
+	if m.Topic == "" {
+		return fmt.Errorf("missing topic")
+	}
+	if m.NodeSegment <= 0 && m.NodePath == "" {
+		return fmt.Errorf("missing node_segment or node_path")
+	}
+	if len(m.Fields) == 0 {
+		return fmt.Errorf("no fields")
+	}
+	for _, f := range m.Fields {
+		if f.Path == "" || f.DataType == "" {
+			return fmt.Errorf("field needs path and data_type")
+		}
+	}
+	return nil
+}
+
+// jsonPath returns the value at path in a decoded JSON document.
+func jsonPath(v any, path string) (any, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch cur := v.(type) {
+		case map[string]any:
+			next, ok := cur[key]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(cur) {
+				return nil, false
+			}
+			v = cur[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// jsonNumber converts a JSON value to a number. Booleans become 0 or 1 and
+// numeric strings are parsed.
+func jsonNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// decode applies the mapping to a payload received on topic. It reports false
+// when the topic does not match or no field could be extracted.
+func (m JSONMapping) decode(topic string, data []byte) (*Decoded, bool) {
+	if !filterCovers(m.Topic, topic) {
+		return nil, false
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, false
+	}
+
+	var node string
+	if m.NodePath != "" {
+		if v, ok := jsonPath(doc, m.NodePath); ok {
+			switch id := v.(type) {
+			case string:
+				node = id
+			case float64:
+				node = strconv.FormatFloat(id, 'f', -1, 64)
+			}
+		}
+	}
+	if node == "" && m.NodeSegment > 0 {
+		if parts := strings.Split(topic, "/"); m.NodeSegment <= len(parts) {
+			node = parts[m.NodeSegment-1]
+		}
+	}
+	if node == "" {
+		return nil, false
+	}
+
+	ts := time.Now()
+	if m.TimestampPath != "" {
+		if v, ok := jsonPath(doc, m.TimestampPath); ok {
+			if sec, ok := jsonNumber(v); ok && sec > 0 {
+				ts = time.Unix(int64(sec), 0)
+			}
+		}
+	}
+
+	var out []Telemetry
+	for _, f := range m.Fields {
+		v, ok := jsonPath(doc, f.Path)
+		if !ok {
+			continue
+		}
+		val, ok := jsonNumber(v)
+		if !ok {
+			continue
+		}
+		if f.Scale != 0 {
+			val *= f.Scale
+		}
+		out = append(out, Telemetry{NodeID: node, DataType: f.DataType, Value: val, Timestamp: ts})
+	}
+	if len(out) == 0 {
+		return nil, false
+	}
+	return &Decoded{Telemetry: out}, true
+}
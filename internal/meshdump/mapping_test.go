@@ -0,0 +1,69 @@
+package meshdump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJSONMappingDecode(t *testing.T) {
+	d := &Decoder{Mappings: []JSONMapping{
+		{Topic: "sensors/+/soil", NodeSegment: 2, Fields: []FieldMapping{
+			{Path: "moisture", DataType: "soil_moisture"},
+			{Path: "t", DataType: "temperature"},
+			{Path: "battery.mv", DataType: "voltage", Scale: 0.001},
+		}},
+		{Topic: "weather/#", NodePath: "station.id", TimestampPath: "time", Fields: []FieldMapping{
+			{Path: "readings.0.value", DataType: "temperature"},
+			{Path: "rain", DataType: "rain"},
+		}},
+	}}
+
+	dec, err := d.Decode("sensors/garden/soil", `{"moisture": 41, "t": 17.2, "battery": {"mv": "3710"}}`)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := map[string]float64{"soil_moisture": 41, "temperature": 17.2, "voltage": 3.71}
+	if len(dec.Telemetry) != len(want) {
+		t.Fatalf("unexpected telemetry: %+v", dec.Telemetry)
+	}
+	for _, tel := range dec.Telemetry {
+		if tel.NodeID != "garden" || tel.Value != want[tel.DataType] {
+			t.Errorf("unexpected entry: %+v", tel)
+		}
+	}
+
+	dec, err = d.Decode("weather/roof", `{"station": {"id": "roof-1"}, "time": 1700000000, "readings": [{"value": 9.5}], "rain": true}`)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(dec.Telemetry) != 2 || dec.Telemetry[0].NodeID != "roof-1" || dec.Telemetry[0].Value != 9.5 ||
+		dec.Telemetry[1].Value != 1 || !dec.Telemetry[0].Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected telemetry: %+v", dec.Telemetry)
+	}
+
+	// payloads without mapped fields and other topics use the built-in formats
+	if _, err := d.Decode("sensors/garden/soil", `{"unrelated": 1}`); err == nil {
+		t.Errorf("expected error for payload without mapped fields")
+	}
+	dec, err = d.Decode("msh/test", `{"NodeID":"00000001","DataType":"voltage","Value":4.2}`)
+	if err != nil || dec.Telemetry[0].NodeID != "00000001" {
+		t.Errorf("built-in JSON format not decoded: %+v %v", dec, err)
+	}
+}
+
+func TestLoadJSONMappings(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.json")
+	os.WriteFile(good, []byte(`[{"topic":"sensors/#","node_segment":2,"fields":[{"path":"t","data_type":"temperature"}]}]`), 0o600)
+	ms, err := LoadJSONMappings(good)
+	if err != nil || len(ms) != 1 || ms[0].Fields[0].DataType != "temperature" {
+		t.Fatalf("unexpected result: %+v %v", ms, err)
+	}
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(`[{"topic":"sensors/#","fields":[{"path":"t","data_type":"temperature"}]}]`), 0o600)
+	if _, err := LoadJSONMappings(bad); err == nil {
+		t.Errorf("expected error for rule without node id source")
+	}
+}
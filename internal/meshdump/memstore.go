@@ -0,0 +1,359 @@
+package meshdump
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store keeping everything in memory. Its contents are lost
+// when the process exits.
+type MemoryStore struct {
+	mu    sync.Mutex
+	data  map[string][]Telemetry
+	nodes map[string]NodeInfo
+	order []string
+	sent  []SentMessage
+	// rollups holds the aggregates of the retention tiers, oldest first
+	rollups map[string][]Rollup
+	// packets holds the metadata of the most recent packets, oldest first
+	packets []PacketMeta
+	// activity holds when nodes were heard
+	activity map[string]*NodeActivity
+	// versions holds the latest metadata version of every node and history
+	// the versions themselves
+	versions map[string]int
+	history  map[string][]NodeChange
+	// annotations holds what operators recorded about nodes
+	annotations map[string]NodeAnnotation
+	debug       bool
+}
+
+// NewMemoryStore returns an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		data:        make(map[string][]Telemetry),
+		rollups:     make(map[string][]Rollup),
+		nodes:       make(map[string]NodeInfo),
+		order:       []string{},
+		activity:    make(map[string]*NodeActivity),
+		versions:    make(map[string]int),
+		history:     make(map[string][]NodeChange),
+		annotations: make(map[string]NodeAnnotation),
+		debug:       debugEnabled(),
+	}
+	if s.debug {
+		log.Printf("store debug enabled")
+	}
+	return s
+}
+
+// Add stores a telemetry entry.
+func (s *MemoryStore) Add(t Telemetry) {
+	s.addBatch([]Telemetry{t})
+}
+
+// AddBatch stores several telemetry entries.
+func (s *MemoryStore) AddBatch(entries []Telemetry) {
+	s.addBatch(entries)
+}
+
+// addBatch stores entries and returns the IDs of the nodes seen for the first
+// time.
+func (s *MemoryStore) addBatch(entries []Telemetry) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range entries {
+		log.Printf("store: add node=%s type=%s value=%f", t.NodeID, t.DataType, t.Value)
+		s.data[t.NodeID] = append(s.data[t.NodeID], t)
+	}
+	return s.discover(entries)
+}
+
+// registerNodes adds the nodes of entries to the node list without keeping
+// the telemetry and returns the IDs of the nodes seen for the first time.
+func (s *MemoryStore) registerNodes(entries []Telemetry) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.discover(entries)
+}
+
+// discover adds unknown nodes of entries to the node list. The caller must
+// hold s.mu.
+func (s *MemoryStore) discover(entries []Telemetry) []string {
+	var newNodes []string
+	for _, t := range entries {
+		if _, ok := s.nodes[t.NodeID]; !ok {
+			s.nodes[t.NodeID] = NodeInfo{ID: t.NodeID}
+			s.order = append(s.order, t.NodeID)
+			newNodes = append(newNodes, t.NodeID)
+			if s.debug {
+				log.Printf("debug: discovered node %s", t.NodeID)
+			}
+		}
+	}
+	return newNodes
+}
+
+// Get returns the raw telemetry of the given node ID.
+func (s *MemoryStore) Get(nodeID string) []Telemetry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Telemetry(nil), s.data[nodeID]...)
+}
+
+// DataTypes returns the sorted data types kept for a node.
+func (s *MemoryStore) DataTypes(nodeID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, t := range s.data[nodeID] {
+		seen[t.DataType] = true
+	}
+	for _, r := range s.rollups[nodeID] {
+		seen[r.DataType] = true
+	}
+	types := make([]string, 0, len(seen))
+	for dt := range seen {
+		types = append(types, dt)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Query returns the telemetry of a node selected by q.
+func (s *MemoryStore) Query(nodeID string, q TelemetryQuery) []Telemetry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return runQuery(nodeID, q, s.rollups[nodeID], s.data[nodeID])
+}
+
+// Rollups returns the aggregated telemetry of a node, oldest first.
+func (s *MemoryStore) Rollups(nodeID string) []Rollup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Rollup(nil), s.rollups[nodeID]...)
+}
+
+// Nodes returns the list of known nodes with associated metadata.
+func (s *MemoryStore) Nodes() []NodeInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]NodeInfo, 0, len(s.order))
+	for _, id := range s.order {
+		n := s.nodes[id]
+		n.HasData = s.hasData(id)
+		out = append(out, n)
+	}
+	return out
+}
+
+// SetNodeInfo stores metadata about a node and records changes in its
+// history. The history is appended under the lock that assigns the version so
+// concurrent updates are recorded in version order.
+func (s *MemoryStore) SetNodeInfo(info NodeInfo, source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, c, ok := s.setNodeInfo(info, source); ok {
+		s.history[info.ID] = append(s.history[info.ID], c)
+	}
+}
+
+// setNodeInfo stores metadata about a node and returns the stored metadata
+// and the new version when the metadata changed. The caller must hold s.mu.
+func (s *MemoryStore) setNodeInfo(info NodeInfo, source string) (NodeInfo, NodeChange, bool) {
+	prev, ok := s.nodes[info.ID]
+	if !ok {
+		s.order = append(s.order, info.ID)
+	}
+	if source != SourceAPI {
+		info = prev.merge(info)
+	}
+	info.HasData = false
+	s.nodes[info.ID] = info
+	if s.debug {
+		log.Printf("debug: node info updated %+v", info)
+	}
+	c, changed := nodeChange(prev, info, source, s.versions[info.ID]+1)
+	if changed {
+		s.versions[info.ID] = c.Version
+	}
+	return info, c, changed
+}
+
+// NodeHistory returns the versions of the metadata of a node, oldest first.
+func (s *MemoryStore) NodeHistory(id string) []NodeChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]NodeChange(nil), s.history[id]...)
+}
+
+// Node retrieves metadata for the given node ID. If not present, the returned
+// boolean is false.
+func (s *MemoryStore) Node(id string) (NodeInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[id]
+	if ok {
+		n.HasData = s.hasData(id)
+	}
+	return n, ok
+}
+
+// hasData reports whether any telemetry is kept for a node. The caller must
+// hold s.mu.
+func (s *MemoryStore) hasData(id string) bool {
+	return len(s.data[id]) > 0 || len(s.rollups[id]) > 0
+}
+
+// AddSentMessage records a message sent to the mesh.
+func (s *MemoryStore) AddSentMessage(m SentMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, m)
+}
+
+// SentMessages returns the messages sent to the mesh, oldest first.
+func (s *MemoryStore) SentMessages() []SentMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SentMessage(nil), s.sent...)
+}
+
+// AckSentMessage updates the delivery state of the sent message with the given
+// packet ID. An empty errReason marks the message as acknowledged. The result
+// is false when no such message exists.
+func (s *MemoryStore) AckSentMessage(id uint32, errReason string) bool {
+	_, ok := s.ackSentMessage(id, errReason)
+	return ok
+}
+
+// ackSentMessage is AckSentMessage returning the updated message.
+func (s *MemoryStore) ackSentMessage(id uint32, errReason string) (SentMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.sent {
+		if s.sent[i].ID != id {
+			continue
+		}
+		m := &s.sent[i]
+		if errReason == "" {
+			m.Status = SendAcked
+		} else {
+			m.Status = SendFailed
+		}
+		m.Error = errReason
+		return *m, true
+	}
+	return SentMessage{}, false
+}
+
+// packetLimit is the number of packet metadata records kept in memory.
+const packetLimit = 1000
+
+// AddPackets records the metadata of received packets and the activity of
+// their nodes. Only the most recent packetLimit records are kept.
+func (s *MemoryStore) AddPackets(ps []PacketMeta) {
+	s.addPackets(ps)
+}
+
+// addPackets is AddPackets returning the updated activity of the nodes that
+// sent ps.
+func (s *MemoryStore) addPackets(ps []PacketMeta) map[string]NodeActivity {
+	if len(ps) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets = append(s.packets, ps...)
+	if n := len(s.packets) - packetLimit; n > 0 {
+		s.packets = append([]PacketMeta(nil), s.packets[n:]...)
+	}
+	updated := make(map[string]NodeActivity)
+	for _, p := range ps {
+		if p.NodeID == "" {
+			continue
+		}
+		a := s.activity[p.NodeID]
+		if a == nil {
+			a = &NodeActivity{}
+			s.activity[p.NodeID] = a
+		}
+		a.record(p)
+		updated[p.NodeID] = a.clone()
+	}
+	return updated
+}
+
+// Activity returns when a node was heard and its packet counts.
+func (s *MemoryStore) Activity(id string) (NodeActivity, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.activity[id]
+	if !ok {
+		return NodeActivity{}, false
+	}
+	return a.clone(), true
+}
+
+// Annotation returns what operators recorded about a node.
+func (s *MemoryStore) Annotation(id string) (NodeAnnotation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.annotations[id]
+	return a.clone(), ok
+}
+
+// SetAnnotation replaces the annotation of a node.
+func (s *MemoryStore) SetAnnotation(id string, a NodeAnnotation) {
+	s.setAnnotation(id, a)
+}
+
+// setAnnotation normalizes and stores a, or removes the annotation of the node
+// when a is empty, and returns the stored annotation.
+func (s *MemoryStore) setAnnotation(id string, a NodeAnnotation) NodeAnnotation {
+	a = a.normalize()
+	a.UpdatedAt = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a.empty() {
+		delete(s.annotations, id)
+	} else {
+		s.annotations[id] = a.clone()
+	}
+	return a
+}
+
+// Packets returns the metadata of recent packets, newest first, for which
+// match returns true. A nil match selects every packet. At most limit records
+// are returned when limit is positive.
+func (s *MemoryStore) Packets(match func(PacketMeta) bool, limit int) []PacketMeta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []PacketMeta
+	for i := len(s.packets) - 1; i >= 0; i-- {
+		if match != nil && !match(s.packets[i]) {
+			continue
+		}
+		out = append(out, s.packets[i])
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out
+}
+
+// Compact applies the retention tiers at time now.
+func (s *MemoryStore) Compact(tiers []RetentionTier, now time.Time) CompactStats {
+	st := s.compact(tiers, now)
+	if len(tiers) > 0 && tiers[0].MaxAge > 0 {
+		st.Pruned = s.prunePackets(packetCutoff(tiers, now))
+	}
+	return st
+}
+
+// Close does nothing; it is part of the Store interface.
+func (s *MemoryStore) Close() error {
+	return nil
+}
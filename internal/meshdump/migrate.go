@@ -0,0 +1,305 @@
+package meshdump
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Migration is a schema change of the SQLite database. Migrations are applied
+// in version order, each in its own transaction, and recorded in the
+// schema_migrations table.
+type Migration struct {
+	Version int
+	Name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change, oldest first. Released migrations
+// must not be changed; add a new one instead. The first two also bring
+// databases created before versioning up to date, so they only create what
+// is missing.
+var migrations = []Migration{
+	{1, "initial schema", execSQL(`CREATE TABLE IF NOT EXISTS nodes (
+    node_id TEXT PRIMARY KEY,
+    long_name TEXT,
+    short_name TEXT,
+    firmware TEXT
+);
+CREATE TABLE IF NOT EXISTS telemetry (
+    node_id TEXT NOT NULL,
+    data_type TEXT,
+    value REAL,
+    timestamp TEXT,
+    FOREIGN KEY(node_id) REFERENCES nodes(node_id)
+);
+CREATE INDEX IF NOT EXISTS idx_telemetry_node_id ON telemetry(node_id);
+CREATE TABLE IF NOT EXISTS sent_messages (
+    id INTEGER PRIMARY KEY,
+    to_node TEXT,
+    channel TEXT,
+    text TEXT,
+    want_ack INTEGER,
+    timestamp TEXT,
+    status TEXT,
+    error TEXT
+);
+CREATE TABLE IF NOT EXISTS packets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    timestamp TEXT,
+    node_id TEXT,
+    topic TEXT,
+    root TEXT,
+    region TEXT,
+    format TEXT,
+    channel TEXT,
+    gateway TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_packets_node_id ON packets(node_id);
+CREATE TABLE IF NOT EXISTS rollups (
+    node_id TEXT NOT NULL,
+    data_type TEXT NOT NULL,
+    resolution INTEGER NOT NULL,
+    timestamp TEXT NOT NULL,
+    count INTEGER,
+    min REAL,
+    max REAL,
+    avg REAL,
+    PRIMARY KEY (node_id, data_type, resolution, timestamp)
+);`)},
+	{2, "node hardware and last heard", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "nodes", "hardware", "TEXT"); err != nil {
+			return err
+		}
+		return addColumn(tx, "nodes", "last_heard", "INTEGER")
+	}},
+	// timestamps become Unix milliseconds and data types references to a
+	// dictionary, and telemetry is indexed for range queries per metric
+	{3, "integer timestamps and metric dictionary", integerTimestamps},
+	// node activity starts from the packets and telemetry already stored;
+	// packet counts by port start empty as the port was not recorded
+	{4, "node activity", execSQL(`ALTER TABLE packets ADD COLUMN port TEXT;
+CREATE TABLE node_activity (
+    node_id TEXT PRIMARY KEY,
+    first_seen INTEGER,
+    last_seen INTEGER,
+    last_position_time INTEGER
+);
+CREATE TABLE node_packet_counts (
+    node_id TEXT NOT NULL,
+    port TEXT NOT NULL,
+    count INTEGER NOT NULL,
+    PRIMARY KEY (node_id, port)
+);
+INSERT INTO node_activity (node_id, first_seen, last_seen, last_position_time)
+    SELECT node_id, MIN(first), MAX(last), 0 FROM (
+        SELECT node_id, unixepoch(timestamp) AS first, unixepoch(timestamp) AS last FROM packets
+            WHERE node_id != '' AND unixepoch(timestamp) IS NOT NULL
+        UNION ALL
+        SELECT node_id, MIN(ts) / 1000, MAX(ts) / 1000 FROM telemetry GROUP BY node_id
+    ) GROUP BY node_id;`)},
+	// the history of every node with metadata starts with its current state
+	{5, "node metadata history", execSQL(`ALTER TABLE nodes ADD COLUMN role TEXT;
+CREATE TABLE node_history (
+    node_id TEXT NOT NULL,
+    version INTEGER NOT NULL,
+    ts INTEGER NOT NULL,
+    source TEXT NOT NULL,
+    long_name TEXT,
+    short_name TEXT,
+    firmware TEXT,
+    hardware TEXT,
+    role TEXT,
+    changed TEXT,
+    PRIMARY KEY (node_id, version)
+);
+INSERT INTO node_history (node_id, version, ts, source, long_name, short_name, firmware, hardware, role, changed)
+    SELECT node_id, 1, CAST(unixepoch('subsec') * 1000 AS INTEGER), 'migration',
+        COALESCE(long_name, ''), COALESCE(short_name, ''), COALESCE(firmware, ''), COALESCE(hardware, ''), '', ''
+    FROM nodes
+    WHERE COALESCE(long_name, '') != '' OR COALESCE(short_name, '') != '' OR COALESCE(firmware, '') != '' OR COALESCE(hardware, '') != '';`)},
+	{6, "node annotations", execSQL(`CREATE TABLE node_annotations (
+    node_id TEXT PRIMARY KEY,
+    display_name TEXT,
+    group_name TEXT,
+    location TEXT,
+    owner TEXT,
+    notes TEXT,
+    updated_at INTEGER NOT NULL
+);
+CREATE TABLE node_tags (
+    node_id TEXT NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (node_id, tag)
+);`)},
+}
+
+// execSQL returns a migration step running statements.
+func execSQL(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// addColumn adds a column to an existing table unless it is already present.
+func addColumn(tx *sql.Tx, table, column, typ string) error {
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + typ)
+	return err
+}
+
+// integerTimestampsSQL converts telemetry and rollups to Unix millisecond
+// timestamps and the metric dictionary.
+const integerTimestampsSQL = `CREATE TABLE metrics (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+INSERT INTO metrics (name)
+    SELECT data_type FROM telemetry WHERE data_type IS NOT NULL
+    UNION SELECT data_type FROM rollups;
+CREATE TABLE telemetry_new (
+    node_id TEXT NOT NULL,
+    metric_id INTEGER NOT NULL REFERENCES metrics(id),
+    value REAL,
+    ts INTEGER NOT NULL,
+    FOREIGN KEY(node_id) REFERENCES nodes(node_id)
+);
+INSERT INTO telemetry_new (node_id, metric_id, value, ts)
+    SELECT t.node_id, m.id, t.value, CAST(round(unixepoch(t.timestamp, 'subsec') * 1000) AS INTEGER)
+    FROM telemetry t JOIN metrics m ON m.name = t.data_type
+    WHERE unixepoch(t.timestamp) IS NOT NULL
+    ORDER BY t.rowid;
+DROP TABLE telemetry;
+ALTER TABLE telemetry_new RENAME TO telemetry;
+CREATE INDEX idx_telemetry_node_metric_ts ON telemetry(node_id, metric_id, ts);
+CREATE INDEX idx_telemetry_ts ON telemetry(ts);
+CREATE TABLE rollups_new (
+    node_id TEXT NOT NULL,
+    metric_id INTEGER NOT NULL REFERENCES metrics(id),
+    resolution INTEGER NOT NULL,
+    ts INTEGER NOT NULL,
+    count INTEGER,
+    min REAL,
+    max REAL,
+    avg REAL,
+    PRIMARY KEY (node_id, metric_id, resolution, ts)
+);
+INSERT INTO rollups_new (node_id, metric_id, resolution, ts, count, min, max, avg)
+    SELECT r.node_id, m.id, r.resolution, unixepoch(r.timestamp) * 1000, r.count, r.min, r.max, r.avg
+    FROM rollups r JOIN metrics m ON m.name = r.data_type
+    WHERE unixepoch(r.timestamp) IS NOT NULL;
+DROP TABLE rollups;
+ALTER TABLE rollups_new RENAME TO rollups;
+CREATE INDEX idx_rollups_resolution_ts ON rollups(resolution, ts);`
+
+// integerTimestamps applies integerTimestampsSQL and logs how many rows are
+// dropped because their timestamp or data type is missing or cannot be
+// parsed.
+func integerTimestamps(tx *sql.Tx) error {
+	var telemetry, rollups int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM telemetry WHERE data_type IS NULL OR unixepoch(timestamp) IS NULL").Scan(&telemetry); err != nil {
+		return err
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM rollups WHERE unixepoch(timestamp) IS NULL").Scan(&rollups); err != nil {
+		return err
+	}
+	if telemetry > 0 || rollups > 0 {
+		log.Printf("store: dropping %d telemetry rows and %d rollups with an invalid timestamp or data type", telemetry, rollups)
+	}
+	return execSQL(integerTimestampsSQL)(tx)
+}
+
+// schemaVersion returns the highest migration applied to db, zero for a
+// database without a version table.
+func schemaVersion(db *sql.DB) (int, error) {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").Scan(&n); err != nil || n == 0 {
+		return 0, err
+	}
+	var v int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&v)
+	return v, err
+}
+
+// migrate applies the pending migrations to db and returns them. With dryRun
+// the pending migrations are only reported.
+func migrate(db *sql.DB, dryRun bool) ([]Migration, error) {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	latest := migrations[len(migrations)-1].Version
+	if current > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than the supported version %d", current, latest)
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	if dryRun || len(pending) == 0 {
+		return pending, nil
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT,
+    applied_at TEXT
+)`); err != nil {
+		return nil, err
+	}
+	for i, m := range pending {
+		if err := applyMigration(db, m); err != nil {
+			return pending[:i], fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		log.Printf("store: applied migration %d (%s)", m.Version, m.Name)
+	}
+	return pending, nil
+}
+
+// applyMigration runs m and records it in a single transaction.
+func applyMigration(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		m.Version, m.Name, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrateSQLite brings the database at path up to the current schema and
+// returns the migrations it applied. With dryRun nothing is changed and the
+// pending migrations are returned; a missing database is not created.
+func MigrateSQLite(path string, dryRun bool) ([]Migration, error) {
+	if dryRun {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return append([]Migration(nil), migrations...), nil
+		}
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA busy_timeout=5000"); err != nil {
+		return nil, err
+	}
+	return migrate(db, dryRun)
+}
@@ -0,0 +1,206 @@
+package meshdump
+
+import (
+	"bytes"
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	pending, err := MigrateSQLite(path, true)
+	if err != nil || len(pending) != len(migrations) {
+		t.Fatalf("dry run on a missing file: %v %v", pending, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("dry run created the database")
+	}
+
+	applied, err := MigrateSQLite(path, false)
+	if err != nil || len(applied) != len(migrations) {
+		t.Fatalf("migrate: %v %v", applied, err)
+	}
+	if pending, err := MigrateSQLite(path, true); err != nil || len(pending) != 0 {
+		t.Errorf("dry run after migrating: %v %v", pending, err)
+	}
+	if applied, err := MigrateSQLite(path, false); err != nil || len(applied) != 0 {
+		t.Errorf("second migration: %v %v", applied, err)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the schema of the first release, without a version table
+	if _, err := db.Exec(`CREATE TABLE nodes (node_id TEXT PRIMARY KEY, long_name TEXT, short_name TEXT, firmware TEXT);
+CREATE TABLE telemetry (node_id TEXT NOT NULL, data_type TEXT, value REAL, timestamp TEXT);
+INSERT INTO nodes VALUES ('n1', 'One', 'N1', '2.3');
+INSERT INTO telemetry VALUES ('n1', 'voltage', 4.1, '2024-05-20T12:00:00Z');`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	pending, err := MigrateSQLite(path, true)
+	if err != nil || len(pending) != len(migrations) || pending[0].Version != 1 {
+		t.Fatalf("dry run: %v %v", pending, err)
+	}
+	s, err := OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n, ok := s.Node("n1"); !ok || n.LongName != "One" || !n.HasData {
+		t.Errorf("node after migration: %+v", n)
+	}
+	s.SetNodeInfo(NodeInfo{ID: "n1", LongName: "One", Hardware: "RAK4631"}, SourceAPI)
+	if h := s.Health(); !h.Healthy {
+		t.Errorf("write to migrated database failed: %s", h.LastError)
+	}
+	if len(s.Get("n1")) != 1 {
+		t.Errorf("telemetry after migration: %v", s.Get("n1"))
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	if _, err := MigrateSQLite(path, false); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name) VALUES (1000, 'future')"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := OpenSQLiteStore(path); err == nil {
+		t.Error("opened a database with a newer schema")
+	}
+	if _, err := NewStore(path); err == nil {
+		t.Error("NewStore fell back to memory for a database with a newer schema")
+	}
+}
+
+// openAtVersion creates a database at path with the migrations up to version.
+func openAtVersion(t testing.TB, path string, version int) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, name TEXT, applied_at TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if m.Version > version {
+			break
+		}
+		if err := applyMigration(db, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestMigrateIntegerTimestamps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	db := openAtVersion(t, path, 2)
+	if _, err := db.Exec(`INSERT INTO nodes (node_id) VALUES ('n1');
+INSERT INTO telemetry VALUES ('n1', 'voltage', 4.1, '2024-05-20T14:00:00.25+02:00');
+INSERT INTO telemetry VALUES ('n1', 'temperature', 21, '2024-05-20T12:00:01.123456789Z');
+INSERT INTO telemetry VALUES ('n1', 'voltage', 4.0, 'garbage');
+INSERT INTO rollups VALUES ('n1', 'voltage', 3600, '2024-05-20T10:00:00Z', 2, 3.9, 4.2, 4.05);`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	s, err := OpenSQLiteStore(path)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !strings.Contains(logged.String(), "dropping 1 telemetry rows and 0 rollups") {
+		t.Errorf("dropped rows not logged: %s", logged.String())
+	}
+	base := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+	got := s.Get("n1")
+	if len(got) != 2 || got[0].DataType != "voltage" || !got[0].Timestamp.Equal(base.Add(250*time.Millisecond)) ||
+		got[1].DataType != "temperature" || !got[1].Timestamp.Equal(base.Add(1123*time.Millisecond)) {
+		t.Errorf("telemetry after migration: %v", got)
+	}
+	rs := s.Rollups("n1")
+	if len(rs) != 1 || !rs[0].Timestamp.Equal(base.Add(-2*time.Hour)) || rs[0].Resolution != time.Hour || rs[0].Avg != 4.05 {
+		t.Errorf("rollups after migration: %+v", rs)
+	}
+	if types := s.DataTypes("n1"); len(types) != 2 || types[0] != "temperature" || types[1] != "voltage" {
+		t.Errorf("data types after migration: %v", types)
+	}
+	if got := s.Query("n1", TelemetryQuery{From: base, Types: []string{"voltage"}}); len(got) != 1 || got[0].Value != 4.1 {
+		t.Errorf("range query after migration: %v", got)
+	}
+}
+
+func TestMigrateNodeActivity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	db := openAtVersion(t, path, 3)
+	if _, err := db.Exec(`INSERT INTO nodes (node_id) VALUES ('n1'), ('n2');
+INSERT INTO metrics (id, name) VALUES (1, 'voltage');
+INSERT INTO telemetry VALUES ('n1', 1, 4.1, 1716206400000);
+INSERT INTO packets (timestamp, node_id) VALUES ('2024-05-20T14:30:00+02:00', 'n1');
+INSERT INTO packets (timestamp, node_id) VALUES ('2024-05-20T12:10:00Z', 'n2');`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	base := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+	if a, ok := s.Activity("n1"); !ok || a.FirstSeen != base.Unix() || a.LastSeen != base.Add(30*time.Minute).Unix() || len(a.Packets) != 0 {
+		t.Errorf("n1: %+v", a)
+	}
+	if a, ok := s.Activity("n2"); !ok || a.FirstSeen != base.Add(10*time.Minute).Unix() || a.LastSeen != a.FirstSeen {
+		t.Errorf("n2: %+v", a)
+	}
+}
+
+func TestMigrateNodeHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	db := openAtVersion(t, path, 4)
+	if _, err := db.Exec(`INSERT INTO nodes (node_id, long_name, short_name, firmware) VALUES ('n1', 'One', 'N1', '2.5'), ('n2', '', '', '');`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h := s.NodeHistory("n1")
+	if len(h) != 1 || h[0].Version != 1 || h[0].Source != SourceMigration || h[0].LongName != "One" || h[0].Firmware != "2.5" {
+		t.Errorf("n1: %+v", h)
+	}
+	if h := s.NodeHistory("n2"); len(h) != 0 {
+		t.Errorf("n2: %+v", h)
+	}
+	s.SetNodeInfo(NodeInfo{ID: "n1", LongName: "Uno", ShortName: "N1", Firmware: "2.5"}, SourceAPI)
+	if h := s.NodeHistory("n1"); len(h) != 2 || h[1].Version != 2 || len(h[1].Changed) != 1 {
+		t.Errorf("n1 after edit: %+v", h)
+	}
+}
@@ -2,8 +2,10 @@ package meshdump
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -121,56 +123,248 @@ func telemetryFromProto(nodeID string, tm *mpb.Telemetry) []Telemetry {
 	return out
 }
 
-// StartMQTT connects to the given broker and subscribes to the provided topic.
-// If user is non-empty, the client authenticates with the provided username and password.
-// Incoming messages are first decoded as JSON Telemetry. If that fails they are
-// treated as protobuf MapReport messages. Decoded telemetry or node info is
-// stored in the provided Store until the context is cancelled.
-func StartMQTT(ctx context.Context, broker, topic, user, pass string, store *Store) error {
-	log.Printf("mqtt: connecting to %s", broker)
-	opts := mqtt.NewClientOptions().AddBroker(broker)
-	if user != "" {
-		opts.SetUsername(user).SetPassword(pass)
+// Connection states reported by MQTTStatus.
+const (
+	MQTTConnecting   = "connecting"
+	MQTTConnected    = "connected"
+	MQTTDisconnected = "disconnected"
+)
+
+// MQTTConfig holds the settings used by StartMQTT to reach a broker.
+type MQTTConfig struct {
+	Broker   string
+	Topic    string
+	Username string
+	Password string
+	// ClientID identifies the session on the broker. It is required for
+	// persistent sessions so the broker can recognise the client again.
+	ClientID string
+	// Persistent disables the clean session flag and subscribes with QoS 1 so
+	// the broker queues messages while MeshDump is offline.
+	Persistent bool
+	// MaxReconnectInterval caps the exponential backoff between reconnect
+	// attempts. Zero selects a default of one minute.
+	MaxReconnectInterval time.Duration
+}
+
+// MQTTStatus describes the current state of the MQTT client connection.
+type MQTTStatus struct {
+	Broker      string     `json:"broker"`
+	Topic       string     `json:"topic"`
+	State       string     `json:"state"`
+	Connected   *time.Time `json:"connected_at,omitempty"`
+	LastMessage *time.Time `json:"last_message,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Reconnects  int        `json:"reconnects"`
+}
+
+// MQTTClient is a MQTT subscription that survives broker restarts. The
+// underlying Paho client reconnects with backoff and the subscription is
+// re-established every time the connection comes back.
+type MQTTClient struct {
+	cfg      MQTTConfig
+	client   mqtt.Client
+	pipeline *Pipeline
+
+	mu        sync.Mutex
+	status    MQTTStatus
+	connected bool // set after the first successful connection
+	// subs holds the subscriptions made through Subscribe, renewed with
+	// the main subscription after every reconnect
+	subs []mqttSubscription
+}
+
+// mqttSubscription is a subscription made through MQTTClient.Subscribe.
+type mqttSubscription struct {
+	filter string
+	fn     func(topic string, payload []byte)
+}
+
+// Status returns a snapshot of the connection state.
+func (c *MQTTClient) Status() MQTTStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.status
+	if st.Connected != nil {
+		t := *st.Connected
+		st.Connected = &t
 	}
-	client := mqtt.NewClient(opts)
-	if t := client.Connect(); t.Wait() && t.Error() != nil {
-		return t.Error()
+	if st.LastMessage != nil {
+		t := *st.LastMessage
+		st.LastMessage = &t
+	}
+	return st
+}
+
+func (c *MQTTClient) setState(state string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.State = state
+	if err != nil {
+		c.status.LastError = err.Error()
+	}
+}
+
+func (c *MQTTClient) onConnect(client mqtt.Client) {
+	now := time.Now()
+	c.mu.Lock()
+	if c.connected {
+		c.status.Reconnects++
+	}
+	c.connected = true
+	c.status.State = MQTTConnected
+	c.status.Connected = &now
+	c.mu.Unlock()
+
+	qos := byte(0)
+	if c.cfg.Persistent {
+		qos = 1
+	}
+	log.Printf("mqtt: connected, subscribing to %s", c.cfg.Topic)
+	if t := client.Subscribe(c.cfg.Topic, qos, c.onMessage); t.Wait() && t.Error() != nil {
+		log.Printf("mqtt: subscribe %s: %v", c.cfg.Topic, t.Error())
+		c.setState(MQTTConnected, t.Error())
+		return
+	}
+	log.Printf("mqtt: subscribed to %s", c.cfg.Topic)
+	c.mu.Lock()
+	subs := c.subs
+	c.mu.Unlock()
+	for _, s := range subs {
+		if err := c.subscribe(client, s); err != nil {
+			log.Printf("mqtt: subscribe %s: %v", s.filter, err)
+		}
 	}
-	log.Printf("mqtt: connected, subscribing to %s", topic)
 
 	// send a welcome message to verify connectivity
 	client.Publish("meshdump/welcome", 0, false, []byte("MeshDump connected"))
+}
+
+func (c *MQTTClient) onConnectionLost(_ mqtt.Client, err error) {
+	log.Printf("mqtt: connection lost: %v", err)
+	c.setState(MQTTDisconnected, err)
+}
+
+func (c *MQTTClient) onReconnecting(_ mqtt.Client, _ *mqtt.ClientOptions) {
+	log.Printf("mqtt: reconnecting to %s", c.cfg.Broker)
+	c.setState(MQTTConnecting, nil)
+}
+
+func (c *MQTTClient) onMessage(_ mqtt.Client, m mqtt.Message) {
+	now := time.Now()
+	c.mu.Lock()
+	c.status.LastMessage = &now
+	c.mu.Unlock()
 
-	if t := client.Subscribe(topic, 0, func(c mqtt.Client, m mqtt.Message) {
-		payload := m.Payload()
-		dec, err := DecodeMessage(m.Topic(), string(payload))
-		if err != nil {
-			if store.debug {
-				b := payload
-				if len(b) > 200 {
-					b = append(b[:200], '.', '.', '.')
-				}
-				log.Printf("debug: decode failed topic=%s payload=%q err=%v", m.Topic(), b, err)
+	c.pipeline.Submit(m.Topic(), m.Payload())
+}
+
+// Publish sends payload to topic on the connected broker.
+func (c *MQTTClient) Publish(topic string, payload []byte, retain bool) error {
+	qos := byte(0)
+	if c.cfg.Persistent {
+		qos = 1
+	}
+	t := c.client.Publish(topic, qos, retain, payload)
+	if !t.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("mqtt: publish %s: timeout", topic)
+	}
+	return t.Error()
+}
+
+// Subscribe calls fn with every message published on a topic matching
+// filter. The subscription is renewed after every reconnect.
+func (c *MQTTClient) Subscribe(filter string, fn func(topic string, payload []byte)) error {
+	s := mqttSubscription{filter: filter, fn: fn}
+	c.mu.Lock()
+	c.subs = append(c.subs, s)
+	c.mu.Unlock()
+	if !c.client.IsConnectionOpen() {
+		// subscribed once connected
+		return nil
+	}
+	return c.subscribe(c.client, s)
+}
+
+// subscribe makes the subscription s on client.
+func (c *MQTTClient) subscribe(client mqtt.Client, s mqttSubscription) error {
+	qos := byte(0)
+	if c.cfg.Persistent {
+		qos = 1
+	}
+	t := client.Subscribe(s.filter, qos, func(_ mqtt.Client, m mqtt.Message) {
+		s.fn(m.Topic(), m.Payload())
+	})
+	if !t.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("mqtt: subscribe %s: timeout", s.filter)
+	}
+	return t.Error()
+}
+
+// StartMQTT connects to the configured broker and subscribes to its topic.
+// If a username is set, the client authenticates with it and the password.
+// Incoming messages are first decoded as JSON Telemetry. If that fails they are
+// treated as protobuf MapReport messages. Decoded messages are handed to the
+// pipeline until the context is cancelled.
+//
+// The connection is established in the background: a broker that is down at
+// startup is retried with backoff instead of failing, and the subscription is
+// renewed after every reconnect.
+func StartMQTT(ctx context.Context, cfg MQTTConfig, pipeline *Pipeline) (*MQTTClient, error) {
+	if cfg.Broker == "" {
+		return nil, fmt.Errorf("mqtt: no broker configured")
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = "#"
+	}
+	if cfg.Persistent && cfg.ClientID == "" {
+		return nil, fmt.Errorf("mqtt: persistent sessions require a client id")
+	}
+	if cfg.MaxReconnectInterval <= 0 {
+		cfg.MaxReconnectInterval = time.Minute
+	}
+	c := &MQTTClient{
+		cfg:      cfg,
+		pipeline: pipeline,
+		status:   MQTTStatus{Broker: cfg.Broker, Topic: cfg.Topic, State: MQTTConnecting},
+	}
+
+	log.Printf("mqtt: connecting to %s", cfg.Broker)
+	opts := mqtt.NewClientOptions().AddBroker(cfg.Broker)
+	if cfg.Username != "" {
+		opts.SetUsername(cfg.Username).SetPassword(cfg.Password)
+	}
+	if cfg.ClientID != "" {
+		opts.SetClientID(cfg.ClientID)
+	}
+	opts.SetCleanSession(!cfg.Persistent).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(cfg.MaxReconnectInterval).
+		SetOnConnectHandler(c.onConnect).
+		SetConnectionLostHandler(c.onConnectionLost).
+		SetReconnectingHandler(c.onReconnecting)
+	c.client = mqtt.NewClient(opts)
+
+	// With ConnectRetry the token only completes once connected, so it is
+	// only watched for errors rather than waited on.
+	t := c.client.Connect()
+	go func() {
+		select {
+		case <-t.Done():
+			if err := t.Error(); err != nil {
+				log.Printf("mqtt: connect: %v", err)
+				c.setState(MQTTDisconnected, err)
 			}
-			log.Printf("mqtt decode: %v", err)
-			return
-		}
-		for _, t := range dec.Telemetry {
-			log.Printf("mqtt: message from %s type=%s value=%f", t.NodeID, t.DataType, t.Value)
-			store.Add(t)
+		case <-ctx.Done():
 		}
-		if dec.NodeInfo != nil {
-			store.SetNodeInfo(*dec.NodeInfo)
-		}
-	}); t.Wait() && t.Error() != nil {
-		client.Disconnect(250)
-		return t.Error()
-	}
-	log.Printf("mqtt: subscribed to %s", topic)
+	}()
 
 	go func() {
 		<-ctx.Done()
-		client.Disconnect(250)
+		c.client.Disconnect(250)
+		c.setState(MQTTDisconnected, nil)
 	}()
-	return nil
+	return c, nil
 }
@@ -0,0 +1,147 @@
+package meshdump
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// freeAddr returns a local TCP address that is currently unused.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// testBrokerConfig returns the configuration of an embedded broker on addr
+// with the default meshdump credentials.
+func testBrokerConfig(addr string) BrokerConfig {
+	return BrokerConfig{Address: addr, Username: "meshdump", Password: "meshdump"}
+}
+
+// waitFor polls cond until it returns true or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return cond()
+}
+
+// publish sends a single message to the broker at addr using a throwaway client.
+func publish(t *testing.T, addr, topic string, payload []byte) {
+	t.Helper()
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + addr).
+		SetUsername("meshdump").SetPassword("meshdump")
+	c := mqtt.NewClient(opts)
+	if tok := c.Connect(); tok.Wait() && tok.Error() != nil {
+		t.Fatalf("publisher connect: %v", tok.Error())
+	}
+	defer c.Disconnect(50)
+	if tok := c.Publish(topic, 0, false, payload); tok.Wait() && tok.Error() != nil {
+		t.Fatalf("publish: %v", tok.Error())
+	}
+}
+
+// subscribe returns the topics of the messages the broker at addr delivers to
+// a client subscribed to filter.
+func subscribe(t *testing.T, addr, filter string) <-chan string {
+	t.Helper()
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + addr).
+		SetUsername("meshdump").SetPassword("meshdump")
+	c := mqtt.NewClient(opts)
+	if tok := c.Connect(); tok.Wait() && tok.Error() != nil {
+		t.Fatalf("subscriber connect: %v", tok.Error())
+	}
+	t.Cleanup(func() { c.Disconnect(50) })
+	received := make(chan string, 16)
+	if tok := c.Subscribe(filter, 0, func(_ mqtt.Client, m mqtt.Message) { received <- m.Topic() }); tok.Wait() && tok.Error() != nil {
+		t.Fatalf("subscribe: %v", tok.Error())
+	}
+	return received
+}
+
+func TestMQTTReconnectResubscribes(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	brokerCtx, stopBroker := context.WithCancel(ctx)
+	if _, err := StartMQTTServer(brokerCtx, testBrokerConfig(addr), nil); err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	st := NewMemoryStore()
+	client, err := StartMQTT(ctx, MQTTConfig{
+		Broker:               "tcp://" + addr,
+		Topic:                "msh/#",
+		Username:             "meshdump",
+		Password:             "meshdump",
+		MaxReconnectInterval: time.Second,
+	}, NewPipeline(st))
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return client.Status().State == MQTTConnected }) {
+		t.Fatalf("client did not connect: %+v", client.Status())
+	}
+
+	downlink := make(chan string, 16)
+	if err := client.Subscribe("down/+", func(topic string, _ []byte) { downlink <- topic }); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	msg, _ := json.Marshal(Telemetry{NodeID: "00000001", DataType: "voltage", Value: 3.7})
+	publish(t, addr, "msh/00000001", msg)
+	if !waitFor(t, 5*time.Second, func() bool { return len(st.Get("00000001")) == 1 }) {
+		t.Fatalf("message not stored before restart")
+	}
+
+	// restart the broker on the same address
+	stopBroker()
+	if !waitFor(t, 5*time.Second, func() bool { return client.Status().State != MQTTConnected }) {
+		t.Fatalf("disconnect not detected: %+v", client.Status())
+	}
+	if _, err := StartMQTTServer(ctx, testBrokerConfig(addr), nil); err != nil {
+		t.Fatalf("server restart: %v", err)
+	}
+	if !waitFor(t, 10*time.Second, func() bool { return client.Status().Reconnects == 1 }) {
+		t.Fatalf("client did not reconnect: %+v", client.Status())
+	}
+
+	publish(t, addr, "msh/00000001", msg)
+	if !waitFor(t, 5*time.Second, func() bool { return len(st.Get("00000001")) == 2 }) {
+		t.Fatalf("subscription not restored after reconnect")
+	}
+	publish(t, addr, "down/1", nil)
+	select {
+	case topic := <-downlink:
+		if topic != "down/1" {
+			t.Errorf("unexpected topic %s", topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("additional subscription not restored after reconnect")
+	}
+	if st := client.Status(); st.LastMessage == nil || st.State != MQTTConnected {
+		t.Errorf("unexpected status: %+v", st)
+	}
+}
+
+func TestStartMQTTPersistentRequiresClientID(t *testing.T) {
+	if _, err := StartMQTT(context.Background(), MQTTConfig{Broker: "tcp://localhost:1", Persistent: true}, NewPipeline(NewMemoryStore())); err == nil {
+		t.Fatalf("expected error without client id")
+	}
+}
@@ -0,0 +1,259 @@
+package meshdump
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access levels of a TopicRule.
+const (
+	AccessRead      = "read"
+	AccessWrite     = "write"
+	AccessReadWrite = "readwrite"
+)
+
+// TopicRule grants access to the topics matching an MQTT filter.
+type TopicRule struct {
+	Topic  string `json:"topic"`
+	Access string `json:"access"`
+}
+
+// allows reports whether the rule permits the requested kind of access.
+func (r TopicRule) allows(write bool) bool {
+	switch r.Access {
+	case AccessReadWrite:
+		return true
+	case AccessWrite:
+		return write
+	case AccessRead, "":
+		return !write
+	}
+	return false
+}
+
+// Account is a broker user limited to a set of topics. Password holds a hash
+// produced by HashPassword.
+type Account struct {
+	Username string      `json:"username"`
+	Password string      `json:"password"`
+	Allow    []TopicRule `json:"allow"`
+}
+
+// accountsFile is the layout of the accounts configuration file.
+type accountsFile struct {
+	Accounts []Account `json:"accounts"`
+}
+
+// Accounts holds the broker accounts loaded from a JSON file. The file is
+// checked periodically by Watch so changes apply without a restart.
+type Accounts struct {
+	path string
+
+	mu    sync.RWMutex
+	mod   time.Time
+	users map[string]Account
+}
+
+// LoadAccounts reads the accounts file at path.
+func LoadAccounts(path string) (*Accounts, error) {
+	a := &Accounts{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload reads the file again if it changed since the last load.
+func (a *Accounts) reload() error {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	a.mu.RLock()
+	unchanged := fi.ModTime().Equal(a.mod) && a.users != nil
+	a.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	b, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var f accountsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("accounts %s: %v", a.path, err)
+	}
+	users := make(map[string]Account, len(f.Accounts))
+	for _, acc := range f.Accounts {
+		if acc.Username == "" {
+			return fmt.Errorf("accounts %s: account without username", a.path)
+		}
+		if _, _, _, err := parsePasswordHash(acc.Password); err != nil {
+			return fmt.Errorf("accounts %s: user %s: %v", a.path, acc.Username, err)
+		}
+		for _, r := range acc.Allow {
+			switch r.Access {
+			case "", AccessRead, AccessWrite, AccessReadWrite:
+			default:
+				return fmt.Errorf("accounts %s: user %s: invalid access %q", a.path, acc.Username, r.Access)
+			}
+		}
+		users[acc.Username] = acc
+	}
+	a.mu.Lock()
+	a.users = users
+	a.mod = fi.ModTime()
+	a.mu.Unlock()
+	log.Printf("mqtt server: loaded %d accounts from %s", len(users), a.path)
+	return nil
+}
+
+// Watch reloads the accounts file every interval until ctx is cancelled. A
+// file that fails to load keeps the previous accounts in effect.
+func (a *Accounts) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := a.reload(); err != nil {
+				log.Printf("mqtt server: %v", err)
+			}
+		}
+	}
+}
+
+// Authenticate reports whether the password matches the account of user.
+func (a *Accounts) Authenticate(user, pass string) bool {
+	a.mu.RLock()
+	acc, ok := a.users[user]
+	a.mu.RUnlock()
+	return ok && CheckPassword(acc.Password, pass)
+}
+
+// ACL reports whether user may subscribe to (write false) or publish on
+// (write true) the given topic or filter.
+func (a *Accounts) ACL(user, topic string, write bool) bool {
+	a.mu.RLock()
+	acc, ok := a.users[user]
+	a.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	for _, r := range acc.Allow {
+		if r.allows(write) && filterCovers(r.Topic, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterCovers reports whether every topic matched by filter is also matched
+// by pattern. With a plain topic as filter this is ordinary MQTT matching.
+func filterCovers(pattern, filter string) bool {
+	p := strings.Split(pattern, "/")
+	f := strings.Split(filter, "/")
+	for i, seg := range p {
+		if seg == "#" {
+			return true
+		}
+		if i >= len(f) {
+			return false
+		}
+		switch {
+		case f[i] == "#":
+			return false
+		case seg == "+":
+			continue
+		case f[i] == "+" || seg != f[i]:
+			return false
+		}
+	}
+	return len(p) == len(f)
+}
+
+// Password hashes use PBKDF2 with HMAC-SHA256 and are stored as
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>" with base64 salt and hash.
+const (
+	passwordHashPrefix     = "pbkdf2-sha256"
+	passwordHashIterations = 100000
+)
+
+// pbkdf2SHA256 derives a key of keyLen bytes as specified in RFC 8018.
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+	out := make([]byte, 0, blocks*hashLen)
+	var buf [4]byte
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		u = prf.Sum(u[:0])
+		t := append([]byte(nil), u...)
+		for n := 1; n < iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
+// HashPassword returns a salted hash of password for use in an accounts file.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordHashIterations, sha256.Size)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashPrefix, passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func parsePasswordHash(h string) (iter int, salt, key []byte, err error) {
+	parts := strings.Split(h, "$")
+	if len(parts) != 4 || parts[0] != passwordHashPrefix {
+		return 0, nil, nil, fmt.Errorf("password is not a %s hash", passwordHashPrefix)
+	}
+	if iter, err = strconv.Atoi(parts[1]); err != nil || iter < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid iteration count %q", parts[1])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid hash")
+	}
+	return iter, salt, key, nil
+}
+
+// CheckPassword reports whether password matches the hash.
+func CheckPassword(hash, password string) bool {
+	iter, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(key, pbkdf2SHA256([]byte(password), salt, iter, len(key)))
+}
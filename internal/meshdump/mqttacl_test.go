@@ -0,0 +1,208 @@
+package meshdump
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// test vectors from RFC 7914 section 11 and draft-josefsson-pbkdf2-test-vectors
+	got := hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"), 1, 32))
+	if got != "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b" {
+		t.Errorf("unexpected key for c=1: %s", got)
+	}
+	got = hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"), 2, 32))
+	if got != "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43" {
+		t.Errorf("unexpected key for c=2: %s", got)
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	h, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	if !CheckPassword(h, "secret") || CheckPassword(h, "wrong") || CheckPassword("plain", "plain") {
+		t.Errorf("password check failed for %s", h)
+	}
+}
+
+func TestFilterCovers(t *testing.T) {
+	tests := []struct {
+		pattern, filter string
+		want            bool
+	}{
+		{"msh/EU_868/2/e/#", "msh/EU_868/2/e/LongFast/!abcd1234", true},
+		{"msh/EU_868/2/e/#", "msh/EU_868/2/e", true},
+		{"msh/EU_868/2/e/#", "msh/US/2/e/LongFast/!abcd1234", false},
+		{"msh/EU_868/2/e/#", "msh/#", false},
+		{"msh/+/2/map/#", "msh/EU_868/2/map/x", true},
+		{"msh/+/2/map/#", "msh/+/2/map/#", true},
+		{"msh/EU_868/+", "msh/+", false},
+		{"msh/EU_868/+", "msh/EU_868/a/b", false},
+		{"#", "anything/at/all", true},
+		{"meshdump/+/voltage", "meshdump/abcd1234/voltage", true},
+	}
+	for _, tt := range tests {
+		if got := filterCovers(tt.pattern, tt.filter); got != tt.want {
+			t.Errorf("filterCovers(%q, %q) = %v, want %v", tt.pattern, tt.filter, got, tt.want)
+		}
+	}
+}
+
+// writeAccounts writes an accounts file and moves its modification time
+// forward so a reload notices the change.
+func writeAccounts(t *testing.T, path string, accounts []Account, mod time.Time) {
+	t.Helper()
+	b, _ := json.Marshal(accountsFile{Accounts: accounts})
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+}
+
+func TestAccountsReload(t *testing.T) {
+	hash, _ := HashPassword("gw")
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	now := time.Now()
+	writeAccounts(t, path, []Account{{Username: "gateway", Password: hash,
+		Allow: []TopicRule{{Topic: "msh/EU_868/2/e/#", Access: AccessWrite}}}}, now)
+
+	a, err := LoadAccounts(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !a.Authenticate("gateway", "gw") || a.Authenticate("gateway", "nope") {
+		t.Errorf("unexpected authentication result")
+	}
+	if !a.ACL("gateway", "msh/EU_868/2/e/LongFast/!abcd1234", true) {
+		t.Errorf("gateway should publish on its prefix")
+	}
+	if a.ACL("gateway", "msh/EU_868/2/e/#", false) {
+		t.Errorf("write-only account should not subscribe")
+	}
+
+	writeAccounts(t, path, []Account{{Username: "dashboard", Password: hash,
+		Allow: []TopicRule{{Topic: "meshdump/#", Access: AccessRead}}}}, now.Add(time.Second))
+	if err := a.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if a.Authenticate("gateway", "gw") || !a.Authenticate("dashboard", "gw") {
+		t.Errorf("accounts not reloaded")
+	}
+
+	// invalid files keep the previous accounts
+	if err := os.WriteFile(path, []byte(`{"accounts":[{"username":"x","password":"plain"}]}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	os.Chtimes(path, now.Add(2*time.Second), now.Add(2*time.Second))
+	if err := a.reload(); err == nil {
+		t.Errorf("expected error for unhashed password")
+	}
+	if !a.Authenticate("dashboard", "gw") {
+		t.Errorf("previous accounts should stay in effect")
+	}
+}
+
+func TestBrokerACL(t *testing.T) {
+	hash, _ := HashPassword("pw")
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	writeAccounts(t, path, []Account{
+		{Username: "gateway", Password: hash, Allow: []TopicRule{{Topic: "msh/EU_868/2/e/#", Access: AccessWrite}}},
+		{Username: "dashboard", Password: hash, Allow: []TopicRule{{Topic: "#", Access: AccessRead}}},
+	}, time.Now())
+
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := testBrokerConfig(addr)
+	cfg.AccountsFile = path
+	if _, err := StartMQTTServer(ctx, cfg, nil); err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	connect := func(user, pass string) (mqtt.Client, error) {
+		c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + addr).SetUsername(user).SetPassword(pass))
+		tok := c.Connect()
+		tok.Wait()
+		return c, tok.Error()
+	}
+	if _, err := connect("gateway", "wrong"); err == nil {
+		t.Fatalf("expected bad credentials to be rejected")
+	}
+
+	received := make(chan string, 4)
+	dash, err := connect("dashboard", "pw")
+	if err != nil {
+		t.Fatalf("dashboard connect: %v", err)
+	}
+	defer dash.Disconnect(50)
+	dash.Subscribe("msh/#", 0, func(_ mqtt.Client, m mqtt.Message) { received <- m.Topic() }).Wait()
+
+	gw, err := connect("gateway", "pw")
+	if err != nil {
+		t.Fatalf("gateway connect: %v", err)
+	}
+	defer gw.Disconnect(50)
+	gw.Publish("msh/US/2/e/LongFast/!abcd1234", 0, false, "denied").Wait()
+	dash.Publish("msh/EU_868/2/e/LongFast/!abcd1234", 0, false, "denied").Wait()
+	gw.Publish("msh/EU_868/2/e/LongFast/!abcd1234", 0, false, "allowed").Wait()
+
+	select {
+	case topic := <-received:
+		if topic != "msh/EU_868/2/e/LongFast/!abcd1234" {
+			t.Fatalf("unexpected delivery on %s", topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("permitted message not delivered")
+	}
+	select {
+	case topic := <-received:
+		t.Errorf("denied message delivered on %s", topic)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestBrokerAccountsWithoutAdmin(t *testing.T) {
+	hash, _ := HashPassword("pw")
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	writeAccounts(t, path, []Account{
+		{Username: "dashboard", Password: hash, Allow: []TopicRule{{Topic: "#", Access: AccessRead}}},
+	}, time.Now())
+
+	// with an accounts file and no MQTT_USERNAME no administrative account
+	// is configured
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := StartMQTTServer(ctx, BrokerConfig{Address: addr, AccountsFile: path}, nil); err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	connect := func(user, pass string) error {
+		c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + addr).SetUsername(user).SetPassword(pass))
+		tok := c.Connect()
+		tok.Wait()
+		if tok.Error() == nil {
+			c.Disconnect(50)
+		}
+		return tok.Error()
+	}
+	if err := connect("meshdump", "meshdump"); err == nil {
+		t.Error("default credentials accepted")
+	}
+	if err := connect("", ""); err == nil {
+		t.Error("empty credentials accepted")
+	}
+	if err := connect("dashboard", "pw"); err != nil {
+		t.Errorf("account rejected: %v", err)
+	}
+}
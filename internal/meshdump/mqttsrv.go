@@ -2,33 +2,228 @@ package meshdump
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
+	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/events"
 	"github.com/mochi-co/mqtt/server/listeners"
 )
 
+// mqttAuth authenticates broker clients. The configured user has full access;
+// further users come from the optional accounts file and are limited to their
+// topic rules.
 type mqttAuth struct {
-	user string
-	pass string
+	user     string
+	pass     string
+	accounts *Accounts
 }
 
 func (a *mqttAuth) Authenticate(u, p []byte) bool {
-	return string(u) == a.user && string(p) == a.pass
+	if a.user != "" && string(u) == a.user && string(p) == a.pass {
+		return true
+	}
+	return a.accounts != nil && a.accounts.Authenticate(string(u), string(p))
 }
 
 func (a *mqttAuth) ACL(user []byte, topic string, write bool) bool {
-	return true
+	if a.user != "" && string(user) == a.user {
+		return true
+	}
+	return a.accounts != nil && a.accounts.ACL(string(user), topic, write)
 }
 
-// StartMQTTServer starts an embedded MQTT broker listening on addr.
-func StartMQTTServer(ctx context.Context, addr, user, pass string) error {
-	srv := mqtt.NewServer(nil)
-	tcp := listeners.NewTCP("tcp", addr)
-	err := srv.AddListener(tcp, &listeners.Config{Auth: &mqttAuth{user: user, pass: pass}})
-	if err != nil {
+// BrokerConfig configures the embedded MQTT broker. Every listener has its own
+// address and is disabled when the address is empty; at least one is needed.
+type BrokerConfig struct {
+	// Address is the listen address of the plain TCP listener.
+	Address string
+	// TLSAddress is the listen address of the MQTT over TLS listener.
+	TLSAddress string
+	// WSAddress is the listen address of the plain WebSocket listener.
+	WSAddress string
+	// WSSAddress is the listen address of the WebSocket over TLS listener.
+	WSSAddress string
+	// TLSCertFile and TLSKeyFile hold the PEM certificate and key used by
+	// the TLS and secure WebSocket listeners.
+	TLSCertFile string
+	TLSKeyFile  string
+	// Username and Password define an administrative account with access
+	// to every topic. Leave Username empty to disable it.
+	Username string
+	Password string
+	// AccountsFile is an optional JSON file with additional accounts and
+	// their topic permissions. It is reloaded when it changes.
+	AccountsFile string
+	// Topic limits which published messages are fed into the pipeline.
+	// Empty selects "#".
+	Topic string
+}
+
+// Broker is the embedded MQTT broker.
+type Broker struct {
+	srv      *mqtt.Server
+	pipeline *Pipeline
+	topic    string
+	clients  clientTracker
+
+	mu    sync.RWMutex
+	hooks []func(topic string, payload []byte, retain bool)
+	subs  []brokerSubscription
+}
+
+// brokerSubscription is a subscription made through Broker.Subscribe.
+type brokerSubscription struct {
+	filter string
+	fn     func(topic string, payload []byte)
+}
+
+// Publish delivers payload to the broker's subscribers of topic.
+func (b *Broker) Publish(topic string, payload []byte, retain bool) error {
+	b.clients.countOut(b.srv.Topics.Subscribers(topic))
+	if err := b.srv.Publish(topic, payload, retain); err != nil {
 		return err
 	}
+	b.notify(topic, payload)
+	return nil
+}
+
+// Inject publishes a message received from outside the broker, such as from
+// a bridged broker or a radio, and ingests it as if a client had published
+// it. Unlike those of clients the message is not reported to OnPublish.
+func (b *Broker) Inject(topic string, payload []byte, retain bool) error {
+	if err := b.Publish(topic, payload, retain); err != nil {
+		return err
+	}
+	b.ingest(topic, payload)
+	return nil
+}
+
+// Subscribe calls fn with every message published on a topic matching
+// filter, both by clients of the broker and through Publish.
+func (b *Broker) Subscribe(filter string, fn func(topic string, payload []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, brokerSubscription{filter: filter, fn: fn})
+	return nil
+}
+
+// notify passes a published message to the subscriptions it matches.
+func (b *Broker) notify(topic string, payload []byte) {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	for _, s := range subs {
+		if filterCovers(s.filter, topic) {
+			s.fn(topic, payload)
+		}
+	}
+}
+
+// OnPublish registers fn to be called with every message published by a
+// client of the broker. Messages sent through Publish are not reported.
+func (b *Broker) OnPublish(fn func(topic string, payload []byte, retain bool)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks = append(b.hooks, fn)
+}
+
+// ingest decodes a message into the pipeline if its topic is selected.
+func (b *Broker) ingest(topic string, payload []byte) {
+	if b.pipeline == nil || !filterCovers(b.topic, topic) {
+		return
+	}
+	b.pipeline.Submit(topic, payload)
+}
+
+// onMessage runs on the publishing client's connection before the message is
+// dispatched, so the messages of one client are submitted in order. The
+// pipeline keeps that order for messages on the same topic.
+func (b *Broker) onMessage(cl events.Client, pk events.Packet) (events.Packet, error) {
+	b.clients.countIn(cl.ID)
+	b.clients.countOut(b.srv.Topics.Subscribers(pk.TopicName))
+	b.ingest(pk.TopicName, pk.Payload)
+	b.mu.RLock()
+	hooks := b.hooks
+	b.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(pk.TopicName, pk.Payload, pk.FixedHeader.Retain)
+	}
+	b.notify(pk.TopicName, pk.Payload)
+	return pk, nil
+}
+
+// StartMQTTServer starts an embedded MQTT broker. Messages published by its
+// clients on cfg.Topic are decoded directly into pipeline, which may be nil
+// when the broker only relays messages.
+func StartMQTTServer(ctx context.Context, cfg BrokerConfig, pipeline *Pipeline) (*Broker, error) {
+	auth := &mqttAuth{user: cfg.Username, pass: cfg.Password}
+	if cfg.AccountsFile != "" {
+		accounts, err := LoadAccounts(cfg.AccountsFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.accounts = accounts
+		go accounts.Watch(ctx, 5*time.Second)
+	}
+	var tlsConfig *tls.Config
+	if cfg.TLSAddress != "" || cfg.WSSAddress != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return nil, fmt.Errorf("mqtt server: TLS listeners need a certificate and key")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt server: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	srv := mqtt.NewServer(nil)
+	var started []string
+	add := func(l listeners.Listener, addr string, tc *tls.Config) error {
+		if err := srv.AddListener(l, &listeners.Config{Auth: auth, TLSConfig: tc}); err != nil {
+			return fmt.Errorf("mqtt server: %s listener: %v", l.ID(), err)
+		}
+		started = append(started, l.ID()+"="+addr)
+		return nil
+	}
+	if cfg.Address != "" {
+		if err := add(listeners.NewTCP("tcp", cfg.Address), cfg.Address, nil); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TLSAddress != "" {
+		if err := add(listeners.NewTCP("tls", cfg.TLSAddress), cfg.TLSAddress, tlsConfig); err != nil {
+			srv.Close()
+			return nil, err
+		}
+	}
+	if cfg.WSAddress != "" {
+		if err := add(listeners.NewWebsocket("ws", cfg.WSAddress), cfg.WSAddress, nil); err != nil {
+			srv.Close()
+			return nil, err
+		}
+	}
+	if cfg.WSSAddress != "" {
+		if err := add(listeners.NewWebsocket("wss", cfg.WSSAddress), cfg.WSSAddress, tlsConfig); err != nil {
+			srv.Close()
+			return nil, err
+		}
+	}
+	if len(started) == 0 {
+		return nil, fmt.Errorf("mqtt server: no listener configured")
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = "#"
+	}
+	b := &Broker{srv: srv, pipeline: pipeline, topic: cfg.Topic}
+	srv.Events.OnMessage = b.onMessage
+	srv.Events.OnConnect = b.clients.onConnect
+	srv.Events.OnDisconnect = b.clients.onDisconnect
 	go func() {
 		if err := srv.Serve(); err != nil {
 			log.Printf("mqtt server: %v", err)
@@ -38,6 +233,6 @@ func StartMQTTServer(ctx context.Context, addr, user, pass string) error {
 		<-ctx.Done()
 		srv.Close()
 	}()
-	log.Printf("mqtt server started on %s", addr)
-	return nil
+	log.Printf("mqtt server started on %s", strings.Join(started, " "))
+	return b, nil
 }
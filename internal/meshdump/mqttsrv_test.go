@@ -0,0 +1,201 @@
+package meshdump
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and returns the
+// paths of the certificate and key files and a pool trusting it.
+func writeTestCert(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "meshdump test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestBrokerListeners(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	cfg := testBrokerConfig(freeAddr(t))
+	cfg.TLSAddress = freeAddr(t)
+	cfg.WSAddress = freeAddr(t)
+	cfg.WSSAddress = freeAddr(t)
+	cfg.TLSCertFile = certFile
+	cfg.TLSKeyFile = keyFile
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := StartMQTTServer(ctx, cfg, nil); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	for _, url := range []string{
+		"tcp://" + cfg.Address,
+		"ssl://" + cfg.TLSAddress,
+		"ws://" + cfg.WSAddress,
+		"wss://" + cfg.WSSAddress,
+	} {
+		opts := mqtt.NewClientOptions().AddBroker(url).
+			SetUsername("meshdump").SetPassword("meshdump").
+			SetTLSConfig(&tls.Config{RootCAs: pool}).
+			SetConnectTimeout(5 * time.Second)
+		c := mqtt.NewClient(opts)
+		tok := c.Connect()
+		if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Errorf("connect %s: %v", url, tok.Error())
+			continue
+		}
+		c.Disconnect(50)
+	}
+}
+
+func TestBrokerConfigErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := StartMQTTServer(ctx, BrokerConfig{}, nil); err == nil {
+		t.Errorf("expected error without listeners")
+	}
+	if _, err := StartMQTTServer(ctx, BrokerConfig{TLSAddress: freeAddr(t)}, nil); err == nil {
+		t.Errorf("expected error for TLS listener without certificate")
+	}
+}
+
+func TestBrokerIngest(t *testing.T) {
+	cfg := testBrokerConfig(freeAddr(t))
+	cfg.Topic = "msh/#"
+	st := NewMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker, err := StartMQTTServer(ctx, cfg, NewPipeline(st))
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	publish(t, cfg.Address, "msh/EU_868/2/json/LongFast/!00000001", []byte(`{"NodeID":"00000001","DataType":"voltage","Value":4.1}`))
+	publish(t, cfg.Address, "other/00000002", []byte(`{"NodeID":"00000002","DataType":"voltage","Value":3.9}`))
+	if !waitFor(t, 5*time.Second, func() bool { return len(st.Get("00000001")) == 1 }) {
+		t.Fatalf("published message not ingested")
+	}
+	if len(st.Get("00000002")) != 0 {
+		t.Errorf("message outside of the topic filter ingested")
+	}
+
+	// messages published by MeshDump itself are not ingested again
+	broker.Publish("msh/EU_868/2/json/LongFast/!00000003", []byte(`{"NodeID":"00000003","DataType":"voltage","Value":3.7}`), false)
+	time.Sleep(100 * time.Millisecond)
+	if len(st.Get("00000003")) != 0 {
+		t.Errorf("inline publish ingested")
+	}
+
+	// injected messages reach subscribers and are ingested
+	sub := subscribe(t, cfg.Address, "msh/#")
+	if err := broker.Inject("msh/EU_868/2/json/LongFast/!00000004", []byte(`{"NodeID":"00000004","DataType":"voltage","Value":3.6}`), false); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return len(st.Get("00000004")) == 1 }) {
+		t.Errorf("injected message not ingested")
+	}
+	select {
+	case <-sub:
+	case <-time.After(5 * time.Second):
+		t.Error("injected message not delivered to subscribers")
+	}
+}
+
+func TestBrokerStats(t *testing.T) {
+	cfg := testBrokerConfig(freeAddr(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker, err := StartMQTTServer(ctx, cfg, nil)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	connect := func(id string) mqtt.Client {
+		opts := mqtt.NewClientOptions().AddBroker("tcp://" + cfg.Address).SetClientID(id).
+			SetUsername("meshdump").SetPassword("meshdump")
+		c := mqtt.NewClient(opts)
+		if tok := c.Connect(); tok.Wait() && tok.Error() != nil {
+			t.Fatalf("connect %s: %v", id, tok.Error())
+		}
+		return c
+	}
+	sub := connect("dashboard")
+	if tok := sub.Subscribe("msh/#", 0, nil); tok.Wait() && tok.Error() != nil {
+		t.Fatalf("subscribe: %v", tok.Error())
+	}
+	gw := connect("gateway")
+	for i := 0; i < 2; i++ {
+		if tok := gw.Publish("msh/EU_868/2/e/LongFast/!00000001", 0, false, []byte("x")); tok.Wait() && tok.Error() != nil {
+			t.Fatalf("publish: %v", tok.Error())
+		}
+	}
+	broker.Publish("msh/EU_868/status", []byte("y"), true)
+
+	clientStats := func(id string) (BrokerClient, bool) {
+		for _, c := range broker.Stats().Clients {
+			if c.ID == id {
+				return c, true
+			}
+		}
+		return BrokerClient{}, false
+	}
+	if !waitFor(t, 5*time.Second, func() bool {
+		c, _ := clientStats("gateway")
+		return c.MessagesIn == 2
+	}) {
+		t.Fatalf("publishes not counted: %+v", broker.Stats())
+	}
+	stats := broker.Stats()
+	if d, _ := clientStats("dashboard"); d.MessagesOut != 3 || d.Username != "meshdump" || d.Remote == "" || d.ConnectedAt.IsZero() {
+		t.Errorf("unexpected subscriber stats: %+v", d)
+	}
+	if stats.State != "running" || stats.Retained < 1 || stats.Subscriptions != 1 {
+		t.Errorf("unexpected broker stats: %+v", stats)
+	}
+
+	gw.Disconnect(50)
+	if !waitFor(t, 5*time.Second, func() bool { _, ok := clientStats("gateway"); return !ok }) {
+		t.Errorf("disconnected client still listed")
+	}
+	sub.Disconnect(50)
+}
@@ -0,0 +1,132 @@
+package meshdump
+
+import (
+	"fmt"
+	"time"
+
+	mpb "github.com/meshtastic/go/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// hardwareName returns the name of a hardware model, or "" when unset.
+func hardwareName(hw mpb.HardwareModel) string {
+	if hw == mpb.HardwareModel_UNSET {
+		return ""
+	}
+	return hw.String()
+}
+
+// ParseNodeDB decodes a node database saved by a Meshtastic device. The file
+// may hold a NodeDatabase, a DeviceState, whose owner becomes the only node,
+// or a single NodeInfoLite. The formats are told apart by requiring that every
+// top-level field is known to the message type.
+func ParseNodeDB(b []byte) ([]*mpb.NodeInfoLite, error) {
+	clean := func(m proto.Message) bool {
+		return proto.Unmarshal(b, m) == nil && len(m.ProtoReflect().GetUnknown()) == 0
+	}
+	var db mpb.NodeDatabase
+	if clean(&db) && len(db.GetNodes()) > 0 {
+		return db.GetNodes(), nil
+	}
+	var st mpb.DeviceState
+	if clean(&st) && st.GetMyNode().GetMyNodeNum() != 0 {
+		n := &mpb.NodeInfoLite{Num: st.GetMyNode().GetMyNodeNum()}
+		if o := st.GetOwner(); o != nil {
+			n.User = &mpb.UserLite{LongName: o.GetLongName(), ShortName: o.GetShortName(), HwModel: o.GetHwModel()}
+		}
+		return []*mpb.NodeInfoLite{n}, nil
+	}
+	var ni mpb.NodeInfoLite
+	if clean(&ni) && ni.GetNum() != 0 {
+		return []*mpb.NodeInfoLite{&ni}, nil
+	}
+	return nil, fmt.Errorf("not a Meshtastic node database")
+}
+
+// ImportResult counts what ImportNodeDB added to the store.
+type ImportResult struct {
+	Nodes     int `json:"nodes"`
+	Telemetry int `json:"telemetry"`
+}
+
+// ImportNodeDB seeds the store with the nodes of a device node database. Names
+// and hardware only fill in missing values so newer data received from the
+// mesh is kept. Positions and device metrics are stored as telemetry at the
+// time they were reported; entries already present are skipped, so importing
+// the same file twice does not duplicate data.
+func ImportNodeDB(store Store, nodes []*mpb.NodeInfoLite) ImportResult {
+	var res ImportResult
+	for _, n := range nodes {
+		if n.GetNum() == 0 {
+			continue
+		}
+		id := fmt.Sprintf("%08x", n.GetNum())
+		info, _ := store.Node(id)
+		info.ID = id
+		info.HasData = false
+		if u := n.GetUser(); u != nil {
+			if info.LongName == "" {
+				info.LongName = u.GetLongName()
+			}
+			if info.ShortName == "" {
+				info.ShortName = u.GetShortName()
+			}
+			if info.Hardware == "" {
+				info.Hardware = hardwareName(u.GetHwModel())
+			}
+			if info.Role == "" {
+				info.Role = u.GetRole().String()
+			}
+		}
+		if heard := int64(n.GetLastHeard()); heard > info.LastHeard {
+			info.LastHeard = heard
+		}
+		store.SetNodeInfo(info, SourceNodeDB)
+		res.Nodes++
+
+		var tel []Telemetry
+		if p := n.GetPosition(); p != nil && (p.GetLatitudeI() != 0 || p.GetLongitudeI() != 0) {
+			ts := time.Unix(int64(p.GetTime()), 0)
+			if p.GetTime() == 0 {
+				ts = time.Unix(int64(n.GetLastHeard()), 0)
+			}
+			tel = append(tel,
+				Telemetry{NodeID: id, DataType: "latitude", Value: float64(p.GetLatitudeI()) / 1e7, Timestamp: ts},
+				Telemetry{NodeID: id, DataType: "longitude", Value: float64(p.GetLongitudeI()) / 1e7, Timestamp: ts})
+			if p.GetAltitude() != 0 {
+				tel = append(tel, Telemetry{NodeID: id, DataType: "altitude", Value: float64(p.GetAltitude()), Timestamp: ts})
+			}
+		}
+		if dm := n.GetDeviceMetrics(); dm != nil && n.GetLastHeard() != 0 {
+			metricsFromProto(&tel, id, dm, time.Unix(int64(n.GetLastHeard()), 0))
+		}
+
+		if len(tel) == 0 {
+			continue
+		}
+		q := TelemetryQuery{From: tel[0].Timestamp, To: tel[0].Timestamp}
+		for _, t := range tel {
+			if t.Timestamp.Before(q.From) {
+				q.From = t.Timestamp
+			}
+			if t.Timestamp.After(q.To) {
+				q.To = t.Timestamp
+			}
+			q.Types = append(q.Types, t.DataType)
+		}
+		existing := make(map[string]bool)
+		for _, t := range store.Query(id, q) {
+			existing[t.DataType+"@"+t.Timestamp.UTC().String()] = true
+		}
+		var add []Telemetry
+		for _, t := range tel {
+			if t.Timestamp.Unix() <= 0 || existing[t.DataType+"@"+t.Timestamp.UTC().String()] {
+				continue
+			}
+			add = append(add, t)
+		}
+		store.AddBatch(add)
+		res.Telemetry += len(add)
+	}
+	return res
+}
@@ -0,0 +1,120 @@
+package meshdump
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mpb "github.com/meshtastic/go/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+func testNodeDB(t *testing.T) []byte {
+	t.Helper()
+	db := &mpb.NodeDatabase{
+		Version: 24,
+		Nodes: []*mpb.NodeInfoLite{
+			{
+				Num:       0xabcd1234,
+				LastHeard: 1700000100,
+				User:      &mpb.UserLite{LongName: "Base", ShortName: "BS", HwModel: mpb.HardwareModel_TBEAM},
+				Position:  &mpb.PositionLite{LatitudeI: 525000000, LongitudeI: 134000000, Altitude: 40, Time: 1700000050},
+				DeviceMetrics: &mpb.DeviceMetrics{
+					BatteryLevel: proto.Uint32(80),
+				},
+			},
+			{Num: 0x11112222, User: &mpb.UserLite{LongName: "Rover"}},
+		},
+	}
+	b, err := proto.Marshal(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseNodeDB(t *testing.T) {
+	nodes, err := ParseNodeDB(testNodeDB(t))
+	if err != nil || len(nodes) != 2 {
+		t.Fatalf("node database: %v %v", nodes, err)
+	}
+
+	state, _ := proto.Marshal(&mpb.DeviceState{
+		MyNode: &mpb.MyNodeInfo{MyNodeNum: 0x01020304},
+		Owner:  &mpb.User{LongName: "Me", HwModel: mpb.HardwareModel_HELTEC_V3},
+	})
+	nodes, err = ParseNodeDB(state)
+	if err != nil || len(nodes) != 1 || nodes[0].GetNum() != 0x01020304 ||
+		nodes[0].GetUser().GetHwModel() != mpb.HardwareModel_HELTEC_V3 {
+		t.Fatalf("device state: %v %v", nodes, err)
+	}
+
+	if _, err := ParseNodeDB([]byte("not a protobuf")); err == nil {
+		t.Error("expected error for garbage")
+	}
+}
+
+func TestImportNodeDB(t *testing.T) {
+	st := NewMemoryStore()
+	st.SetNodeInfo(NodeInfo{ID: "11112222", LongName: "Rover 2", Firmware: "2.5.0"}, SourceAPI)
+	nodes, err := ParseNodeDB(testNodeDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := ImportNodeDB(st, nodes)
+	if res.Nodes != 2 || res.Telemetry != 4 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	n, _ := st.Node("abcd1234")
+	if n.LongName != "Base" || n.Hardware != "TBEAM" || n.LastHeard != 1700000100 {
+		t.Errorf("unexpected node %+v", n)
+	}
+	if n, _ := st.Node("11112222"); n.LongName != "Rover 2" || n.Firmware != "2.5.0" {
+		t.Errorf("existing node overwritten: %+v", n)
+	}
+	got := map[string]float64{}
+	for _, tel := range st.Get("abcd1234") {
+		got[tel.DataType] = tel.Value
+	}
+	if got["latitude"] != 52.5 || got["longitude"] != 13.4 || got["altitude"] != 40 || got["batteryLevel"] != 80 {
+		t.Errorf("unexpected telemetry %v", got)
+	}
+
+	if res := ImportNodeDB(st, nodes); res.Telemetry != 0 {
+		t.Errorf("re-import added %d entries", res.Telemetry)
+	}
+}
+
+func TestImportNodeDBHandler(t *testing.T) {
+	srv, st := newTestServer()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "nodes.proto")
+	fw.Write(testNodeDB(t))
+	mw.Close()
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/import/nodedb", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	srv.Router().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body)
+	}
+	var res ImportResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil || res.Nodes != 2 {
+		t.Fatalf("unexpected response %s", rr.Body)
+	}
+	if _, ok := st.Node("abcd1234"); !ok {
+		t.Error("node not imported")
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/api/import/nodedb", bytes.NewReader([]byte("junk")))
+	srv.Router().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for junk, got %d", rr.Code)
+	}
+}
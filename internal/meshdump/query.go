@@ -0,0 +1,170 @@
+package meshdump
+
+import (
+	"sort"
+	"time"
+)
+
+// Aggregations supported by TelemetryQuery.Agg.
+const (
+	AggAvg   = "avg"
+	AggMin   = "min"
+	AggMax   = "max"
+	AggLast  = "last"
+	AggCount = "count"
+)
+
+// ValidAgg reports whether agg names a supported aggregation.
+func ValidAgg(agg string) bool {
+	switch agg {
+	case AggAvg, AggMin, AggMax, AggLast, AggCount:
+		return true
+	}
+	return false
+}
+
+// TelemetryQuery selects the telemetry returned by Store.Query. Zero values
+// leave the corresponding filter unset.
+type TelemetryQuery struct {
+	From  time.Time
+	To    time.Time
+	Types []string
+	// Limit caps the number of results after ordering.
+	Limit int
+	// Desc returns the newest results first.
+	Desc bool
+	// Bucket groups the results of each data type into buckets of this
+	// length which are reduced to one value by Agg, "avg" when empty. The
+	// timestamp of an aggregated result is the start of its bucket.
+	Bucket time.Duration
+	Agg    string
+}
+
+// match reports whether a point of dtype at ts is selected by q. A nil types
+// set selects every data type.
+func (q TelemetryQuery) match(types map[string]bool, dtype string, ts time.Time) bool {
+	return (q.From.IsZero() || !ts.Before(q.From)) &&
+		(q.To.IsZero() || !ts.After(q.To)) &&
+		(types == nil || types[dtype])
+}
+
+type bucketKey struct {
+	dtype string
+	start int64
+}
+
+// bucketAcc accumulates the points of one bucket.
+type bucketAcc struct {
+	dtype    string
+	start    time.Time
+	count    int
+	min, max float64
+	sum      float64
+	lastTS   time.Time
+	last     float64
+}
+
+func (b *bucketAcc) add(count int, min, max, avg float64, ts time.Time) {
+	if b.count == 0 || min < b.min {
+		b.min = min
+	}
+	if b.count == 0 || max > b.max {
+		b.max = max
+	}
+	b.count += count
+	b.sum += avg * float64(count)
+	if b.lastTS.IsZero() || !ts.Before(b.lastTS) {
+		b.lastTS, b.last = ts, avg
+	}
+}
+
+func (b *bucketAcc) value(agg string) float64 {
+	switch agg {
+	case AggMin:
+		return b.min
+	case AggMax:
+		return b.max
+	case AggLast:
+		return b.last
+	case AggCount:
+		return float64(b.count)
+	}
+	return b.sum / float64(b.count)
+}
+
+// runQuery answers q from the rollups and raw points of one node, oldest first
+// unless q.Desc is set. Each part of the range is answered by the finest
+// retention tier still holding it: raw points where they are kept, otherwise
+// the average of each rollup bucket at the bucket's start. Aggregations use
+// the min, max and count of the rollups and weight each rollup's average by
+// its count, which is exact when q.Bucket is a multiple of their resolution;
+// AggLast takes the average of the latest rollup since rollups do not keep
+// the last point. Only matching entries are copied and the result is never
+// nil.
+func runQuery(nodeID string, q TelemetryQuery, rollups []Rollup, points []Telemetry) []Telemetry {
+	var types map[string]bool
+	if len(q.Types) > 0 {
+		types = make(map[string]bool, len(q.Types))
+		for _, t := range q.Types {
+			types[t] = true
+		}
+	}
+
+	var out []Telemetry
+	if q.Bucket > 0 {
+		buckets := make(map[bucketKey]*bucketAcc)
+		acc := func(dtype string, ts time.Time) *bucketAcc {
+			start := ts.UTC().Truncate(q.Bucket)
+			k := bucketKey{dtype, start.Unix()}
+			b := buckets[k]
+			if b == nil {
+				b = &bucketAcc{dtype: dtype, start: start}
+				buckets[k] = b
+			}
+			return b
+		}
+		for _, r := range rollups {
+			if q.match(types, r.DataType, r.Timestamp) {
+				acc(r.DataType, r.Timestamp).add(r.Count, r.Min, r.Max, r.Avg, r.Timestamp)
+			}
+		}
+		for _, t := range points {
+			if q.match(types, t.DataType, t.Timestamp) {
+				acc(t.DataType, t.Timestamp).add(1, t.Value, t.Value, t.Value, t.Timestamp)
+			}
+		}
+		out = make([]Telemetry, 0, len(buckets))
+		for _, b := range buckets {
+			out = append(out, Telemetry{NodeID: nodeID, DataType: b.dtype, Value: b.value(q.Agg), Timestamp: b.start})
+		}
+		sort.Slice(out, func(i, j int) bool {
+			if !out[i].Timestamp.Equal(out[j].Timestamp) {
+				return out[i].Timestamp.Before(out[j].Timestamp)
+			}
+			return out[i].DataType < out[j].DataType
+		})
+	} else {
+		out = []Telemetry{}
+		for _, r := range rollups {
+			if q.match(types, r.DataType, r.Timestamp) {
+				out = append(out, Telemetry{NodeID: r.NodeID, DataType: r.DataType, Value: r.Avg, Timestamp: r.Timestamp})
+			}
+		}
+		for _, t := range points {
+			if q.match(types, t.DataType, t.Timestamp) {
+				out = append(out, t)
+			}
+		}
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Timestamp.Before(out[j].Timestamp) })
+	}
+
+	if q.Desc {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	if q.Limit > 0 && len(out) > q.Limit {
+		out = out[:q.Limit]
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package meshdump
+
+import (
+	"testing"
+	"time"
+)
+
+func queryTestStore() (Store, time.Time) {
+	s := NewMemoryStore()
+	base := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+	s.AddBatch([]Telemetry{
+		{NodeID: "n1", DataType: "voltage", Value: 4.0, Timestamp: base},
+		{NodeID: "n1", DataType: "temperature", Value: 20, Timestamp: base.Add(10 * time.Minute)},
+		{NodeID: "n1", DataType: "voltage", Value: 3.8, Timestamp: base.Add(20 * time.Minute)},
+		{NodeID: "n1", DataType: "voltage", Value: 3.6, Timestamp: base.Add(70 * time.Minute)},
+		{NodeID: "n2", DataType: "voltage", Value: 5, Timestamp: base},
+	})
+	return s, base
+}
+
+func TestStoreQueryFilters(t *testing.T) {
+	s, base := queryTestStore()
+
+	if got := s.Query("n1", TelemetryQuery{}); len(got) != 4 || got[0].Value != 4.0 || got[3].Value != 3.6 {
+		t.Errorf("all: %v", got)
+	}
+	got := s.Query("n1", TelemetryQuery{From: base.Add(10 * time.Minute), To: base.Add(20 * time.Minute)})
+	if len(got) != 2 || got[0].DataType != "temperature" || got[1].Value != 3.8 {
+		t.Errorf("range: %v", got)
+	}
+	if got := s.Query("n1", TelemetryQuery{Types: []string{"temperature"}}); len(got) != 1 || got[0].Value != 20 {
+		t.Errorf("types: %v", got)
+	}
+	got = s.Query("n1", TelemetryQuery{Types: []string{"voltage"}, Desc: true, Limit: 2})
+	if len(got) != 2 || got[0].Value != 3.6 || got[1].Value != 3.8 {
+		t.Errorf("desc limit: %v", got)
+	}
+}
+
+func TestStoreQueryAggregate(t *testing.T) {
+	s, base := queryTestStore()
+	for _, tc := range []struct {
+		agg  string
+		want []float64
+	}{
+		{AggAvg, []float64{3.9, 3.6}},
+		{AggMin, []float64{3.8, 3.6}},
+		{AggMax, []float64{4.0, 3.6}},
+		{AggLast, []float64{3.8, 3.6}},
+		{AggCount, []float64{2, 1}},
+	} {
+		got := s.Query("n1", TelemetryQuery{Types: []string{"voltage"}, Bucket: time.Hour, Agg: tc.agg})
+		if len(got) != 2 || !got[0].Timestamp.Equal(base) || !got[1].Timestamp.Equal(base.Add(time.Hour)) {
+			t.Fatalf("%s: unexpected buckets %v", tc.agg, got)
+		}
+		for i, w := range tc.want {
+			if d := got[i].Value - w; d > 1e-9 || d < -1e-9 {
+				t.Errorf("%s: bucket %d = %v, want %v", tc.agg, i, got[i].Value, w)
+			}
+		}
+	}
+
+	// rollups keep min, max and count exact
+	tiers, _ := ParseRetention("raw:1h,15m:forever")
+	s.Compact(tiers, base.Add(2*time.Hour))
+	got := s.Query("n1", TelemetryQuery{Types: []string{"voltage"}, Bucket: time.Hour, Agg: AggMin})
+	if len(got) != 2 || got[0].Value != 3.8 {
+		t.Errorf("min across tiers: %v", got)
+	}
+	got = s.Query("n1", TelemetryQuery{Types: []string{"voltage"}, Bucket: time.Hour, Agg: AggCount})
+	if len(got) != 2 || got[0].Value != 2 {
+		t.Errorf("count across tiers: %v", got)
+	}
+}
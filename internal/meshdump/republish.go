@@ -0,0 +1,156 @@
+package meshdump
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Default topic templates used by the JSON republisher. "<node>" is replaced by
+// the node ID and "<dataType>" by the telemetry data type.
+const (
+	DefaultTelemetryTopic = "meshdump/<node>/<dataType>"
+	DefaultNodeInfoTopic  = "meshdump/<node>/nodeinfo"
+	DefaultTextTopic      = "meshdump/<node>/text"
+)
+
+// RepublishConfig configures the JSON republisher. Empty templates fall back to
+// the defaults above.
+type RepublishConfig struct {
+	TelemetryTopic string
+	NodeInfoTopic  string
+	TextTopic      string
+	// Retain publishes telemetry and node info as retained messages so the
+	// topics always hold the latest value. Text messages are never retained.
+	Retain bool
+}
+
+// jsonTelemetry is the payload published for a telemetry point.
+type jsonTelemetry struct {
+	NodeID    string    `json:"node_id"`
+	DataType  string    `json:"data_type"`
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// JSONPublisher republishes decoded messages as plain JSON so other tools do
+// not need to understand Meshtastic protobufs. It is registered as a Sink on
+// the ingest pipeline.
+type JSONPublisher struct {
+	pub Publisher
+	cfg RepublishConfig
+}
+
+// NewJSONPublisher returns a publisher sending to pub.
+func NewJSONPublisher(pub Publisher, cfg RepublishConfig) *JSONPublisher {
+	if cfg.TelemetryTopic == "" {
+		cfg.TelemetryTopic = DefaultTelemetryTopic
+	}
+	if cfg.NodeInfoTopic == "" {
+		cfg.NodeInfoTopic = DefaultNodeInfoTopic
+	}
+	if cfg.TextTopic == "" {
+		cfg.TextTopic = DefaultTextTopic
+	}
+	return &JSONPublisher{pub: pub, cfg: cfg}
+}
+
+// expandTopic fills in the placeholders of a topic template.
+func expandTopic(tmpl, node, dataType string) string {
+	return strings.NewReplacer("<node>", node, "<dataType>", dataType).Replace(tmpl)
+}
+
+// Consume publishes every part of dec on its topic.
+func (p *JSONPublisher) Consume(dec *Decoded) {
+	for _, t := range dec.Telemetry {
+		topic := expandTopic(p.cfg.TelemetryTopic, t.NodeID, t.DataType)
+		p.publish(topic, jsonTelemetry{NodeID: t.NodeID, DataType: t.DataType, Value: t.Value, Timestamp: t.Timestamp}, p.cfg.Retain)
+	}
+	if dec.NodeInfo != nil {
+		topic := expandTopic(p.cfg.NodeInfoTopic, dec.NodeInfo.ID, "nodeinfo")
+		p.publish(topic, dec.NodeInfo, p.cfg.Retain)
+	}
+	if dec.Text != nil {
+		topic := expandTopic(p.cfg.TextTopic, dec.Text.From, "text")
+		p.publish(topic, dec.Text, false)
+	}
+}
+
+func (p *JSONPublisher) publish(topic string, v interface{}, retain bool) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("republish: %v", err)
+		return
+	}
+	// a PublishQueue logs the messages it drops itself
+	if err := p.pub.Publish(topic, b, retain); err != nil && !errors.Is(err, ErrPublishQueueFull) {
+		log.Printf("republish %s: %v", topic, err)
+	}
+}
+
+// ErrPublishQueueFull is returned by PublishQueue.Publish when a message is
+// dropped because the queue is full.
+var ErrPublishQueueFull = errors.New("publish queue full")
+
+// PublishQueue is a Publisher that hands messages to a background goroutine
+// publishing them in order. Outputs consuming the pipeline publish through it
+// so that a slow or disconnected broker does not hold up ingest; when the
+// queue is full further messages are dropped.
+type PublishQueue struct {
+	pub     Publisher
+	queue   chan publishedMessage
+	dropped atomic.Uint64
+}
+
+// publishedMessage is a message waiting in a PublishQueue.
+type publishedMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// NewPublishQueue returns a queue of size messages publishing to pub until
+// ctx is cancelled. Zero selects 1024.
+func NewPublishQueue(ctx context.Context, pub Publisher, size int) *PublishQueue {
+	if size <= 0 {
+		size = 1024
+	}
+	q := &PublishQueue{pub: pub, queue: make(chan publishedMessage, size)}
+	go q.run(ctx)
+	return q
+}
+
+// Publish queues a message without waiting for it to be published.
+func (q *PublishQueue) Publish(topic string, payload []byte, retain bool) error {
+	select {
+	case q.queue <- publishedMessage{topic: topic, payload: payload, retain: retain}:
+		return nil
+	default:
+		if n := q.dropped.Add(1); n == 1 || n%1000 == 0 {
+			log.Printf("publish: queue full, %d messages dropped", n)
+		}
+		return ErrPublishQueueFull
+	}
+}
+
+// Dropped returns the number of messages dropped because the queue was full.
+func (q *PublishQueue) Dropped() uint64 {
+	return q.dropped.Load()
+}
+
+func (q *PublishQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-q.queue:
+			if err := q.pub.Publish(m.topic, m.payload, m.retain); err != nil {
+				log.Printf("publish %s: %v", m.topic, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package meshdump
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type publishedMsg struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// fakePublisher records published messages.
+type fakePublisher struct {
+	mu   sync.Mutex
+	msgs []publishedMsg
+}
+
+func (f *fakePublisher) Publish(topic string, payload []byte, retain bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.msgs = append(f.msgs, publishedMsg{topic: topic, payload: payload, retain: retain})
+	return nil
+}
+
+func (f *fakePublisher) messages() []publishedMsg {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]publishedMsg(nil), f.msgs...)
+}
+
+func TestJSONPublisher(t *testing.T) {
+	fp := &fakePublisher{}
+	st := NewMemoryStore()
+	p := NewPipeline(st)
+	p.AddSink(NewJSONPublisher(fp, RepublishConfig{Retain: true}))
+
+	ts := time.Unix(1700000000, 0).UTC()
+	p.Handle(&Decoded{
+		Telemetry: []Telemetry{{NodeID: "abcdef12", DataType: "voltage", Value: 3.9, Timestamp: ts}},
+		NodeInfo:  &NodeInfo{ID: "abcdef12", LongName: "Node"},
+		Text:      &TextMessage{From: "abcdef12", To: "ffffffff", Text: "hi", Timestamp: ts},
+	})
+
+	msgs := fp.messages()
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	if msgs[0].topic != "meshdump/abcdef12/voltage" || !msgs[0].retain {
+		t.Errorf("unexpected telemetry message: %+v", msgs[0])
+	}
+	var tel jsonTelemetry
+	if err := json.Unmarshal(msgs[0].payload, &tel); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if tel.NodeID != "abcdef12" || tel.Value != 3.9 || !tel.Timestamp.Equal(ts) {
+		t.Errorf("unexpected payload: %+v", tel)
+	}
+	if msgs[1].topic != "meshdump/abcdef12/nodeinfo" || !msgs[1].retain {
+		t.Errorf("unexpected node info message: %+v", msgs[1])
+	}
+	if msgs[2].topic != "meshdump/abcdef12/text" || msgs[2].retain {
+		t.Errorf("unexpected text message: %+v", msgs[2])
+	}
+	if len(st.Get("abcdef12")) != 1 {
+		t.Errorf("telemetry not stored")
+	}
+
+	// republished JSON must not be ingested again as telemetry
+	for _, m := range msgs {
+		if dec, err := DecodeMessage(m.topic, string(m.payload)); err == nil && len(dec.Telemetry) > 0 {
+			t.Errorf("republished payload on %s decoded as telemetry: %+v", m.topic, dec.Telemetry)
+		}
+	}
+}
+
+func TestExpandTopic(t *testing.T) {
+	got := expandTopic("site/<node>/sensors/<dataType>", "00000001", "temperature")
+	if got != "site/00000001/sensors/temperature" {
+		t.Errorf("unexpected topic %q", got)
+	}
+}
+
+// blockingPublisher blocks every Publish until release is closed.
+type blockingPublisher struct {
+	fakePublisher
+	release chan struct{}
+}
+
+func (b *blockingPublisher) Publish(topic string, payload []byte, retain bool) error {
+	<-b.release
+	return b.fakePublisher.Publish(topic, payload, retain)
+}
+
+func TestPublishQueue(t *testing.T) {
+	bp := &blockingPublisher{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := NewPublishQueue(ctx, bp, 2)
+
+	// the first message is taken by the goroutine, which then blocks; the
+	// queue holds two more and drops the rest without waiting
+	if err := q.Publish("t/0", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, time.Second, func() bool { return len(q.queue) == 0 })
+	start := time.Now()
+	var errs []error
+	for i := 1; i < 5; i++ {
+		errs = append(errs, q.Publish(fmt.Sprintf("t/%d", i), nil, false))
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Publish blocked")
+	}
+	if errs[0] != nil || errs[1] != nil || !errors.Is(errs[2], ErrPublishQueueFull) || q.Dropped() != 2 {
+		t.Errorf("errors %v, dropped %d", errs, q.Dropped())
+	}
+
+	close(bp.release)
+	if !waitFor(t, time.Second, func() bool { return len(bp.messages()) == 3 }) {
+		t.Fatalf("published %d of 3 messages", len(bp.messages()))
+	}
+	for i, m := range bp.messages() {
+		if want := fmt.Sprintf("t/%d", i); m.topic != want {
+			t.Errorf("message %d: got %s, want %s", i, m.topic, want)
+		}
+	}
+}
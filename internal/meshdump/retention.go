@@ -0,0 +1,345 @@
+package meshdump
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionTier keeps telemetry at one resolution for MaxAge. The first tier
+// holds the raw points and has a zero Resolution; the following tiers hold
+// Rollups with the min, max and average of every Resolution long bucket. A
+// zero MaxAge keeps the data of a tier forever. Received packets and sent
+// messages are kept as long as the raw points.
+type RetentionTier struct {
+	Resolution time.Duration
+	MaxAge     time.Duration
+}
+
+func (t RetentionTier) String() string {
+	res := "raw"
+	if t.Resolution > 0 {
+		res = t.Resolution.String()
+	}
+	if t.MaxAge == 0 {
+		return res + ":forever"
+	}
+	return res + ":" + t.MaxAge.String()
+}
+
+// ParseRetention parses a comma separated list of tiers such as
+// "raw:7d,15m:90d,1h:forever". Each tier is a resolution, "raw" for the first
+// one, and the time its data is kept. Durations accept a "d" suffix for days.
+// An empty string keeps all raw points forever and returns no tiers.
+func ParseRetention(s string) ([]RetentionTier, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var tiers []RetentionTier
+	for i, item := range strings.Split(s, ",") {
+		res, age, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok {
+			return nil, fmt.Errorf("retention tier %q: expected <resolution>:<age>", item)
+		}
+		var t RetentionTier
+		if i == 0 {
+			if res != "raw" {
+				return nil, fmt.Errorf("retention tier %q: the first tier must be raw", item)
+			}
+		} else {
+			d, err := parseDays(res)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("retention tier %q: invalid resolution", item)
+			}
+			t.Resolution = d
+		}
+		if age != "forever" {
+			d, err := parseDays(age)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("retention tier %q: invalid age", item)
+			}
+			t.MaxAge = d
+		}
+		tiers = append(tiers, t)
+	}
+	for i := 1; i < len(tiers); i++ {
+		prev, t := tiers[i-1], tiers[i]
+		if prev.MaxAge == 0 {
+			return nil, fmt.Errorf("retention tier %s: follows a tier kept forever", t)
+		}
+		if t.MaxAge != 0 && t.MaxAge <= prev.MaxAge {
+			return nil, fmt.Errorf("retention tier %s: must be kept longer than %s", t, prev)
+		}
+		if prev.Resolution > 0 && (t.Resolution <= prev.Resolution || t.Resolution%prev.Resolution != 0) {
+			return nil, fmt.Errorf("retention tier %s: resolution must be a multiple of %s", t, prev.Resolution)
+		}
+	}
+	return tiers, nil
+}
+
+// parseDays is time.ParseDuration with support for a "d" suffix.
+func parseDays(s string) (time.Duration, error) {
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		days, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Rollup aggregates the telemetry of one node and data type over the bucket
+// of Resolution starting at Timestamp.
+type Rollup struct {
+	NodeID     string        `json:"node_id"`
+	DataType   string        `json:"data_type"`
+	Resolution time.Duration `json:"resolution"`
+	Timestamp  time.Time     `json:"timestamp"`
+	Count      int           `json:"count"`
+	Min        float64       `json:"min"`
+	Max        float64       `json:"max"`
+	Avg        float64       `json:"avg"`
+}
+
+// add merges a point or another rollup of count points into r.
+func (r *Rollup) add(count int, min, max, avg float64) {
+	if r.Count == 0 || min < r.Min {
+		r.Min = min
+	}
+	if r.Count == 0 || max > r.Max {
+		r.Max = max
+	}
+	r.Avg = (r.Avg*float64(r.Count) + avg*float64(count)) / float64(r.Count+count)
+	r.Count += count
+}
+
+type rollupKey struct {
+	node, dtype string
+	res         time.Duration
+	ts          int64
+}
+
+func (r Rollup) key() rollupKey {
+	return rollupKey{r.NodeID, r.DataType, r.Resolution, r.Timestamp.Unix()}
+}
+
+// CompactStats reports the work done by Store.Compact.
+type CompactStats struct {
+	RolledUp int // raw points and rollups merged into a coarser tier
+	Deleted  int // raw points and rollups removed from their tier
+	Pruned   int // packet metadata older than the raw tier
+}
+
+// packetCutoff returns the time before which the metadata of received packets
+// has expired at now. Sent messages are a log of what was sent and do not
+// expire.
+func packetCutoff(tiers []RetentionTier, now time.Time) time.Time {
+	return now.Add(-tiers[0].MaxAge)
+}
+
+// prunePackets removes the packet metadata held in memory that is older than
+// cutoff and returns how many records were removed.
+func (s *MemoryStore) prunePackets(cutoff time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.packets)
+	packets := s.packets[:0]
+	for _, p := range s.packets {
+		if !p.Timestamp.Before(cutoff) {
+			packets = append(packets, p)
+		}
+	}
+	s.packets = packets
+	return n - len(s.packets)
+}
+
+// compactCutoff returns the time before which the data of tier i has expired
+// at now. It is aligned to the buckets of the next tier so only complete
+// buckets are rolled up.
+func compactCutoff(tiers []RetentionTier, i int, now time.Time) time.Time {
+	c := now.Add(-tiers[i].MaxAge).UTC()
+	if i+1 < len(tiers) {
+		c = c.Truncate(tiers[i+1].Resolution)
+	}
+	return c
+}
+
+// rollupSource gives a compaction access to the rollups kept by a store.
+type rollupSource interface {
+	// rollup returns the stored rollup with key k.
+	rollup(k rollupKey) (Rollup, bool)
+	// expired returns the stored rollups of resolution res whose bucket
+	// ends at or before cutoff.
+	expired(res time.Duration, cutoff time.Time) []Rollup
+}
+
+// compaction lists the changes made by a compaction for the store to apply to
+// its storage.
+type compaction struct {
+	rawCutoff time.Time
+	upsert    []Rollup
+	removed   map[rollupKey]bool
+}
+
+// planCompaction applies the retention tiers at time now. The raw points in
+// old, which the caller selected with compactCutoff(tiers, 0, now), and the
+// rollups older than their tier's MaxAge are merged into the next tier and
+// removed, or simply removed when there is no next tier.
+func planCompaction(tiers []RetentionTier, now time.Time, old []Telemetry, src rollupSource) (CompactStats, compaction) {
+	var st CompactStats
+	c := compaction{rawCutoff: compactCutoff(tiers, 0, now), removed: make(map[rollupKey]bool)}
+	index := make(map[rollupKey]*Rollup)
+	changed := make(map[rollupKey]bool)
+	lookup := func(k rollupKey) *Rollup {
+		if r := index[k]; r != nil {
+			return r
+		}
+		r := &Rollup{NodeID: k.node, DataType: k.dtype, Resolution: k.res, Timestamp: time.Unix(k.ts, 0).UTC()}
+		if stored, ok := src.rollup(k); ok {
+			*r = stored
+		}
+		index[k] = r
+		return r
+	}
+	merge := func(node, dtype string, res time.Duration, ts time.Time, count int, min, max, avg float64) {
+		k := rollupKey{node, dtype, res, ts.UTC().Truncate(res).Unix()}
+		lookup(k).add(count, min, max, avg)
+		changed[k] = true
+		delete(c.removed, k)
+		st.RolledUp++
+	}
+
+	for _, p := range old {
+		if len(tiers) > 1 {
+			merge(p.NodeID, p.DataType, tiers[1].Resolution, p.Timestamp, 1, p.Value, p.Value, p.Value)
+		}
+		st.Deleted++
+	}
+	for i := 1; i < len(tiers) && tiers[i].MaxAge != 0; i++ {
+		res, cutoff := tiers[i].Resolution, compactCutoff(tiers, i, now)
+		for _, r := range src.expired(res, cutoff) {
+			lookup(r.key())
+		}
+		var expired []*Rollup
+		for _, r := range index {
+			if r.Resolution == res && r.Count > 0 && !r.Timestamp.Add(res).After(cutoff) {
+				expired = append(expired, r)
+			}
+		}
+		for _, r := range expired {
+			if i+1 < len(tiers) {
+				merge(r.NodeID, r.DataType, tiers[i+1].Resolution, r.Timestamp, r.Count, r.Min, r.Max, r.Avg)
+			}
+			k := r.key()
+			r.Count = 0
+			delete(changed, k)
+			c.removed[k] = true
+			st.Deleted++
+		}
+	}
+	for k := range changed {
+		c.upsert = append(c.upsert, *index[k])
+	}
+	return st, c
+}
+
+// compact applies the retention tiers to the data held in memory.
+func (s *MemoryStore) compact(tiers []RetentionTier, now time.Time) CompactStats {
+	if len(tiers) == 0 || tiers[0].MaxAge == 0 {
+		return CompactStats{}
+	}
+	rawCutoff := compactCutoff(tiers, 0, now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var old []Telemetry
+	for node, pts := range s.data {
+		keep := make([]Telemetry, 0, len(pts))
+		for _, p := range pts {
+			if p.Timestamp.Before(rawCutoff) {
+				old = append(old, p)
+			} else {
+				keep = append(keep, p)
+			}
+		}
+		if len(keep) != len(pts) {
+			s.data[node] = keep
+		}
+	}
+	src := newMemoryRollups(s.rollups)
+	st, c := planCompaction(tiers, now, old, src)
+
+	for k := range c.removed {
+		delete(src, k)
+	}
+	for _, r := range c.upsert {
+		src[r.key()] = r
+	}
+	s.rollups = make(map[string][]Rollup)
+	for _, r := range src {
+		s.rollups[r.NodeID] = append(s.rollups[r.NodeID], r)
+	}
+	for _, rs := range s.rollups {
+		sort.Slice(rs, func(i, j int) bool {
+			if !rs[i].Timestamp.Equal(rs[j].Timestamp) {
+				return rs[i].Timestamp.Before(rs[j].Timestamp)
+			}
+			return rs[i].DataType < rs[j].DataType
+		})
+	}
+	return st
+}
+
+// memoryRollups is the rollupSource of a MemoryStore.
+type memoryRollups map[rollupKey]Rollup
+
+func newMemoryRollups(rollups map[string][]Rollup) memoryRollups {
+	m := make(memoryRollups)
+	for _, rs := range rollups {
+		for _, r := range rs {
+			m[r.key()] = r
+		}
+	}
+	return m
+}
+
+func (m memoryRollups) rollup(k rollupKey) (Rollup, bool) {
+	r, ok := m[k]
+	return r, ok
+}
+
+func (m memoryRollups) expired(res time.Duration, cutoff time.Time) []Rollup {
+	var out []Rollup
+	for _, r := range m {
+		if r.Resolution == res && !r.Timestamp.Add(res).After(cutoff) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// RunCompaction compacts the store according to tiers right away and then
+// every interval until ctx is cancelled.
+func RunCompaction(ctx context.Context, store Store, tiers []RetentionTier, interval time.Duration) {
+	compact := func() {
+		st := store.Compact(tiers, time.Now())
+		if st.RolledUp > 0 || st.Deleted > 0 || st.Pruned > 0 {
+			log.Printf("store: compaction rolled up %d and deleted %d entries, pruned %d packets", st.RolledUp, st.Deleted, st.Pruned)
+		}
+	}
+	compact()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			compact()
+		}
+	}
+}
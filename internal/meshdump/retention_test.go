@@ -0,0 +1,127 @@
+package meshdump
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	tiers, err := ParseRetention("raw:7d,15m:90d,1h:forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RetentionTier{
+		{MaxAge: 7 * 24 * time.Hour},
+		{Resolution: 15 * time.Minute, MaxAge: 90 * 24 * time.Hour},
+		{Resolution: time.Hour},
+	}
+	if len(tiers) != len(want) {
+		t.Fatalf("unexpected tiers %v", tiers)
+	}
+	for i := range want {
+		if tiers[i] != want[i] {
+			t.Errorf("tier %d: got %v, want %v", i, tiers[i], want[i])
+		}
+	}
+	if tiers, err := ParseRetention(""); err != nil || tiers != nil {
+		t.Errorf("empty: %v %v", tiers, err)
+	}
+	for _, bad := range []string{
+		"15m:7d",                  // first tier not raw
+		"raw:7d,15m",              // missing age
+		"raw:forever,1h:forever",  // tier after forever
+		"raw:7d,15m:90d,20m:365d", // resolution not a multiple
+		"raw:7d,1h:2d",            // shorter age
+		"raw:7x",
+	} {
+		if _, err := ParseRetention(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers, _ := ParseRetention("raw:1d,15m:10d,1h:forever")
+	now := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+
+	old := now.Add(-2 * 24 * time.Hour).Truncate(time.Hour)
+	s.AddBatch([]Telemetry{
+		{NodeID: "n1", DataType: "temperature", Value: 10, Timestamp: old},
+		{NodeID: "n1", DataType: "temperature", Value: 20, Timestamp: old.Add(5 * time.Minute)},
+		{NodeID: "n1", DataType: "temperature", Value: 30, Timestamp: old.Add(20 * time.Minute)},
+		{NodeID: "n1", DataType: "temperature", Value: 1, Timestamp: now.Add(-time.Hour)},
+		// old enough for the hourly tier
+		{NodeID: "n1", DataType: "temperature", Value: 5, Timestamp: now.Add(-20 * 24 * time.Hour)},
+	})
+
+	st := s.Compact(tiers, now)
+	if st.Deleted != 5 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	if raw := s.Get("n1"); len(raw) != 1 || raw[0].Value != 1 {
+		t.Errorf("raw points: %v", raw)
+	}
+	rs := s.Rollups("n1")
+	if len(rs) != 3 {
+		t.Fatalf("unexpected rollups %+v", rs)
+	}
+	if rs[0].Resolution != time.Hour || rs[0].Avg != 5 {
+		t.Errorf("hourly rollup: %+v", rs[0])
+	}
+	if r := rs[1]; r.Resolution != 15*time.Minute || !r.Timestamp.Equal(old) || r.Count != 2 || r.Min != 10 || r.Max != 20 || r.Avg != 15 {
+		t.Errorf("15m rollup: %+v", r)
+	}
+
+	// the rollups survive a restart and a second run has nothing to do
+	s.Close()
+	s, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if len(s.Get("n1")) != 1 || len(s.Rollups("n1")) != 3 {
+		t.Fatalf("after reload: %v %+v", s.Get("n1"), s.Rollups("n1"))
+	}
+	if st := s.Compact(tiers, now); st != (CompactStats{}) {
+		t.Errorf("second run: %+v", st)
+	}
+
+	// later the 15 minute buckets move to the hourly tier
+	s.Compact(tiers, now.Add(10*24*time.Hour))
+	rs = s.Rollups("n1")
+	if len(rs) != 3 || rs[1].Resolution != time.Hour || rs[1].Count != 3 || rs[1].Avg != 20 {
+		t.Errorf("hourly rollups: %+v", rs)
+	}
+}
+
+func TestStoreQuery(t *testing.T) {
+	s := NewMemoryStore()
+	tiers, _ := ParseRetention("raw:1h,1h:forever")
+	now := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+	s.AddBatch([]Telemetry{
+		{NodeID: "n1", DataType: "voltage", Value: 3, Timestamp: now.Add(-3*time.Hour + time.Minute)},
+		{NodeID: "n1", DataType: "voltage", Value: 5, Timestamp: now.Add(-3*time.Hour + 2*time.Minute)},
+		{NodeID: "n1", DataType: "voltage", Value: 4.2, Timestamp: now.Add(-time.Minute)},
+	})
+	s.Compact(tiers, now)
+
+	got := s.Query("n1", TelemetryQuery{})
+	if len(got) != 2 || got[0].Value != 4 || !got[0].Timestamp.Equal(now.Add(-3*time.Hour)) || got[1].Value != 4.2 {
+		t.Errorf("unexpected result %v", got)
+	}
+	if got := s.Query("n1", TelemetryQuery{From: now.Add(-time.Hour)}); len(got) != 1 || got[0].Value != 4.2 {
+		t.Errorf("recent range: %v", got)
+	}
+	if got := s.Query("n1", TelemetryQuery{To: now.Add(-time.Hour)}); len(got) != 1 || got[0].Value != 4 {
+		t.Errorf("old range: %v", got)
+	}
+	if n, _ := s.Node("n1"); !n.HasData {
+		t.Error("node should have data")
+	}
+}
@@ -0,0 +1,181 @@
+package meshdump
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mpb "github.com/meshtastic/go/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrPublish is returned by Sender.Send when the message was valid but could
+// not be handed to the broker.
+var ErrPublish = errors.New("publish failed")
+
+// broadcastAddr is the destination used for channel-wide messages.
+const broadcastAddr = 0xffffffff
+
+// SendConfig configures the MQTT downlink used to send text messages.
+type SendConfig struct {
+	// RootTopic is the topic root of the mesh, for example "msh/EU_868".
+	RootTopic string
+	// GatewayID is the node ID MeshDump sends as, for example "!abcd1234".
+	GatewayID string
+	// Keys holds the PSKs of the channels messages can be sent on.
+	Keys ChannelKeys
+	// DefaultChannel is used when a request does not name a channel.
+	DefaultChannel string
+	// HopLimit of sent packets. Zero selects the firmware default of 3.
+	HopLimit uint32
+}
+
+// SendRequest is the body accepted by POST /api/send. To is a node ID; when
+// empty the message is broadcast on the channel.
+type SendRequest struct {
+	Text    string `json:"text"`
+	Channel string `json:"channel"`
+	To      string `json:"to"`
+	WantAck bool   `json:"want_ack"`
+}
+
+// Sender publishes text messages to the mesh through the MQTT downlink topic
+// of a channel and records them in the store.
+type Sender struct {
+	pub   Publisher
+	store Store
+	cfg   SendConfig
+	from  uint32
+}
+
+// parseNodeNum converts a node ID such as "!abcd1234" or "abcd1234" into the
+// node number.
+func parseNodeNum(id string) (uint32, error) {
+	id = strings.TrimPrefix(strings.TrimSpace(id), "!")
+	if !validNodeID(id) {
+		return 0, fmt.Errorf("invalid node id %q", id)
+	}
+	n, err := strconv.ParseUint(id, 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(n), nil
+}
+
+// NewSender returns a sender publishing through pub.
+func NewSender(pub Publisher, store Store, cfg SendConfig) (*Sender, error) {
+	from, err := parseNodeNum(cfg.GatewayID)
+	if err != nil {
+		return nil, fmt.Errorf("send: gateway: %v", err)
+	}
+	if cfg.RootTopic == "" {
+		return nil, fmt.Errorf("send: no root topic configured")
+	}
+	cfg.RootTopic = strings.TrimSuffix(cfg.RootTopic, "/")
+	if cfg.DefaultChannel == "" {
+		cfg.DefaultChannel = "LongFast"
+	}
+	// the caller's keys may be shared with a decoder, so they are copied
+	// before the default channel is added
+	keys := make(ChannelKeys, len(cfg.Keys)+1)
+	for name, key := range cfg.Keys {
+		keys[name] = key
+	}
+	if _, ok := keys[cfg.DefaultChannel]; !ok {
+		keys[cfg.DefaultChannel] = defaultPSK
+	}
+	cfg.Keys = keys
+	if cfg.HopLimit == 0 {
+		cfg.HopLimit = 3
+	}
+	return &Sender{pub: pub, store: store, cfg: cfg, from: from}, nil
+}
+
+// newPacketID returns a random non-zero packet ID.
+func newPacketID() uint32 {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return uint32(time.Now().UnixNano())
+		}
+		if id := binary.LittleEndian.Uint32(b[:]); id != 0 {
+			return id
+		}
+	}
+}
+
+// Send encrypts the message with the channel key, publishes it to the
+// downlink topic and records it in the store.
+func (s *Sender) Send(req SendRequest) (SentMessage, error) {
+	if req.Text == "" {
+		return SentMessage{}, fmt.Errorf("empty text")
+	}
+	if len(req.Text) > 200 {
+		return SentMessage{}, fmt.Errorf("text longer than 200 bytes")
+	}
+	channel := req.Channel
+	if channel == "" {
+		channel = s.cfg.DefaultChannel
+	}
+	key, ok := s.cfg.Keys[channel]
+	if !ok {
+		return SentMessage{}, fmt.Errorf("unknown channel %q", channel)
+	}
+	to := uint32(broadcastAddr)
+	if req.To != "" {
+		n, err := parseNodeNum(req.To)
+		if err != nil {
+			return SentMessage{}, err
+		}
+		to = n
+	}
+
+	id := newPacketID()
+	data, err := proto.Marshal(&mpb.Data{Portnum: mpb.PortNum_TEXT_MESSAGE_APP, Payload: []byte(req.Text)})
+	if err != nil {
+		return SentMessage{}, err
+	}
+	enc, err := cryptPacket(key, id, s.from, data)
+	if err != nil {
+		return SentMessage{}, err
+	}
+	pkt := &mpb.MeshPacket{
+		From:     s.from,
+		To:       to,
+		Id:       id,
+		Channel:  channelHash(channel, key),
+		HopLimit: s.cfg.HopLimit,
+		HopStart: s.cfg.HopLimit,
+		WantAck:  req.WantAck,
+	}
+	if len(key) == 0 {
+		pkt.PayloadVariant = &mpb.MeshPacket_Decoded{Decoded: &mpb.Data{Portnum: mpb.PortNum_TEXT_MESSAGE_APP, Payload: []byte(req.Text)}}
+	} else {
+		pkt.PayloadVariant = &mpb.MeshPacket_Encrypted{Encrypted: enc}
+	}
+	gateway := fmt.Sprintf("!%08x", s.from)
+	raw, err := proto.Marshal(&mpb.ServiceEnvelope{Packet: pkt, ChannelId: channel, GatewayId: gateway})
+	if err != nil {
+		return SentMessage{}, err
+	}
+	topic := s.cfg.RootTopic + "/2/e/" + channel + "/" + gateway
+	if err := s.pub.Publish(topic, raw, false); err != nil {
+		return SentMessage{}, fmt.Errorf("%w: %v", ErrPublish, err)
+	}
+
+	m := SentMessage{
+		ID:        id,
+		To:        fmt.Sprintf("%08x", to),
+		Channel:   channel,
+		Text:      req.Text,
+		WantAck:   req.WantAck,
+		Timestamp: time.Now(),
+		Status:    SendPending,
+	}
+	s.store.AddSentMessage(m)
+	return m, nil
+}
@@ -0,0 +1,125 @@
+package meshdump
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mpb "github.com/meshtastic/go/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestExpandPSK(t *testing.T) {
+	key, err := ExpandPSK("AQ==")
+	if err != nil || !bytes.Equal(key, defaultPSK) {
+		t.Fatalf("unexpected default key %x err=%v", key, err)
+	}
+	key, _ = ExpandPSK("Ag==")
+	if key[15] != defaultPSK[15]+1 {
+		t.Errorf("unexpected simple key %x", key)
+	}
+	if key, _ := ExpandPSK("AA=="); key != nil {
+		t.Errorf("expected no key for PSK 0, got %x", key)
+	}
+	if _, err := ExpandPSK("AQI="); err == nil {
+		t.Errorf("expected error for invalid length")
+	}
+	// the default LongFast channel is known to hash to 8
+	if h := channelHash("LongFast", defaultPSK); h != 8 {
+		t.Errorf("unexpected channel hash %d", h)
+	}
+}
+
+func TestSenderRoundTrip(t *testing.T) {
+	fp := &fakePublisher{}
+	st := NewMemoryStore()
+	sender, err := NewSender(fp, st, SendConfig{RootTopic: "msh/EU_868/", GatewayID: "!0000abcd"})
+	if err != nil {
+		t.Fatalf("sender: %v", err)
+	}
+	msg, err := sender.Send(SendRequest{Text: "hello", To: "12345678", WantAck: true})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	msgs := fp.messages()
+	if len(msgs) != 1 || msgs[0].topic != "msh/EU_868/2/e/LongFast/!0000abcd" {
+		t.Fatalf("unexpected publish: %+v", msgs)
+	}
+
+	var env mpb.ServiceEnvelope
+	if err := proto.Unmarshal(msgs[0].payload, &env); err != nil {
+		t.Fatalf("envelope: %v", err)
+	}
+	if env.GetPacket().GetEncrypted() == nil || env.GetPacket().GetTo() != 0x12345678 || !env.GetPacket().GetWantAck() {
+		t.Fatalf("unexpected packet: %v", env.GetPacket())
+	}
+	dec, err := DecodeMessage(msgs[0].topic, string(msgs[0].payload))
+	if err != nil || dec.Text == nil || dec.Text.Text != "hello" || dec.Text.From != "0000abcd" {
+		t.Fatalf("decrypt failed: %+v err=%v", dec, err)
+	}
+
+	// an acknowledgement from the destination updates the status
+	routing, _ := proto.Marshal(&mpb.Routing{Variant: &mpb.Routing_ErrorReason{ErrorReason: mpb.Routing_NONE}})
+	ack := &mpb.MeshPacket{From: 0x12345678, To: 0xabcd, PayloadVariant: &mpb.MeshPacket_Decoded{Decoded: &mpb.Data{
+		Portnum: mpb.PortNum_ROUTING_APP, Payload: routing, RequestId: msg.ID}}}
+	raw, _ := proto.Marshal(&mpb.ServiceEnvelope{Packet: ack, ChannelId: "LongFast"})
+	if err := NewPipeline(st).HandleMessage("msh/EU_868/2/e/LongFast/!12345678", raw); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	sent := st.SentMessages()
+	if len(sent) != 1 || sent[0].Status != SendAcked {
+		t.Errorf("unexpected sent messages: %+v", sent)
+	}
+}
+
+func TestNewSenderCopiesKeys(t *testing.T) {
+	keys := ChannelKeys{"Secret": []byte("0123456789abcdef")}
+	sender, err := NewSender(&fakePublisher{}, NewMemoryStore(), SendConfig{RootTopic: "msh/EU_868", GatewayID: "0000abcd", Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys["LongFast"]; ok || len(keys) != 1 {
+		t.Errorf("caller's keys changed: %v", keys)
+	}
+	if _, ok := sender.cfg.Keys["LongFast"]; !ok || sender.cfg.Keys["Secret"] == nil {
+		t.Errorf("sender keys: %v", sender.cfg.Keys)
+	}
+}
+
+func TestSendHandler(t *testing.T) {
+	srv, st := newTestServer()
+
+	body, _ := json.Marshal(SendRequest{Text: "hi"})
+	rr := httptest.NewRecorder()
+	srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/send", bytes.NewReader(body)))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without sender, got %d", rr.Code)
+	}
+
+	sender, _ := NewSender(&fakePublisher{}, st, SendConfig{RootTopic: "msh/EU_868", GatewayID: "0000abcd"})
+	srv.SetSender(sender)
+	rr = httptest.NewRecorder()
+	srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/send", bytes.NewReader(body)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	body, _ = json.Marshal(SendRequest{Text: "hi", Channel: "Unknown"})
+	rr = httptest.NewRecorder()
+	srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/send", bytes.NewReader(body)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown channel, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/send", nil))
+	var sent []SentMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &sent); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(sent) != 1 || sent[0].To != "ffffffff" || sent[0].Status != SendPending {
+		t.Errorf("unexpected sent messages: %+v", sent)
+	}
+}
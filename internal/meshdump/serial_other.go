@@ -0,0 +1,11 @@
+//go:build !linux
+
+package meshdump
+
+import "os"
+
+// configureSerial is a no-op on platforms without termios support; the port
+// keeps the settings configured by the operating system.
+func configureSerial(f *os.File, baud int) error {
+	return nil
+}
@@ -3,30 +3,68 @@ package meshdump
 import (
 	"embed"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Server wraps the HTTP router and store.
 type Server struct {
-	store *Store
-	mux   *http.ServeMux
+	store    Store
+	mux      *http.ServeMux
+	mqtt     *MQTTClient
+	broker   *Broker
+	pipeline *Pipeline
+	send     *Sender
+	nodeTh   NodeThresholds
 }
 
-func NewServer(store *Store) *Server {
+func NewServer(store Store) *Server {
 	s := &Server{store: store, mux: http.NewServeMux()}
 	s.routes()
 	return s
 }
 func (s *Server) Router() *http.ServeMux { return s.mux }
 
+// SetMQTTClient registers the MQTT client whose state is reported by
+// /api/status/mqtt.
+func (s *Server) SetMQTTClient(c *MQTTClient) { s.mqtt = c }
+
+// SetBroker registers the embedded broker whose clients are reported by
+// /api/broker.
+func (s *Server) SetBroker(b *Broker) { s.broker = b }
+
+// SetPipeline registers the ingest pipeline whose counters are reported by
+// /api/status/pipeline.
+func (s *Server) SetPipeline(p *Pipeline) { s.pipeline = p }
+
+// SetSender enables sending text messages through /api/send.
+func (s *Server) SetSender(sender *Sender) { s.send = sender }
+
+// SetNodeThresholds sets when /api/nodes reports nodes as stale or offline.
+func (s *Server) SetNodeThresholds(th NodeThresholds) { s.nodeTh = th }
+
 func (s *Server) routes() {
 	s.mux.HandleFunc("/api/telemetry/", s.handleTelemetry())
 	s.mux.HandleFunc("/api/nodes", s.handleNodes)
+	s.mux.HandleFunc("/api/nodes/", s.handleNode)
 	s.mux.HandleFunc("/api/nodeinfo/", s.handleNodeInfo())
 	s.mux.HandleFunc("/api/version", s.handleVersion)
+	s.mux.HandleFunc("/api/status/mqtt", s.handleMQTTStatus)
+	s.mux.HandleFunc("/api/status/pipeline", s.handlePipelineStatus)
+	s.mux.HandleFunc("/api/status/store", s.handleStoreStatus)
+	s.mux.HandleFunc("/api/broker", s.handleBroker)
+	s.mux.HandleFunc("/api/packets", s.handlePackets)
+	s.mux.HandleFunc("/api/send", s.handleSend)
+	s.mux.HandleFunc("/api/import/nodedb", s.handleImportNodeDB)
+	s.mux.HandleFunc("/admin", s.handleAdmin)
 	sub, err := fs.Sub(libFS, "web/lib")
 	if err != nil {
 		panic(err)
@@ -42,7 +80,12 @@ func (s *Server) handleTelemetry() http.HandlerFunc {
 			http.Error(w, "missing node", http.StatusBadRequest)
 			return
 		}
-		data := s.store.Get(node)
+		q, err := parseTelemetryQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data := s.store.Query(node, q)
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(data); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -50,14 +93,200 @@ func (s *Server) handleTelemetry() http.HandlerFunc {
 	}
 }
 
+// parseTelemetryQuery reads the from, to, types, limit, order, bucket and agg
+// parameters of a telemetry request. Times are RFC 3339 or Unix seconds.
+func parseTelemetryQuery(v url.Values) (TelemetryQuery, error) {
+	var q TelemetryQuery
+	parseTime := func(name string) (time.Time, error) {
+		s := v.Get(name)
+		if s == "" {
+			return time.Time{}, nil
+		}
+		if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(sec, 0), nil
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s %q", name, s)
+		}
+		return t, nil
+	}
+	var err error
+	if q.From, err = parseTime("from"); err != nil {
+		return q, err
+	}
+	if q.To, err = parseTime("to"); err != nil {
+		return q, err
+	}
+	for _, t := range strings.Split(v.Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			q.Types = append(q.Types, t)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	switch order := v.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("invalid order %q", order)
+	}
+	if s := v.Get("bucket"); s != "" {
+		if q.Bucket, err = parseDays(s); err != nil || q.Bucket < time.Second {
+			return q, fmt.Errorf("invalid bucket %q", s)
+		}
+		q.Agg = AggAvg
+	}
+	if agg := v.Get("agg"); agg != "" {
+		if q.Bucket == 0 {
+			return q, fmt.Errorf("agg requires bucket")
+		}
+		if !ValidAgg(agg) {
+			return q, fmt.Errorf("invalid agg %q", agg)
+		}
+		q.Agg = agg
+	}
+	return q, nil
+}
+
+// nodeStatus is a node as listed by /api/nodes. LastHeard is the latest of
+// the time the node was last seen and the time reported by an imported node
+// database.
+type nodeStatus struct {
+	NodeInfo
+	NodeActivity
+	LastHeard  int64           `json:"last_heard,omitempty"`
+	Status     string          `json:"status"`
+	Annotation *NodeAnnotation `json:"annotation,omitempty"`
+}
+
+// nodeFilter selects the nodes listed by /api/nodes: those carrying all Tags,
+// in Group and, when Search is set, with an ID, name, location, owner or notes
+// containing it. Comparisons ignore case.
+type nodeFilter struct {
+	Tags   []string
+	Group  string
+	Search string
+}
+
+func parseNodeFilter(v url.Values) nodeFilter {
+	return nodeFilter{Tags: v["tag"], Group: v.Get("group"), Search: strings.ToLower(v.Get("q"))}
+}
+
+func (f nodeFilter) match(n nodeStatus) bool {
+	var a NodeAnnotation
+	if n.Annotation != nil {
+		a = *n.Annotation
+	}
+	for _, tag := range f.Tags {
+		if !a.HasTag(tag) {
+			return false
+		}
+	}
+	if f.Group != "" && !strings.EqualFold(a.Group, f.Group) {
+		return false
+	}
+	if f.Search == "" {
+		return true
+	}
+	for _, field := range []string{n.ID, n.LongName, n.ShortName, a.DisplayName, a.Location, a.Owner, a.Notes} {
+		if strings.Contains(strings.ToLower(field), f.Search) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
-	nodes := s.store.Nodes()
+	now := time.Now()
+	filter := parseNodeFilter(r.URL.Query())
+	nodes := []nodeStatus{}
+	for _, n := range s.store.Nodes() {
+		a, _ := s.store.Activity(n.ID)
+		ns := nodeStatus{NodeInfo: n, NodeActivity: a, LastHeard: max(n.LastHeard, a.LastSeen)}
+		ns.Status = s.nodeTh.Status(ns.LastHeard, now)
+		if an, ok := s.store.Annotation(n.ID); ok {
+			ns.Annotation = &an
+		}
+		if filter.match(ns) {
+			nodes = append(nodes, ns)
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(nodes); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// handleNode serves the resources of a known node: /api/nodes/{id}/history
+// and /api/nodes/{id}/annotation.
+func (s *Server) handleNode(w http.ResponseWriter, r *http.Request) {
+	id, resource, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/nodes/"), "/")
+	if !ok || id == "" || (resource != "history" && resource != "annotation") {
+		http.NotFound(w, r)
+		return
+	}
+	if _, known := s.store.Node(id); !known {
+		http.Error(w, "unknown node", http.StatusNotFound)
+		return
+	}
+	if resource == "history" {
+		s.serveNodeHistory(w, id)
+	} else {
+		s.serveAnnotation(w, r, id)
+	}
+}
+
+// serveNodeHistory writes the versions of the metadata of a node, oldest
+// first.
+func (s *Server) serveNodeHistory(w http.ResponseWriter, id string) {
+	history := s.store.NodeHistory(id)
+	if history == nil {
+		history = []NodeChange{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAnnotation reads, replaces (PUT) or removes (DELETE) the annotation of
+// a node. Reading a node without annotation returns an empty object.
+func (s *Server) serveAnnotation(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var a NodeAnnotation
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.store.SetAnnotation(id, a)
+	case http.MethodDelete:
+		s.store.SetAnnotation(id, NodeAnnotation{})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	a, ok := s.store.Annotation(id)
+	if !ok {
+		if _, err := w.Write([]byte("{}")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (s *Server) handleNodeInfo() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := strings.TrimPrefix(r.URL.Path, "/api/nodeinfo/")
@@ -75,7 +304,7 @@ func (s *Server) handleNodeInfo() http.HandlerFunc {
 			if info.ID == "" {
 				info.ID = id
 			}
-			s.store.SetNodeInfo(info)
+			s.store.SetNodeInfo(info, SourceAPI)
 			w.WriteHeader(http.StatusNoContent)
 		case http.MethodGet:
 			info, ok := s.store.Node(id)
@@ -102,9 +331,164 @@ func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleMQTTStatus(w http.ResponseWriter, r *http.Request) {
+	status := MQTTStatus{State: "disabled"}
+	if s.mqtt != nil {
+		status = s.mqtt.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handlePipelineStatus(w http.ResponseWriter, r *http.Request) {
+	if s.pipeline == nil {
+		http.Error(w, "no pipeline", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.pipeline.Stats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleStoreStatus reports the health of the store. It answers 503 while
+// writes to the database fail so it can be used as a health check.
+func (s *Server) handleStoreStatus(w http.ResponseWriter, r *http.Request) {
+	health := StoreHealth{Backend: "unknown", Healthy: true}
+	if hs, ok := s.store.(interface{ Health() StoreHealth }); ok {
+		health = hs.Health()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		log.Printf("http: %v", err)
+	}
+}
+
+// handlePackets lists recent packet metadata, optionally filtered by the node,
+// gateway, channel and region query parameters.
+func (s *Server) handlePackets(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	node := strings.TrimPrefix(strings.ToLower(q.Get("node")), "!")
+	gateway := strings.TrimPrefix(strings.ToLower(q.Get("gateway")), "!")
+	channel, region := q.Get("channel"), q.Get("region")
+	packets := s.store.Packets(func(p PacketMeta) bool {
+		return (node == "" || p.NodeID == node) && (gateway == "" || p.Gateway == gateway) &&
+			(channel == "" || p.Channel == channel) && (region == "" || p.Region == region)
+	}, limit)
+	if packets == nil {
+		packets = []PacketMeta{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(packets); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleBroker(w http.ResponseWriter, r *http.Request) {
+	stats := BrokerStats{State: "disabled", Clients: []BrokerClient{}}
+	if s.broker != nil {
+		stats = s.broker.Stats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.store.SentMessages()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		if s.send == nil {
+			http.Error(w, "sending is not configured", http.StatusServiceUnavailable)
+			return
+		}
+		var req SendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		msg, err := s.send.Send(req)
+		if errors.Is(err, ErrPublish) {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(msg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// maxNodeDBSize limits the size of uploaded node databases.
+const maxNodeDBSize = 16 << 20
+
+// handleImportNodeDB imports a node database uploaded either as the request
+// body or as the "file" field of a multipart form.
+func (s *Server) handleImportNodeDB(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxNodeDBSize)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodes, err := ParseNodeDB(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := ImportNodeDB(s.store, nodes)
+	log.Printf("import: %d nodes, %d telemetry entries from node database", res.Nodes, res.Telemetry)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 //go:embed web/index.html
 var indexHTML string
 
+//go:embed web/admin.html
+var adminHTML string
+
 //go:embed web/lib/*
 var libFS embed.FS
 
@@ -114,3 +498,10 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+func (s *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	if _, err := io.WriteString(w, adminHTML); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
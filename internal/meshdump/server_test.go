@@ -5,12 +5,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
 
-func newTestServer() (*Server, *Store) {
-	st := NewStore("")
+func newTestServer() (*Server, Store) {
+	st := NewMemoryStore()
 	srv := NewServer(st)
 	return srv, st
 }
@@ -66,6 +67,51 @@ func TestNodesHandler(t *testing.T) {
 	}
 }
 
+func TestNodesHandlerStatus(t *testing.T) {
+	srv, st := newTestServer()
+	srv.SetNodeThresholds(NodeThresholds{StaleAfter: time.Hour, OfflineAfter: 3 * time.Hour})
+	now := time.Now()
+	st.SetNodeInfo(NodeInfo{ID: "imported", LastHeard: now.Add(-2 * time.Hour).Unix()}, SourceAPI)
+	st.SetNodeInfo(NodeInfo{ID: "silent"}, SourceAPI)
+	st.AddPackets([]PacketMeta{
+		{NodeID: "imported", Port: "TELEMETRY_APP", Timestamp: now.Add(-5 * time.Hour)},
+		{NodeID: "live", Port: "POSITION_APP", Timestamp: now.Add(-time.Minute)},
+	})
+	st.SetNodeInfo(NodeInfo{ID: "live", LongName: "Live"}, SourceAPI)
+
+	rr := httptest.NewRecorder()
+	srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/nodes", nil))
+	var nodes []struct {
+		ID               string            `json:"id"`
+		Status           string            `json:"status"`
+		LastHeard        int64             `json:"last_heard"`
+		FirstSeen        int64             `json:"first_seen"`
+		LastPositionTime int64             `json:"last_position_time"`
+		Packets          map[string]uint64 `json:"packets"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &nodes); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("unexpected nodes: %s", rr.Body)
+	}
+	byID := map[string]int{}
+	for i, n := range nodes {
+		byID[n.ID] = i
+	}
+	// the imported last heard time is newer than the last packet
+	if n := nodes[byID["imported"]]; n.Status != NodeStale || n.LastHeard != now.Add(-2*time.Hour).Unix() ||
+		n.FirstSeen != now.Add(-5*time.Hour).Unix() || n.Packets["TELEMETRY_APP"] != 1 {
+		t.Errorf("imported: %+v", n)
+	}
+	if n := nodes[byID["live"]]; n.Status != NodeOnline || n.LastPositionTime != now.Add(-time.Minute).Unix() {
+		t.Errorf("live: %+v", n)
+	}
+	if n := nodes[byID["silent"]]; n.Status != NodeOffline || n.LastHeard != 0 {
+		t.Errorf("silent: %+v", n)
+	}
+}
+
 func TestNodeInfoHandler(t *testing.T) {
 	srv, st := newTestServer()
 	st.Add(exampleTelemetry)
@@ -100,3 +146,200 @@ func TestNodeInfoHandler(t *testing.T) {
 		t.Errorf("unexpected node info: %+v", got)
 	}
 }
+
+func TestNodeHistoryHandler(t *testing.T) {
+	srv, st := newTestServer()
+	st.SetNodeInfo(NodeInfo{ID: "n1", LongName: "One"}, SourceNodeInfo)
+	st.SetNodeInfo(NodeInfo{ID: "n1", LongName: "One", Firmware: "2.5"}, SourceMapReport)
+	st.SetNodeInfo(NodeInfo{ID: "n2"}, SourceRadio)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+	rr := get("/api/nodes/n1/history")
+	var history []NodeChange
+	if err := json.Unmarshal(rr.Body.Bytes(), &history); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(history) != 2 || history[0].Source != SourceNodeInfo || history[1].Version != 2 || history[1].Firmware != "2.5" {
+		t.Errorf("unexpected history: %s", rr.Body)
+	}
+	if rr := get("/api/nodes/n2/history"); rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("node without metadata: %d %s", rr.Code, rr.Body)
+	}
+	for _, path := range []string{"/api/nodes/unknown/history", "/api/nodes/n1", "/api/nodes/n1/history/x"} {
+		if rr := get(path); rr.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, rr.Code)
+		}
+	}
+}
+
+func TestNodeAnnotationHandler(t *testing.T) {
+	srv, st := newTestServer()
+	st.SetNodeInfo(NodeInfo{ID: "n1", LongName: "One"}, SourceNodeInfo)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		srv.Router().ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+	if rr := do(http.MethodGet, "/api/nodes/n1/annotation", ""); rr.Code != http.StatusOK || rr.Body.String() != "{}" {
+		t.Errorf("no annotation: %d %s", rr.Code, rr.Body)
+	}
+	rr := do(http.MethodPut, "/api/nodes/n1/annotation", `{"display_name":"Hilltop","tags":["solar","backbone"],"owner":"ops"}`)
+	var a NodeAnnotation
+	if err := json.Unmarshal(rr.Body.Bytes(), &a); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if rr.Code != http.StatusOK || a.DisplayName != "Hilltop" || len(a.Tags) != 2 || a.Tags[0] != "backbone" || a.UpdatedAt.IsZero() {
+		t.Errorf("put: %d %s", rr.Code, rr.Body)
+	}
+	if stored, _ := st.Annotation("n1"); stored.Owner != "ops" {
+		t.Errorf("annotation not stored: %+v", stored)
+	}
+	if rr := do(http.MethodPut, "/api/nodes/n1/annotation", "{"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid body: expected 400, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPut, "/api/nodes/unknown/annotation", "{}"); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown node: expected 404, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/api/nodes/n1/annotation", "{}"); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("post: expected 405, got %d", rr.Code)
+	}
+	if rr := do(http.MethodDelete, "/api/nodes/n1/annotation", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("delete: expected 204, got %d", rr.Code)
+	}
+	if _, ok := st.Annotation("n1"); ok {
+		t.Error("annotation not deleted")
+	}
+}
+
+func TestNodesHandlerFilter(t *testing.T) {
+	srv, st := newTestServer()
+	st.SetNodeInfo(NodeInfo{ID: "n1", LongName: "One"}, SourceNodeInfo)
+	st.SetNodeInfo(NodeInfo{ID: "n2", LongName: "Two"}, SourceNodeInfo)
+	st.SetNodeInfo(NodeInfo{ID: "n3", LongName: "Three"}, SourceNodeInfo)
+	st.SetAnnotation("n1", NodeAnnotation{DisplayName: "Hilltop", Tags: []string{"solar", "backbone"}, Group: "North"})
+	st.SetAnnotation("n2", NodeAnnotation{Tags: []string{"solar"}, Group: "south", Notes: "mounted on the hilltop mast"})
+
+	for query, want := range map[string]string{
+		"":                       "n1,n2,n3",
+		"tag=solar":              "n1,n2",
+		"tag=SOLAR&tag=backbone": "n1",
+		"group=north":            "n1",
+		"q=hilltop":              "n1,n2",
+		"q=three":                "n3",
+		"tag=solar&group=south":  "n2",
+		"tag=missing":            "",
+	} {
+		rr := httptest.NewRecorder()
+		srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/nodes?"+query, nil))
+		var nodes []nodeStatus
+		if err := json.Unmarshal(rr.Body.Bytes(), &nodes); err != nil {
+			t.Fatalf("%s: decode: %v", query, err)
+		}
+		var ids []string
+		for _, n := range nodes {
+			ids = append(ids, n.ID)
+		}
+		if got := strings.Join(ids, ","); got != want {
+			t.Errorf("%q: got %s, want %s", query, got, want)
+		}
+	}
+	rr := httptest.NewRecorder()
+	srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/nodes?group=north", nil))
+	if !strings.Contains(rr.Body.String(), `"annotation":{"display_name":"Hilltop"`) {
+		t.Errorf("annotation not listed: %s", rr.Body)
+	}
+}
+
+func TestMQTTStatusHandlerDisabled(t *testing.T) {
+	srv, _ := newTestServer()
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/status/mqtt", nil)
+	srv.Router().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var st MQTTStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if st.State != "disabled" {
+		t.Errorf("unexpected status: %+v", st)
+	}
+}
+
+func TestBrokerHandlerDisabled(t *testing.T) {
+	srv, _ := newTestServer()
+	rr := httptest.NewRecorder()
+	srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/broker", nil))
+	var stats BrokerStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if stats.State != "disabled" || stats.Clients == nil {
+		t.Errorf("unexpected body: %s", rr.Body.String())
+	}
+}
+
+func TestPacketsHandler(t *testing.T) {
+	srv, st := newTestServer()
+	st.AddPackets([]PacketMeta{
+		{TopicInfo: TopicInfo{Region: "EU_868", Channel: "LongFast", Gateway: "abcd1234"}, NodeID: "00000001"},
+		{TopicInfo: TopicInfo{Region: "US", Channel: "LongFast", Gateway: "abcd1234"}, NodeID: "00000002"},
+	})
+	rr := httptest.NewRecorder()
+	srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/packets?gateway=!ABCD1234&region=US", nil))
+	var got []PacketMeta
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 1 || got[0].NodeID != "00000002" {
+		t.Errorf("unexpected packets: %s", rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/packets?limit=x", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid limit, got %d", rr.Code)
+	}
+}
+
+func TestTelemetryHandlerQuery(t *testing.T) {
+	srv, st := newTestServer()
+	base := time.Unix(1700000000, 0)
+	for i := 0; i < 4; i++ {
+		st.Add(Telemetry{NodeID: "n1", DataType: "voltage", Value: float64(i), Timestamp: base.Add(time.Duration(i) * time.Minute)})
+	}
+	st.Add(Telemetry{NodeID: "n1", DataType: "temperature", Value: 20, Timestamp: base})
+
+	get := func(query string) (int, []Telemetry) {
+		rr := httptest.NewRecorder()
+		srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/telemetry/n1?"+query, nil))
+		var got []Telemetry
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+		}
+		return rr.Code, got
+	}
+
+	if code, got := get("types=voltage&from=1700000060&order=desc&limit=2"); code != http.StatusOK ||
+		len(got) != 2 || got[0].Value != 3 || got[1].Value != 2 {
+		t.Errorf("filtered: %d %v", code, got)
+	}
+	if code, got := get("types=voltage&bucket=1h&agg=max"); code != http.StatusOK || len(got) != 1 || got[0].Value != 3 {
+		t.Errorf("aggregated: %d %v", code, got)
+	}
+	if code, got := get("to=" + base.UTC().Format(time.RFC3339)); code != http.StatusOK || len(got) != 2 {
+		t.Errorf("to: %d %v", code, got)
+	}
+	for _, bad := range []string{"from=yesterday", "limit=0", "order=up", "agg=avg", "bucket=1h&agg=median", "bucket=x"} {
+		if code, _ := get(bad); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", bad, code)
+		}
+	}
+}
@@ -0,0 +1,777 @@
+package meshdump
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore is a Store persisted to a SQLite database using the built-in
+// driver. Nodes, sent messages and recent packets are loaded into memory when
+// the store is opened. Telemetry and rollups stay in the database and are
+// queried on demand, with a bounded cache of recent points per node and data
+// type, so opening the store does not depend on the size of the history.
+//
+// Telemetry is buffered and written in transactions when the buffer is full or
+// the flush interval has passed, and when the store is closed. Reads from the
+// database flush the buffer first. The database uses write-ahead logging so
+// readers don't block the writer.
+//
+// Timestamps are stored as Unix milliseconds and data types as references to
+// the metrics table, so telemetry keeps millisecond precision.
+type SQLiteStore struct {
+	*MemoryStore
+	db    *sql.DB
+	cache *recentCache
+	buf   *writeBuffer
+	// flushMu serialises flushes with compaction
+	flushMu sync.Mutex
+
+	dataMu sync.Mutex
+	// withData holds the nodes having telemetry or rollups
+	withData map[string]bool
+
+	metricMu sync.Mutex
+	// metricIDs maps data types to their row in the metrics table
+	metricIDs map[string]int64
+
+	// nodeMu serialises node updates from assigning the version to writing
+	// the row, so the history is written in version order
+	nodeMu sync.Mutex
+}
+
+// OpenSQLiteStore opens the database at path, creating it if necessary.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serialises writers, which SQLite requires anyway,
+	// and lets transactions wait for each other
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"PRAGMA journal_mode=WAL", "PRAGMA synchronous=NORMAL", "PRAGMA busy_timeout=5000"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	s := &SQLiteStore{
+		MemoryStore: NewMemoryStore(),
+		db:          db,
+		cache:       newRecentCache(defaultCachePoints, time.Now()),
+		buf:         newWriteBuffer(),
+		withData:    make(map[string]bool),
+		metricIDs:   make(map[string]int64),
+	}
+	if _, err := migrate(db, false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.buf.wg.Add(1)
+	go s.runFlusher()
+	return s, nil
+}
+
+// SetCacheSize sets the number of recent points kept in memory for every node
+// and data type. Zero or less selects the default.
+func (s *SQLiteStore) SetCacheSize(n int) {
+	if n <= 0 {
+		n = defaultCachePoints
+	}
+	s.cache.setLimit(n)
+}
+
+// Add stores a telemetry entry.
+func (s *SQLiteStore) Add(t Telemetry) {
+	s.AddBatch([]Telemetry{t})
+}
+
+// AddBatch stores several telemetry entries. They are visible to queries
+// right away and written to disk by the next flush.
+func (s *SQLiteStore) AddBatch(entries []Telemetry) {
+	if len(entries) == 0 {
+		return
+	}
+	for _, t := range entries {
+		log.Printf("store: add node=%s type=%s value=%f", t.NodeID, t.DataType, t.Value)
+	}
+	// keep what the database keeps so cached and stored points agree
+	entries = append([]Telemetry(nil), entries...)
+	for i := range entries {
+		entries[i].Timestamp = entries[i].Timestamp.Truncate(time.Millisecond)
+	}
+	newNodes := s.registerNodes(entries)
+	s.cache.add(entries)
+	s.dataMu.Lock()
+	for _, t := range entries {
+		s.withData[t.NodeID] = true
+	}
+	s.dataMu.Unlock()
+	if s.buffer(entries, newNodes) {
+		s.Flush()
+	}
+}
+
+// metricID returns the ID of a data type, adding it to the metrics table
+// through tx when it is new. New IDs are remembered by rememberMetrics once
+// tx is committed.
+func (s *SQLiteStore) metricID(tx *sql.Tx, name string, added map[string]int64) (int64, error) {
+	s.metricMu.Lock()
+	id, ok := s.metricIDs[name]
+	s.metricMu.Unlock()
+	if ok {
+		return id, nil
+	}
+	if id, ok := added[name]; ok {
+		return id, nil
+	}
+	if _, err := tx.Exec("INSERT OR IGNORE INTO metrics (name) VALUES (?)", name); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRow("SELECT id FROM metrics WHERE name = ?", name).Scan(&id); err != nil {
+		return 0, err
+	}
+	added[name] = id
+	return id, nil
+}
+
+// rememberMetrics records metric IDs added by a committed transaction.
+func (s *SQLiteStore) rememberMetrics(added map[string]int64) {
+	s.metricMu.Lock()
+	defer s.metricMu.Unlock()
+	for name, id := range added {
+		s.metricIDs[name] = id
+	}
+}
+
+// knownMetrics returns the IDs of the given data types. Types never stored
+// are skipped.
+func (s *SQLiteStore) knownMetrics(names []string) []any {
+	s.metricMu.Lock()
+	defer s.metricMu.Unlock()
+	var ids []any
+	for _, name := range names {
+		if id, ok := s.metricIDs[name]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// telemetryColumns selects the columns read by selectTelemetry.
+const telemetryColumns = "SELECT t.node_id, m.name, t.value, t.ts FROM telemetry t JOIN metrics m ON m.id = t.metric_id"
+
+// Get returns the raw telemetry of a node in the order it was stored.
+func (s *SQLiteStore) Get(nodeID string) []Telemetry {
+	s.Flush()
+	return s.selectTelemetry(telemetryColumns+" WHERE t.node_id = ? ORDER BY t.rowid", nodeID)
+}
+
+// selectTelemetry runs a query returning telemetry rows.
+func (s *SQLiteStore) selectTelemetry(query string, args ...any) []Telemetry {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("store: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var out []Telemetry
+	for rows.Next() {
+		var t Telemetry
+		var ts int64
+		if err := rows.Scan(&t.NodeID, &t.DataType, &t.Value, &ts); err == nil {
+			t.Timestamp = time.UnixMilli(ts)
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// DataTypes returns the sorted data types kept for a node.
+func (s *SQLiteStore) DataTypes(nodeID string) []string {
+	s.Flush()
+	rows, err := s.db.Query("SELECT name FROM metrics WHERE id IN (SELECT metric_id FROM telemetry WHERE node_id = ? UNION SELECT metric_id FROM rollups WHERE node_id = ?) ORDER BY name", nodeID, nodeID)
+	if err != nil {
+		log.Printf("store: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	types := []string{}
+	for rows.Next() {
+		var dt string
+		if err := rows.Scan(&dt); err == nil {
+			types = append(types, dt)
+		}
+	}
+	return types
+}
+
+// Query returns the telemetry of a node selected by q. Recent ranges are
+// answered from the cache; everything else reads only the matching rows
+// using the (node, metric, time) index.
+func (s *SQLiteStore) Query(nodeID string, q TelemetryQuery) []Telemetry {
+	// the range is compared at the precision of the stored timestamps
+	q.From = q.From.Truncate(time.Millisecond)
+	q.To = q.To.Truncate(time.Millisecond)
+	if points, ok := s.cache.query(nodeID, q); ok {
+		return runQuery(nodeID, q, nil, points)
+	}
+	s.Flush()
+	where, args := " WHERE t.node_id = ?", []any{nodeID}
+	if len(q.Types) > 0 {
+		ids := s.knownMetrics(q.Types)
+		if len(ids) == 0 {
+			return []Telemetry{}
+		}
+		where += " AND t.metric_id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		args = append(args, ids...)
+	}
+	if !q.From.IsZero() {
+		where += " AND t.ts >= ?"
+		args = append(args, q.From.UnixMilli())
+	}
+	if !q.To.IsZero() {
+		where += " AND t.ts <= ?"
+		args = append(args, q.To.UnixMilli())
+	}
+	points := s.selectTelemetry(telemetryColumns+where, args...)
+	rollups := s.selectRollups(rollupColumns+where, args...)
+	return runQuery(nodeID, q, rollups, points)
+}
+
+// Rollups returns the aggregated telemetry of a node, oldest first.
+func (s *SQLiteStore) Rollups(nodeID string) []Rollup {
+	return s.selectRollups(rollupColumns+" WHERE t.node_id = ? ORDER BY t.ts, m.name", nodeID)
+}
+
+// rollupColumns selects the columns read by selectRollups.
+const rollupColumns = "SELECT t.node_id, m.name, t.resolution, t.ts, t.count, t.min, t.max, t.avg FROM rollups t JOIN metrics m ON m.id = t.metric_id"
+
+// selectRollups runs a query returning rollup rows.
+func (s *SQLiteStore) selectRollups(query string, args ...any) []Rollup {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("store: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var out []Rollup
+	for rows.Next() {
+		var r Rollup
+		var res, ts int64
+		if err := rows.Scan(&r.NodeID, &r.DataType, &res, &ts, &r.Count, &r.Min, &r.Max, &r.Avg); err == nil {
+			r.Resolution = time.Duration(res) * time.Second
+			r.Timestamp = time.UnixMilli(ts).UTC()
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Nodes returns the list of known nodes with associated metadata.
+func (s *SQLiteStore) Nodes() []NodeInfo {
+	nodes := s.MemoryStore.Nodes()
+	s.dataMu.Lock()
+	defer s.dataMu.Unlock()
+	for i := range nodes {
+		nodes[i].HasData = s.withData[nodes[i].ID]
+	}
+	return nodes
+}
+
+// Node retrieves metadata for the given node ID.
+func (s *SQLiteStore) Node(id string) (NodeInfo, bool) {
+	n, ok := s.MemoryStore.Node(id)
+	if ok {
+		s.dataMu.Lock()
+		n.HasData = s.withData[id]
+		s.dataMu.Unlock()
+	}
+	return n, ok
+}
+
+// hasStoredData reports whether the database holds telemetry or rollups for
+// a node. Both lookups use the indexes starting with node_id.
+func (s *SQLiteStore) hasStoredData(id string) bool {
+	var ok bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM telemetry WHERE node_id = ?) OR EXISTS (SELECT 1 FROM rollups WHERE node_id = ?)", id, id).Scan(&ok)
+	return err == nil && ok
+}
+
+// SetNodeInfo stores metadata about a node. Changes are added to the
+// node_history table.
+func (s *SQLiteStore) SetNodeInfo(info NodeInfo, source string) {
+	s.nodeMu.Lock()
+	defer s.nodeMu.Unlock()
+	s.mu.Lock()
+	info, c, changed := s.setNodeInfo(info, source)
+	s.mu.Unlock()
+	s.recordWrite("node info", s.writeNodeInfo(info, c, changed))
+}
+
+// writeNodeInfo replaces the row of a node and adds c to its history when
+// changed is true.
+func (s *SQLiteStore) writeNodeInfo(info NodeInfo, c NodeChange, changed bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT OR REPLACE INTO nodes (node_id, long_name, short_name, firmware, hardware, role, last_heard) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		info.ID, info.LongName, info.ShortName, info.Firmware, info.Hardware, info.Role, info.LastHeard); err != nil {
+		return err
+	}
+	if changed {
+		if _, err := tx.Exec("INSERT INTO node_history (node_id, version, ts, source, long_name, short_name, firmware, hardware, role, changed) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			info.ID, c.Version, c.Timestamp.UnixMilli(), c.Source, c.LongName, c.ShortName, c.Firmware, c.Hardware, c.Role, strings.Join(c.Changed, ",")); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// NodeHistory returns the versions of the metadata of a node, oldest first,
+// from the database.
+func (s *SQLiteStore) NodeHistory(id string) []NodeChange {
+	rows, err := s.db.Query("SELECT version, ts, source, long_name, short_name, firmware, hardware, role, changed FROM node_history WHERE node_id = ? ORDER BY version", id)
+	if err != nil {
+		log.Printf("store: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var out []NodeChange
+	for rows.Next() {
+		var c NodeChange
+		var ts int64
+		var changed string
+		if err := rows.Scan(&c.Version, &ts, &c.Source, &c.LongName, &c.ShortName, &c.Firmware, &c.Hardware, &c.Role, &changed); err == nil {
+			c.Timestamp = time.UnixMilli(ts)
+			if changed != "" {
+				c.Changed = strings.Split(changed, ",")
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// SetAnnotation replaces the annotation of a node in memory and in the
+// database.
+func (s *SQLiteStore) SetAnnotation(id string, a NodeAnnotation) {
+	a = s.setAnnotation(id, a)
+	s.recordWrite("node annotation", s.writeAnnotation(id, a))
+}
+
+// writeAnnotation replaces the annotation rows of a node, or deletes them
+// when a is empty.
+func (s *SQLiteStore) writeAnnotation(id string, a NodeAnnotation) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM node_annotations WHERE node_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM node_tags WHERE node_id = ?", id); err != nil {
+		return err
+	}
+	if !a.empty() {
+		if _, err := tx.Exec("INSERT INTO node_annotations (node_id, display_name, group_name, location, owner, notes, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			id, a.DisplayName, a.Group, a.Location, a.Owner, a.Notes, a.UpdatedAt.UnixMilli()); err != nil {
+			return err
+		}
+		for _, tag := range a.Tags {
+			if _, err := tx.Exec("INSERT INTO node_tags (node_id, tag) VALUES (?, ?)", id, tag); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// AddSentMessage records a message sent to the mesh.
+func (s *SQLiteStore) AddSentMessage(m SentMessage) {
+	s.MemoryStore.AddSentMessage(m)
+	ts := m.Timestamp.Format(time.RFC3339Nano)
+	_, err := s.db.Exec("INSERT OR REPLACE INTO sent_messages (id, to_node, channel, text, want_ack, timestamp, status, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		m.ID, m.To, m.Channel, m.Text, m.WantAck, ts, m.Status, m.Error)
+	s.recordWrite("sent message", err)
+}
+
+// AckSentMessage updates the delivery state of the sent message with the given
+// packet ID.
+func (s *SQLiteStore) AckSentMessage(id uint32, errReason string) bool {
+	m, ok := s.ackSentMessage(id, errReason)
+	if !ok {
+		return false
+	}
+	_, err := s.db.Exec("UPDATE sent_messages SET status = ?, error = ? WHERE id = ?", m.Status, m.Error, id)
+	s.recordWrite("sent message", err)
+	return true
+}
+
+// AddPackets records the metadata of received packets. The database keeps
+// every record until Compact expires it while memory only holds the most
+// recent ones.
+func (s *SQLiteStore) AddPackets(ps []PacketMeta) {
+	if len(ps) == 0 {
+		return
+	}
+	activity := s.addPackets(ps)
+	s.recordWrite("packets", s.writePackets(ps, activity))
+}
+
+// writePackets inserts packet metadata and the updated node activity in a
+// transaction.
+func (s *SQLiteStore) writePackets(ps []PacketMeta, activity map[string]NodeActivity) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range ps {
+		ts := p.Timestamp.Format(time.RFC3339Nano)
+		if _, err := tx.Exec("INSERT INTO packets (timestamp, node_id, topic, root, region, format, channel, gateway, port) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			ts, p.NodeID, p.Topic, p.Root, p.Region, p.Format, p.Channel, p.Gateway, p.Port); err != nil {
+			return err
+		}
+	}
+	for id, a := range activity {
+		if _, err := tx.Exec("INSERT OR REPLACE INTO node_activity (node_id, first_seen, last_seen, last_position_time) VALUES (?, ?, ?, ?)",
+			id, a.FirstSeen, a.LastSeen, a.LastPositionTime); err != nil {
+			return err
+		}
+		for port, n := range a.Packets {
+			if _, err := tx.Exec("INSERT OR REPLACE INTO node_packet_counts (node_id, port, count) VALUES (?, ?, ?)", id, port, n); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Compact applies the retention tiers at time now to the database.
+func (s *SQLiteStore) Compact(tiers []RetentionTier, now time.Time) CompactStats {
+	if len(tiers) == 0 || tiers[0].MaxAge == 0 {
+		return CompactStats{}
+	}
+	// flush and keep further flushes out until the old rows are replaced
+	s.Flush()
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	rawCutoff := compactCutoff(tiers, 0, now)
+	rows, err := s.db.Query("SELECT t.rowid, t.node_id, m.name, t.value, t.ts FROM telemetry t JOIN metrics m ON m.id = t.metric_id WHERE t.ts <= ?",
+		rawCutoff.UnixMilli())
+	if err != nil {
+		log.Printf("store: compaction: %v", err)
+		return CompactStats{}
+	}
+	var ids []int64
+	var old []Telemetry
+	for rows.Next() {
+		var id int64
+		var t Telemetry
+		var ts int64
+		if err := rows.Scan(&id, &t.NodeID, &t.DataType, &t.Value, &ts); err != nil {
+			continue
+		}
+		if t.Timestamp = time.UnixMilli(ts); t.Timestamp.Before(rawCutoff) {
+			ids = append(ids, id)
+			old = append(old, t)
+		}
+	}
+	rows.Close()
+
+	st, c := planCompaction(tiers, now, old, sqliteRollups{s})
+	s.cache.expire(rawCutoff)
+	s.prunePackets(packetCutoff(tiers, now))
+	n, err := s.pruneStoredPackets(packetCutoff(tiers, now))
+	s.recordWrite("expiry", err)
+	st.Pruned = n
+	if st.RolledUp == 0 && st.Deleted == 0 {
+		return st
+	}
+	s.recordWrite("compaction", s.persistCompaction(ids, c))
+
+	// nodes may have lost all their data when no tier follows
+	affected := make(map[string]bool)
+	for _, t := range old {
+		affected[t.NodeID] = true
+	}
+	for k := range c.removed {
+		affected[k.node] = true
+	}
+	for id := range affected {
+		has := s.hasStoredData(id)
+		s.dataMu.Lock()
+		s.withData[id] = has
+		s.dataMu.Unlock()
+	}
+	return st
+}
+
+// pruneStoredPackets deletes the packet metadata older than cutoff from the
+// database and returns how many records were deleted.
+func (s *SQLiteStore) pruneStoredPackets(cutoff time.Time) (int, error) {
+	res, err := s.db.Exec("DELETE FROM packets WHERE unixepoch(timestamp, 'subsec') < ?", float64(cutoff.UnixMilli())/1000)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// persistCompaction applies a compaction to the database.
+func (s *SQLiteStore) persistCompaction(ids []int64, c compaction) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		if _, err := tx.Exec("DELETE FROM telemetry WHERE rowid = ?", id); err != nil {
+			return err
+		}
+	}
+	added := make(map[string]int64)
+	for k := range c.removed {
+		metric, err := s.metricID(tx, k.dtype, added)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM rollups WHERE node_id = ? AND metric_id = ? AND resolution = ? AND ts = ?",
+			k.node, metric, int64(k.res/time.Second), k.ts*1000); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.upsert {
+		metric, err := s.metricID(tx, r.DataType, added)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO rollups (node_id, metric_id, resolution, ts, count, min, max, avg) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			r.NodeID, metric, int64(r.Resolution/time.Second), r.Timestamp.UnixMilli(), r.Count, r.Min, r.Max, r.Avg); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.rememberMetrics(added)
+	return nil
+}
+
+// sqliteRollups is the rollupSource of a SQLiteStore.
+type sqliteRollups struct{ s *SQLiteStore }
+
+func (src sqliteRollups) rollup(k rollupKey) (Rollup, bool) {
+	rs := src.s.selectRollups(rollupColumns+" WHERE t.node_id = ? AND m.name = ? AND t.resolution = ? AND t.ts = ?",
+		k.node, k.dtype, int64(k.res/time.Second), k.ts*1000)
+	if len(rs) == 0 {
+		return Rollup{}, false
+	}
+	return rs[0], true
+}
+
+func (src sqliteRollups) expired(res time.Duration, cutoff time.Time) []Rollup {
+	return src.s.selectRollups(rollupColumns+" WHERE t.resolution = ? AND t.ts <= ?",
+		int64(res/time.Second), cutoff.Add(-res).UnixMilli())
+}
+
+// load repopulates the in-memory state from the SQLite database.
+func (s *SQLiteStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// load nodes
+	rows, err := s.db.Query("SELECT node_id, COALESCE(long_name, ''), COALESCE(short_name, ''), COALESCE(firmware, ''), COALESCE(hardware, ''), COALESCE(role, ''), COALESCE(last_heard, 0) FROM nodes")
+	if err == nil {
+		defer func() {
+			if cerr := rows.Close(); cerr != nil {
+				log.Printf("store: rows close: %v", cerr)
+			}
+		}()
+		var ids []string
+		for rows.Next() {
+			var id, long, short, fw, hw, role string
+			var heard int64
+			if err := rows.Scan(&id, &long, &short, &fw, &hw, &role, &heard); err == nil {
+				s.nodes[id] = NodeInfo{ID: id, LongName: long, ShortName: short, Firmware: fw, Hardware: hw, Role: role, LastHeard: heard}
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		s.order = append([]string(nil), ids...)
+	}
+
+	if s.debug && len(s.nodes) > 0 {
+		log.Printf("debug: loaded nodes %+v", s.nodes)
+	}
+
+	// the latest metadata versions; the history itself stays on disk
+	vrows, err := s.db.Query("SELECT node_id, MAX(version) FROM node_history GROUP BY node_id")
+	if err != nil {
+		return err
+	}
+	for vrows.Next() {
+		var id string
+		var v int
+		if err := vrows.Scan(&id, &v); err == nil {
+			s.versions[id] = v
+		}
+	}
+	if err := vrows.Err(); err != nil {
+		return err
+	}
+
+	// load the metric dictionary
+	metricRows, err := s.db.Query("SELECT id, name FROM metrics")
+	if err != nil {
+		return err
+	}
+	for metricRows.Next() {
+		var id int64
+		var name string
+		if err := metricRows.Scan(&id, &name); err == nil {
+			s.metricIDs[name] = id
+		}
+	}
+	if err := metricRows.Err(); err != nil {
+		return err
+	}
+
+	// telemetry and rollups stay on disk; only note which nodes have any
+	for _, id := range s.order {
+		if s.hasStoredData(id) {
+			s.withData[id] = true
+		}
+	}
+
+	// load sent messages
+	mrows, err := s.db.Query("SELECT id, to_node, channel, text, want_ack, timestamp, status, error FROM sent_messages ORDER BY timestamp")
+	if err == nil {
+		defer func() {
+			if cerr := mrows.Close(); cerr != nil {
+				log.Printf("store: mrows close: %v", cerr)
+			}
+		}()
+		for mrows.Next() {
+			var m SentMessage
+			var tsStr string
+			if err := mrows.Scan(&m.ID, &m.To, &m.Channel, &m.Text, &m.WantAck, &tsStr, &m.Status, &m.Error); err == nil {
+				m.Timestamp, _ = time.Parse(time.RFC3339Nano, tsStr)
+				s.sent = append(s.sent, m)
+			}
+		}
+	}
+
+	// load the most recent packet metadata
+	prows, err := s.db.Query("SELECT timestamp, node_id, topic, root, region, format, channel, gateway, COALESCE(port, '') FROM (SELECT * FROM packets ORDER BY id DESC LIMIT ?) ORDER BY id", packetLimit)
+	if err == nil {
+		defer func() {
+			if cerr := prows.Close(); cerr != nil {
+				log.Printf("store: prows close: %v", cerr)
+			}
+		}()
+		for prows.Next() {
+			var p PacketMeta
+			var tsStr string
+			if err := prows.Scan(&tsStr, &p.NodeID, &p.Topic, &p.Root, &p.Region, &p.Format, &p.Channel, &p.Gateway, &p.Port); err == nil {
+				p.Timestamp, _ = time.Parse(time.RFC3339Nano, tsStr)
+				s.packets = append(s.packets, p)
+			}
+		}
+	}
+
+	// load node activity and packet counts
+	arows, err := s.db.Query("SELECT node_id, COALESCE(first_seen, 0), COALESCE(last_seen, 0), COALESCE(last_position_time, 0) FROM node_activity")
+	if err != nil {
+		return err
+	}
+	for arows.Next() {
+		var id string
+		var a NodeActivity
+		if err := arows.Scan(&id, &a.FirstSeen, &a.LastSeen, &a.LastPositionTime); err == nil {
+			s.activity[id] = &a
+		}
+	}
+	if err := arows.Err(); err != nil {
+		return err
+	}
+	crows, err := s.db.Query("SELECT node_id, port, count FROM node_packet_counts")
+	if err != nil {
+		return err
+	}
+	for crows.Next() {
+		var id, port string
+		var n uint64
+		if err := crows.Scan(&id, &port, &n); err != nil {
+			continue
+		}
+		a := s.activity[id]
+		if a == nil {
+			a = &NodeActivity{}
+			s.activity[id] = a
+		}
+		if a.Packets == nil {
+			a.Packets = make(map[string]uint64)
+		}
+		a.Packets[port] = n
+	}
+	if err := crows.Err(); err != nil {
+		return err
+	}
+
+	// load node annotations and their tags
+	nrows, err := s.db.Query("SELECT node_id, COALESCE(display_name, ''), COALESCE(group_name, ''), COALESCE(location, ''), COALESCE(owner, ''), COALESCE(notes, ''), updated_at FROM node_annotations")
+	if err != nil {
+		return err
+	}
+	for nrows.Next() {
+		var id string
+		var a NodeAnnotation
+		var updated int64
+		if err := nrows.Scan(&id, &a.DisplayName, &a.Group, &a.Location, &a.Owner, &a.Notes, &updated); err == nil {
+			a.UpdatedAt = time.UnixMilli(updated)
+			s.annotations[id] = a
+		}
+	}
+	if err := nrows.Err(); err != nil {
+		return err
+	}
+	trows, err := s.db.Query("SELECT node_id, tag FROM node_tags ORDER BY node_id, tag")
+	if err != nil {
+		return err
+	}
+	for trows.Next() {
+		var id, tag string
+		if err := trows.Scan(&id, &tag); err != nil {
+			continue
+		}
+		if a, ok := s.annotations[id]; ok {
+			a.Tags = append(a.Tags, tag)
+			s.annotations[id] = a
+		}
+	}
+	return trows.Err()
+}
+
+// Close writes the buffered telemetry and closes the underlying database.
+func (s *SQLiteStore) Close() error {
+	close(s.buf.done)
+	s.buf.wg.Wait()
+	ferr := s.Flush()
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return ferr
+}
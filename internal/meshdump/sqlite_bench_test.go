@@ -0,0 +1,100 @@
+package meshdump
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The range query benchmarks read one day of one metric of one node out of a
+// month of history of several nodes and metrics, once by loading the rows of
+// the node from the text schema used before migration 3 and filtering them in
+// Go, and once through the indexed range query of the current schema:
+//
+//	go test -run '^$' -bench RangeQuery ./internal/meshdump
+
+const (
+	benchNodes   = 5
+	benchMetrics = 4
+	benchDays    = 30
+	benchStep    = 10 * time.Minute
+)
+
+var benchStart = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+func BenchmarkRangeQuery(b *testing.B) {
+	from := benchStart.Add(15 * 24 * time.Hour)
+	to := from.Add(24 * time.Hour)
+	want := int(24 * time.Hour / benchStep)
+
+	b.Run("text", func(b *testing.B) {
+		db := openAtVersion(b, filepath.Join(b.TempDir(), "data.db"), 2)
+		defer db.Close()
+		tx, err := db.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for n := 0; n < benchNodes; n++ {
+			for m := 0; m < benchMetrics; m++ {
+				for ts := benchStart; ts.Before(benchStart.Add(benchDays * 24 * time.Hour)); ts = ts.Add(benchStep) {
+					if _, err := tx.Exec("INSERT INTO telemetry (node_id, data_type, value, timestamp) VALUES (?, ?, ?, ?)",
+						fmt.Sprint("n", n), fmt.Sprint("metric", m), 1.0, ts.Format(time.RFC3339Nano)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			rows, err := db.Query("SELECT node_id, data_type, value, timestamp FROM telemetry WHERE node_id = ?", "n2")
+			if err != nil {
+				b.Fatal(err)
+			}
+			var points []Telemetry
+			for rows.Next() {
+				var t Telemetry
+				var tsStr string
+				if err := rows.Scan(&t.NodeID, &t.DataType, &t.Value, &tsStr); err != nil {
+					b.Fatal(err)
+				}
+				t.Timestamp, _ = time.Parse(time.RFC3339Nano, tsStr)
+				if t.DataType == "metric1" && !t.Timestamp.Before(from) && !t.Timestamp.After(to) {
+					points = append(points, t)
+				}
+			}
+			if len(points) != want+1 {
+				b.Fatalf("%d points", len(points))
+			}
+		}
+	})
+
+	b.Run("integer", func(b *testing.B) {
+		s, err := OpenSQLiteStore(filepath.Join(b.TempDir(), "data.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer s.Close()
+		s.SetWriteBuffer(10000, time.Hour)
+		for n := 0; n < benchNodes; n++ {
+			for m := 0; m < benchMetrics; m++ {
+				for ts := benchStart; ts.Before(benchStart.Add(benchDays * 24 * time.Hour)); ts = ts.Add(benchStep) {
+					s.buffer([]Telemetry{{NodeID: fmt.Sprint("n", n), DataType: fmt.Sprint("metric", m), Value: 1, Timestamp: ts}}, nil)
+				}
+			}
+		}
+		if err := s.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		q := TelemetryQuery{From: from, To: to, Types: []string{"metric1"}}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if got := s.Query("n2", q); len(got) != want+1 {
+				b.Fatalf("%d points", len(got))
+			}
+		}
+	})
+}
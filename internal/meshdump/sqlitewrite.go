@@ -0,0 +1,247 @@
+package meshdump
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultFlushSize is the number of buffered telemetry points that
+	// triggers a write to the database.
+	defaultFlushSize = 500
+	// defaultFlushInterval is the longest time telemetry stays buffered.
+	defaultFlushInterval = time.Second
+	// maxPendingBatches bounds the buffer while the database keeps failing,
+	// as a multiple of the flush size. The oldest points are dropped beyond it.
+	maxPendingBatches = 20
+)
+
+// StoreHealth is the state of the store reported by /api/status/store.
+// Healthy is false while the last write of any kind, such as "telemetry" or
+// "packets", failed; Failing lists those kinds.
+type StoreHealth struct {
+	Backend     string     `json:"backend"`
+	Healthy     bool       `json:"healthy"`
+	Failing     []string   `json:"failing,omitempty"`
+	Pending     int        `json:"pending"`
+	Written     uint64     `json:"written"`
+	Flushes     uint64     `json:"flushes"`
+	WriteErrors uint64     `json:"write_errors"`
+	Dropped     uint64     `json:"dropped"`
+	LastFlush   *time.Time `json:"last_flush,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Health reports the state of an in-memory store, which cannot fail to write.
+func (s *MemoryStore) Health() StoreHealth {
+	return StoreHealth{Backend: "memory", Healthy: true}
+}
+
+// writeBuffer holds telemetry waiting to be written to the database and the
+// outcome of past writes.
+type writeBuffer struct {
+	mu       sync.Mutex
+	size     int
+	interval time.Duration
+	pending  []Telemetry
+	// nodes are the node rows to create with the pending telemetry
+	nodes []string
+	reset chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	written, flushes, writeErrors, dropped uint64
+	lastFlush, lastErrorAt                 time.Time
+	lastError                              string
+	// failing holds the kinds of writes whose last attempt failed
+	failing map[string]bool
+}
+
+func newWriteBuffer() *writeBuffer {
+	return &writeBuffer{
+		size:     defaultFlushSize,
+		interval: defaultFlushInterval,
+		reset:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		failing:  make(map[string]bool),
+	}
+}
+
+// SetWriteBuffer sets how many telemetry points are buffered before they are
+// written in one transaction and how long they may wait at most. Zero or less
+// selects the defaults.
+func (s *SQLiteStore) SetWriteBuffer(size int, interval time.Duration) {
+	if size <= 0 {
+		size = defaultFlushSize
+	}
+	if interval <= 0 {
+		interval = defaultFlushInterval
+	}
+	s.buf.mu.Lock()
+	s.buf.size = size
+	s.buf.interval = interval
+	s.buf.mu.Unlock()
+	select {
+	case s.buf.reset <- struct{}{}:
+	default:
+	}
+}
+
+// runFlusher writes the buffer every flush interval until the store is
+// closed.
+func (s *SQLiteStore) runFlusher() {
+	defer s.buf.wg.Done()
+	for {
+		s.buf.mu.Lock()
+		interval := s.buf.interval
+		s.buf.mu.Unlock()
+		timer := time.NewTimer(interval)
+		select {
+		case <-s.buf.done:
+			timer.Stop()
+			return
+		case <-s.buf.reset:
+			timer.Stop()
+		case <-timer.C:
+			s.Flush()
+		}
+	}
+}
+
+// buffer queues entries for writing and reports whether the buffer is full.
+func (s *SQLiteStore) buffer(entries []Telemetry, newNodes []string) bool {
+	b := s.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, entries...)
+	b.nodes = append(b.nodes, newNodes...)
+	if n := len(b.pending) - maxPendingBatches*b.size; n > 0 {
+		b.pending = append([]Telemetry(nil), b.pending[n:]...)
+		b.dropped += uint64(n)
+		log.Printf("store: write buffer full, dropped %d telemetry entries", n)
+	}
+	return len(b.pending) >= b.size
+}
+
+// Flush writes the buffered telemetry to the database in one transaction. On
+// failure the entries stay buffered and are retried by the next flush.
+func (s *SQLiteStore) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	b := s.buf
+	b.mu.Lock()
+	entries, nodes := b.pending, b.nodes
+	b.pending, b.nodes = nil, nil
+	b.mu.Unlock()
+	if len(entries) == 0 && len(nodes) == 0 {
+		return nil
+	}
+
+	err := s.writeTelemetry(entries, nodes)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		// keep the failed entries ahead of those added meanwhile
+		b.pending = append(entries, b.pending...)
+		b.nodes = append(nodes, b.nodes...)
+		b.recordError("telemetry", err)
+		log.Printf("store: flush of %d telemetry entries failed: %v", len(entries), err)
+		return err
+	}
+	b.written += uint64(len(entries))
+	b.flushes++
+	b.lastFlush = time.Now()
+	delete(b.failing, "telemetry")
+	return nil
+}
+
+// writeTelemetry inserts entries and the rows of new nodes in a transaction.
+func (s *SQLiteStore) writeTelemetry(entries []Telemetry, nodes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range nodes {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO nodes (node_id, long_name, short_name, firmware) VALUES (?, '', '', '')", id); err != nil {
+			return err
+		}
+	}
+	stmt, err := tx.Prepare("INSERT INTO telemetry (node_id, metric_id, value, ts) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	added := make(map[string]int64)
+	for _, t := range entries {
+		metric, err := s.metricID(tx, t.DataType, added)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(t.NodeID, metric, t.Value, t.Timestamp.UnixMilli()); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.rememberMetrics(added)
+	return nil
+}
+
+// recordError notes a failed write of kind. The caller must hold b.mu.
+func (b *writeBuffer) recordError(kind string, err error) {
+	b.writeErrors++
+	b.lastError = err.Error()
+	b.lastErrorAt = time.Now()
+	b.failing[kind] = true
+}
+
+// recordWrite records the outcome of a write of kind outside the telemetry
+// buffer, logging it when err is not nil. A successful write clears an
+// earlier failure of the same kind.
+func (s *SQLiteStore) recordWrite(kind string, err error) {
+	s.buf.mu.Lock()
+	defer s.buf.mu.Unlock()
+	if err == nil {
+		delete(s.buf.failing, kind)
+		return
+	}
+	err = fmt.Errorf("%s: %w", kind, err)
+	log.Printf("store: %v", err)
+	s.buf.recordError(kind, err)
+}
+
+// Health reports the write buffer and the outcome of past writes.
+func (s *SQLiteStore) Health() StoreHealth {
+	b := s.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := StoreHealth{
+		Backend:     "sqlite",
+		Healthy:     len(b.failing) == 0,
+		Pending:     len(b.pending),
+		Written:     b.written,
+		Flushes:     b.flushes,
+		WriteErrors: b.writeErrors,
+		Dropped:     b.dropped,
+		LastError:   b.lastError,
+	}
+	for kind := range b.failing {
+		h.Failing = append(h.Failing, kind)
+	}
+	sort.Strings(h.Failing)
+	if !b.lastFlush.IsZero() {
+		t := b.lastFlush
+		h.LastFlush = &t
+	}
+	if !b.lastErrorAt.IsZero() {
+		t := b.lastErrorAt
+		h.LastErrorAt = &t
+	}
+	return h
+}
@@ -0,0 +1,147 @@
+package meshdump
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storedRows counts the telemetry rows written to the database without
+// flushing the buffer.
+func storedRows(t *testing.T, s *SQLiteStore) int {
+	t.Helper()
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM telemetry").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSQLiteStoreWriteBuffer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	s, err := OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode string
+	if err := s.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal mode %q: %v", mode, err)
+	}
+
+	s.SetWriteBuffer(3, time.Hour)
+	now := time.Now()
+	s.AddBatch([]Telemetry{
+		{NodeID: "n1", DataType: "voltage", Value: 1, Timestamp: now},
+		{NodeID: "n1", DataType: "voltage", Value: 2, Timestamp: now.Add(time.Second)},
+	})
+	if n := storedRows(t, s); n != 0 {
+		t.Errorf("%d rows written before the buffer is full", n)
+	}
+	if got := s.Query("n1", TelemetryQuery{From: now}); len(got) != 2 {
+		t.Errorf("buffered points not visible: %v", got)
+	}
+	s.Add(Telemetry{NodeID: "n1", DataType: "voltage", Value: 3, Timestamp: now.Add(2 * time.Second)})
+	if n := storedRows(t, s); n != 3 {
+		t.Errorf("%d rows written after the buffer filled up", n)
+	}
+
+	s.SetWriteBuffer(100, 20*time.Millisecond)
+	s.Add(Telemetry{NodeID: "n2", DataType: "voltage", Value: 4, Timestamp: now})
+	if !waitFor(t, 5*time.Second, func() bool { return storedRows(t, s) == 4 }) {
+		t.Errorf("buffer not flushed after the interval: %d rows", storedRows(t, s))
+	}
+
+	s.SetWriteBuffer(100, time.Hour)
+	s.Add(Telemetry{NodeID: "n2", DataType: "voltage", Value: 5, Timestamp: now.Add(time.Second)})
+	if h := s.Health(); !h.Healthy || h.Pending != 1 || h.Written != 4 || h.Flushes != 2 || h.LastFlush == nil {
+		t.Errorf("health: %+v", h)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := s.Get("n2"); len(got) != 2 {
+		t.Errorf("points buffered at close: %v", got)
+	}
+}
+
+func TestSQLiteStoreWriteErrors(t *testing.T) {
+	s, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetWriteBuffer(100, time.Hour)
+	srv := NewServer(s)
+	status := func() int {
+		rr := httptest.NewRecorder()
+		srv.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/status/store", nil))
+		return rr.Code
+	}
+
+	if _, err := s.db.Exec("ALTER TABLE telemetry RENAME TO telemetry_old"); err != nil {
+		t.Fatal(err)
+	}
+	s.Add(Telemetry{NodeID: "n1", DataType: "voltage", Value: 1, Timestamp: time.Now()})
+	if err := s.Flush(); err == nil {
+		t.Fatal("flush succeeded without a telemetry table")
+	}
+	h := s.Health()
+	if h.Healthy || h.WriteErrors != 1 || h.Pending != 1 || h.LastError == "" || h.LastErrorAt == nil {
+		t.Errorf("health after failed flush: %+v", h)
+	}
+	if code := status(); code != http.StatusServiceUnavailable {
+		t.Errorf("status code %d while failing", code)
+	}
+
+	// the failed entries are retried once the database recovers
+	if _, err := s.db.Exec("ALTER TABLE telemetry_old RENAME TO telemetry"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if h := s.Health(); !h.Healthy || h.Pending != 0 || h.Written != 1 || h.WriteErrors != 1 {
+		t.Errorf("health after recovery: %+v", h)
+	}
+	if code := status(); code != http.StatusOK {
+		t.Errorf("status code %d after recovery", code)
+	}
+}
+
+func TestSQLiteStoreWriteHealthByKind(t *testing.T) {
+	s, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.db.Exec("ALTER TABLE packets RENAME TO packets_old"); err != nil {
+		t.Fatal(err)
+	}
+	s.AddPackets([]PacketMeta{{NodeID: "n1", Timestamp: time.Now()}})
+	// a successful write of another kind does not hide the failure
+	s.Add(Telemetry{NodeID: "n1", DataType: "voltage", Value: 1, Timestamp: time.Now()})
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if h := s.Health(); h.Healthy || len(h.Failing) != 1 || h.Failing[0] != "packets" {
+		t.Errorf("health after failed packet write: %+v", h)
+	}
+
+	// the next successful write of the same kind clears it
+	if _, err := s.db.Exec("ALTER TABLE packets_old RENAME TO packets"); err != nil {
+		t.Fatal(err)
+	}
+	s.AddPackets([]PacketMeta{{NodeID: "n1", Timestamp: time.Now()}})
+	if h := s.Health(); !h.Healthy || len(h.Failing) != 0 || h.WriteErrors != 1 {
+		t.Errorf("health after recovery: %+v", h)
+	}
+}
@@ -1,14 +1,8 @@
 package meshdump
 
 import (
-	"database/sql"
-	"log"
 	"os"
-	"sort"
-	"sync"
 	"time"
-
-	_ "modernc.org/sqlite"
 )
 
 type Telemetry struct {
@@ -18,219 +12,210 @@ type Telemetry struct {
 	Timestamp time.Time
 }
 
-// NodeInfo describes a node by ID with optional names.
+// NodeInfo describes a node by ID with optional names. LastHeard is the Unix
+// time the node was last heard according to an imported node database.
 type NodeInfo struct {
 	ID        string `json:"id"`
 	LongName  string `json:"long_name"`
 	ShortName string `json:"short_name"`
 	Firmware  string `json:"firmware"`
+	Hardware  string `json:"hardware,omitempty"`
+	Role      string `json:"role,omitempty"`
+	LastHeard int64  `json:"last_heard,omitempty"`
 	HasData   bool   `json:"has_data,omitempty"`
 }
 
-// Store keeps telemetry and node information in memory. When a database path is
-// provided, data is persisted using the built-in SQLite driver.
-type Store struct {
-	mu    sync.Mutex
-	data  map[string][]Telemetry
-	nodes map[string]NodeInfo
-	order []string
-	file  string
-	debug bool
-	db    *sql.DB
-}
-
-// NewStore initializes the store. When path is non-empty a SQLite database is
-// created (if necessary) and used for persistence.
-func NewStore(path string) *Store {
+// Sources of node metadata recorded in the node history.
+const (
+	SourceNodeInfo  = "nodeinfo"
+	SourceMapReport = "map_report"
+	SourceRadio     = "radio"
+	SourceNodeDB    = "nodedb"
+	SourceAPI       = "api"
+	// SourceMigration marks the metadata nodes had when history was
+	// introduced.
+	SourceMigration = "migration"
+)
 
-	s := &Store{
-		data:  make(map[string][]Telemetry),
-		nodes: make(map[string]NodeInfo),
-		order: []string{},
-		file:  path,
-		debug: os.Getenv("DEBUG") != "" && os.Getenv("DEBUG") != "0",
-	}
-	if path != "" {
-		db, err := sql.Open("sqlite", path)
-		if err == nil {
-			s.db = db
-			_ = s.initDB()
-			_ = s.load()
-		} else {
-			log.Printf("store: %v", err)
+// merge returns n updated with the fields update carries. Empty fields of
+// update keep the value of n and LastHeard keeps the later of both.
+func (n NodeInfo) merge(update NodeInfo) NodeInfo {
+	n.ID = update.ID
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&n.LongName, update.LongName},
+		{&n.ShortName, update.ShortName},
+		{&n.Firmware, update.Firmware},
+		{&n.Hardware, update.Hardware},
+		{&n.Role, update.Role},
+	} {
+		if f.src != "" {
+			*f.dst = f.src
 		}
 	}
-	if s.debug {
-		log.Printf("store debug enabled")
-	}
-	return s
+	n.LastHeard = max(n.LastHeard, update.LastHeard)
+	return n
 }
 
-// Add stores a telemetry entry in memory and on disk.
-func (s *Store) Add(t Telemetry) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	log.Printf("store: add node=%s type=%s value=%f", t.NodeID, t.DataType, t.Value)
-	s.data[t.NodeID] = append(s.data[t.NodeID], t)
-	if _, ok := s.nodes[t.NodeID]; !ok {
-		s.nodes[t.NodeID] = NodeInfo{ID: t.NodeID}
-		s.order = append(s.order, t.NodeID)
-		if s.db != nil {
-			_, _ = s.db.Exec("INSERT OR IGNORE INTO nodes (node_id, long_name, short_name, firmware) VALUES (?, '', '', '')", t.NodeID)
-		}
-		if s.debug {
-			log.Printf("debug: discovered node %s", t.NodeID)
+// NodeChange is a version of the metadata of a node. Versions count from 1
+// for every node; Changed lists the JSON names of the fields that differ from
+// the previous version.
+type NodeChange struct {
+	Version   int       `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"`
+	LongName  string    `json:"long_name"`
+	ShortName string    `json:"short_name"`
+	Firmware  string    `json:"firmware"`
+	Hardware  string    `json:"hardware,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Changed   []string  `json:"changed,omitempty"`
+}
+
+// nodeChange returns the change from prev to info and whether any metadata
+// differs. The last heard time is not metadata.
+func nodeChange(prev, info NodeInfo, source string, version int) (NodeChange, bool) {
+	c := NodeChange{Version: version, Timestamp: time.Now(), Source: source, LongName: info.LongName,
+		ShortName: info.ShortName, Firmware: info.Firmware, Hardware: info.Hardware, Role: info.Role}
+	for _, f := range []struct {
+		name    string
+		was, is string
+	}{
+		{"long_name", prev.LongName, info.LongName},
+		{"short_name", prev.ShortName, info.ShortName},
+		{"firmware", prev.Firmware, info.Firmware},
+		{"hardware", prev.Hardware, info.Hardware},
+		{"role", prev.Role, info.Role},
+	} {
+		if f.was != f.is {
+			c.Changed = append(c.Changed, f.name)
 		}
 	}
-	if s.db != nil {
-		ts := t.Timestamp.Format(time.RFC3339Nano)
-		_, _ = s.db.Exec("INSERT INTO telemetry (node_id, data_type, value, timestamp) VALUES (?, ?, ?, ?)", t.NodeID, t.DataType, t.Value, ts)
-	}
+	return c, len(c.Changed) > 0
 }
 
-// Get returns telemetry for the given node ID.
-func (s *Store) Get(nodeID string) []Telemetry {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return append([]Telemetry(nil), s.data[nodeID]...)
+// TextMessage is a text message exchanged on the mesh.
+type TextMessage struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Channel   string    `json:"channel,omitempty"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
-// All returns a copy of the telemetry map.
-func (s *Store) All() map[string][]Telemetry {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	out := make(map[string][]Telemetry, len(s.data))
-	for k, v := range s.data {
-		out[k] = append([]Telemetry(nil), v...)
-	}
-	return out
-}
+// Delivery states of a SentMessage.
+const (
+	SendPending = "sent"
+	SendAcked   = "acked"
+	SendFailed  = "failed"
+)
 
-// Nodes returns the list of known nodes with associated metadata.
-func (s *Store) Nodes() []NodeInfo {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	out := make([]NodeInfo, 0, len(s.order))
-	for _, id := range s.order {
-		n := s.nodes[id]
-		n.HasData = len(s.data[id]) > 0
-		out = append(out, n)
-	}
-	return out
+// SentMessage is a text message sent to the mesh by MeshDump together with
+// its delivery state.
+type SentMessage struct {
+	ID        uint32    `json:"id"`
+	To        string    `json:"to"`
+	Channel   string    `json:"channel"`
+	Text      string    `json:"text"`
+	WantAck   bool      `json:"want_ack"`
+	Timestamp time.Time `json:"timestamp"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
 }
 
-// SetNodeInfo stores metadata about a node.
-func (s *Store) SetNodeInfo(info NodeInfo) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if _, ok := s.nodes[info.ID]; !ok {
-		s.order = append(s.order, info.ID)
-	}
-	s.nodes[info.ID] = info
-	if s.db != nil {
-		_, _ = s.db.Exec("INSERT OR REPLACE INTO nodes (node_id, long_name, short_name, firmware) VALUES (?, ?, ?, ?)", info.ID, info.LongName, info.ShortName, info.Firmware)
-	}
-	if s.debug {
-		log.Printf("debug: node info updated %+v", info)
-
-	}
+// TelemetryStore keeps telemetry points and the rollups of the retention
+// tiers.
+type TelemetryStore interface {
+	// Add stores a telemetry entry.
+	Add(t Telemetry)
+	// AddBatch stores several telemetry entries at once. Nodes seen for the
+	// first time are added to the node list.
+	AddBatch(entries []Telemetry)
+	// Get returns the raw telemetry kept for a node.
+	Get(nodeID string) []Telemetry
+	// DataTypes returns the sorted data types of the telemetry and rollups
+	// kept for a node.
+	DataTypes(nodeID string) []string
+	// Query returns the telemetry of a node selected by q, including rollups.
+	Query(nodeID string, q TelemetryQuery) []Telemetry
+	// Rollups returns the aggregated telemetry of a node, oldest first.
+	Rollups(nodeID string) []Rollup
+	// Compact applies the retention tiers at time now.
+	Compact(tiers []RetentionTier, now time.Time) CompactStats
 }
 
-// Node retrieves metadata for the given node ID. If not present, the returned
-// boolean is false.
-func (s *Store) Node(id string) (NodeInfo, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	n, ok := s.nodes[id]
-	if ok {
-		n.HasData = len(s.data[id]) > 0
-	}
-	return n, ok
+// NodeStore keeps node metadata.
+type NodeStore interface {
+	// Nodes returns every known node in the order they were discovered.
+	Nodes() []NodeInfo
+	// Node returns the metadata of a node and whether it is known.
+	Node(id string) (NodeInfo, bool)
+	// SetNodeInfo updates the metadata of a node. Metadata received from the
+	// mesh is merged into what is known: empty fields keep their value and
+	// LastHeard never moves back. An edit from SourceAPI replaces the
+	// metadata. A change of its names, firmware, hardware or role is added
+	// to the node history with source, one of the Source constants.
+	SetNodeInfo(info NodeInfo, source string)
+	// NodeHistory returns the versions of the metadata of a node, oldest
+	// first.
+	NodeHistory(id string) []NodeChange
+	// Activity returns when a node was heard and how many packets of each
+	// port it sent, as recorded by AddPackets, and whether any were seen.
+	Activity(id string) (NodeActivity, bool)
+	// Annotation returns what operators recorded about a node and whether
+	// anything was.
+	Annotation(id string) (NodeAnnotation, bool)
+	// SetAnnotation replaces the annotation of a node and stamps it with the
+	// current time. An empty annotation removes it.
+	SetAnnotation(id string, a NodeAnnotation)
 }
 
-// initDB creates the required tables if they do not exist.
-func (s *Store) initDB() error {
-	schema := `CREATE TABLE IF NOT EXISTS nodes (
-    node_id TEXT PRIMARY KEY,
-    long_name TEXT,
-    short_name TEXT,
-    firmware TEXT
-);
-CREATE TABLE IF NOT EXISTS telemetry (
-    node_id TEXT NOT NULL,
-    data_type TEXT,
-    value REAL,
-    timestamp TEXT,
-    FOREIGN KEY(node_id) REFERENCES nodes(node_id)
-);
-CREATE INDEX IF NOT EXISTS idx_telemetry_node_id ON telemetry(node_id);`
-	if s.db == nil {
-		return nil
-	}
-	_, err := s.db.Exec(schema)
-	return err
+// MessageStore keeps the messages sent to the mesh and the metadata of
+// received packets.
+type MessageStore interface {
+	AddSentMessage(m SentMessage)
+	SentMessages() []SentMessage
+	// AckSentMessage updates the delivery state of a sent message and
+	// reports whether it exists.
+	AckSentMessage(id uint32, errReason string) bool
+	// AddPackets records received packets and the activity of their nodes.
+	AddPackets(ps []PacketMeta)
+	// Packets returns recent packets, newest first, selected by match.
+	Packets(match func(PacketMeta) bool, limit int) []PacketMeta
 }
 
-// load repopulates the in-memory store from the SQLite database.
-func (s *Store) load() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.db == nil {
-		return nil
-	}
-	// load nodes
-	rows, err := s.db.Query("SELECT node_id, long_name, short_name, firmware FROM nodes")
-	if err == nil {
-		defer func() {
-			if cerr := rows.Close(); cerr != nil {
-				log.Printf("store: rows close: %v", cerr)
-			}
-		}()
-		var ids []string
-		for rows.Next() {
-			var id, long, short, fw string
-			if err := rows.Scan(&id, &long, &short, &fw); err == nil {
-				s.nodes[id] = NodeInfo{ID: id, LongName: long, ShortName: short, Firmware: fw}
-				ids = append(ids, id)
-			}
-		}
-		sort.Strings(ids)
-		s.order = append([]string(nil), ids...)
-	}
+// Store is the storage used by MeshDump. MemoryStore and SQLiteStore
+// implement it; other backends can be plugged in by implementing it and
+// passing the storetest conformance suite.
+type Store interface {
+	TelemetryStore
+	NodeStore
+	MessageStore
+	Close() error
+}
 
-	if s.debug && len(s.nodes) > 0 {
-		log.Printf("debug: loaded nodes %+v", s.nodes)
+// NewStore returns the default store: a SQLiteStore at path, or a MemoryStore
+// when path is empty. It fails when the database cannot be opened rather than
+// falling back to memory, which would silently discard everything received.
+func NewStore(path string) (Store, error) {
+	if path == "" {
+		return NewMemoryStore(), nil
 	}
-
-	// load telemetry
-	trows, err := s.db.Query("SELECT node_id, data_type, value, timestamp FROM telemetry")
-	if err == nil {
-		defer func() {
-			if cerr := trows.Close(); cerr != nil {
-				log.Printf("store: trows close: %v", cerr)
-			}
-		}()
-		for trows.Next() {
-			var nodeID, dtype, tsStr string
-			var val float64
-			if err := trows.Scan(&nodeID, &dtype, &val, &tsStr); err == nil {
-				ts, _ := time.Parse(time.RFC3339Nano, tsStr)
-				s.data[nodeID] = append(s.data[nodeID], Telemetry{
-					NodeID:    nodeID,
-					DataType:  dtype,
-					Value:     val,
-					Timestamp: ts,
-				})
-			}
-		}
+	s, err := OpenSQLiteStore(path)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return s, nil
 }
 
-// Close closes the underlying database if open.
-func (s *Store) Close() error {
-	if s.db != nil {
-		return s.db.Close()
-	}
-	return nil
+// debugEnabled reports whether DEBUG asks for additional logging.
+func debugEnabled() bool {
+	return os.Getenv("DEBUG") != "" && os.Getenv("DEBUG") != "0"
 }
+
+var (
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*SQLiteStore)(nil)
+)
@@ -13,7 +13,7 @@ var exampleTelemetry = Telemetry{
 }
 
 func TestStoreAddGet(t *testing.T) {
-	s := NewStore("")
+	s := NewMemoryStore()
 	s.Add(exampleTelemetry)
 
 	got := s.Get(exampleTelemetry.NodeID)
@@ -33,9 +33,9 @@ func TestStoreAddGet(t *testing.T) {
 }
 
 func TestStoreSetNodeInfo(t *testing.T) {
-	s := NewStore("")
+	s := NewMemoryStore()
 	info := NodeInfo{ID: "node2", LongName: "Node Two", ShortName: "n2", Firmware: "1.0"}
-	s.SetNodeInfo(info)
+	s.SetNodeInfo(info, SourceAPI)
 
 	got, ok := s.Node("node2")
 	if !ok {
@@ -0,0 +1,509 @@
+// Package storetest is a conformance suite for meshdump.Store
+// implementations. A backend passes when Run, and RunPersistent for backends
+// that keep their data across restarts, succeed against it.
+package storetest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"meshdump/internal/meshdump"
+)
+
+// Run checks the behaviour every Store must provide. newStore returns an
+// empty store for each subtest; the suite closes it.
+func Run(t *testing.T, newStore func(t *testing.T) meshdump.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s meshdump.Store)
+	}{
+		{"Telemetry", testTelemetry},
+		{"Nodes", testNodes},
+		{"Query", testQuery},
+		{"Aggregate", testAggregate},
+		{"Compact", testCompact},
+		{"AggregateRollups", testAggregateRollups},
+		{"SentMessages", testSentMessages},
+		{"Packets", testPackets},
+		{"Activity", testActivity},
+		{"History", testHistory},
+		{"ConcurrentHistory", testConcurrentHistory},
+		{"MergeNodeInfo", testMergeNodeInfo},
+		{"Annotations", testAnnotations},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newStore(t)
+			defer s.Close()
+			tc.fn(t, s)
+		})
+	}
+}
+
+// RunPersistent checks that data survives closing a store. open must return a
+// store with the contents last written under the same name.
+func RunPersistent(t *testing.T, open func(t *testing.T, name string) meshdump.Store) {
+	s := open(t, "persist")
+	s.AddBatch([]meshdump.Telemetry{
+		{NodeID: "n1", DataType: "voltage", Value: 4.1, Timestamp: base},
+		{NodeID: "n1", DataType: "voltage", Value: 4.0, Timestamp: base.Add(time.Minute)},
+	})
+	s.SetNodeInfo(meshdump.NodeInfo{ID: "n2", LongName: "Two", Hardware: "TBEAM", LastHeard: 1700000000}, meshdump.SourceNodeInfo)
+	s.SetNodeInfo(meshdump.NodeInfo{ID: "n2", LongName: "Two", Hardware: "TBEAM", Role: "ROUTER", LastHeard: 1700000000}, meshdump.SourceAPI)
+	s.AddSentMessage(meshdump.SentMessage{ID: 7, To: "n1", Text: "hi", Status: meshdump.SendPending, Timestamp: base.Add(3 * time.Hour)})
+	s.AckSentMessage(7, "")
+	s.AddSentMessage(meshdump.SentMessage{ID: 6, To: "n1", Text: "old", Status: meshdump.SendPending, Timestamp: base})
+	s.AddPackets([]meshdump.PacketMeta{
+		{NodeID: "n1", Port: "TELEMETRY_APP", Timestamp: base},
+		{NodeID: "n1", Port: "POSITION_APP", Timestamp: base.Add(3 * time.Hour)},
+	})
+	s.SetAnnotation("n2", meshdump.NodeAnnotation{DisplayName: "Hilltop", Tags: []string{"solar", "backbone"}, Group: "north"})
+	renameConcurrently(s, "n3", 20)
+	tiers, _ := meshdump.ParseRetention("raw:1h,1h:forever")
+	s.Compact(tiers, base.Add(3*time.Hour+time.Minute))
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	s = open(t, "persist")
+	defer s.Close()
+	if len(s.Get("n1")) != 0 || len(s.Rollups("n1")) != 1 {
+		t.Errorf("telemetry after reopen: %v %v", s.Get("n1"), s.Rollups("n1"))
+	}
+	if n, ok := s.Node("n2"); !ok || n.LongName != "Two" || n.Hardware != "TBEAM" || n.Role != "ROUTER" || n.LastHeard != 1700000000 {
+		t.Errorf("node after reopen: %+v", n)
+	}
+	if a, ok := s.Annotation("n2"); !ok || a.DisplayName != "Hilltop" || a.Group != "north" ||
+		len(a.Tags) != 2 || a.Tags[0] != "backbone" || a.Tags[1] != "solar" || a.UpdatedAt.IsZero() {
+		t.Errorf("annotation after reopen: %+v", a)
+	}
+	s.SetNodeInfo(meshdump.NodeInfo{ID: "n2", LongName: "Zwei", Hardware: "TBEAM", Role: "ROUTER"}, meshdump.SourceMapReport)
+	if h := s.NodeHistory("n2"); len(h) != 3 || h[1].Source != meshdump.SourceAPI || h[1].Role != "ROUTER" || h[2].Version != 3 {
+		t.Errorf("history after reopen: %+v", h)
+	}
+	if _, ok := s.Node("n1"); !ok {
+		t.Error("discovered node lost")
+	}
+	// the stored row is the latest version even after concurrent updates
+	if h := s.NodeHistory("n3"); len(h) != 20 {
+		t.Errorf("%d versions of n3 after reopen", len(h))
+	} else if n, _ := s.Node("n3"); n.LongName != h[19].LongName {
+		t.Errorf("n3 stored %q, latest version %q", n.LongName, h[19].LongName)
+	}
+	if msgs := s.SentMessages(); len(msgs) != 2 || msgs[0].ID != 6 || msgs[1].Status != meshdump.SendAcked {
+		t.Errorf("sent messages after reopen: %+v", msgs)
+	}
+	if ps := s.Packets(nil, 0); len(ps) != 1 || ps[0].NodeID != "n1" || ps[0].Port != "POSITION_APP" {
+		t.Errorf("packets after reopen: %+v", ps)
+	}
+	if a, ok := s.Activity("n1"); !ok || a.FirstSeen != base.Unix() || a.LastPositionTime != base.Add(3*time.Hour).Unix() ||
+		a.Packets["POSITION_APP"] != 1 || a.Packets["TELEMETRY_APP"] != 1 {
+		t.Errorf("activity after reopen: %+v", a)
+	}
+}
+
+var base = time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+
+func testTelemetry(t *testing.T, s meshdump.Store) {
+	tel := meshdump.Telemetry{NodeID: "n1", DataType: "temperature", Value: 21.5, Timestamp: base}
+	s.Add(tel)
+	s.AddBatch([]meshdump.Telemetry{
+		{NodeID: "n1", DataType: "voltage", Value: 4.1, Timestamp: base.Add(time.Second)},
+		{NodeID: "n2", DataType: "voltage", Value: 3.9, Timestamp: base},
+	})
+	s.AddBatch(nil)
+
+	got := s.Get("n1")
+	if len(got) != 2 || got[0].DataType != tel.DataType || got[0].Value != tel.Value || !got[0].Timestamp.Equal(tel.Timestamp) {
+		t.Errorf("Get: %v", got)
+	}
+	got[0].Value = 0
+	if s.Get("n1")[0].Value != tel.Value {
+		t.Error("Get must return a copy")
+	}
+	if len(s.Get("n2")) != 1 || len(s.Get("unknown")) != 0 {
+		t.Errorf("Get of other nodes: %v %v", s.Get("n2"), s.Get("unknown"))
+	}
+	if types := s.DataTypes("n1"); len(types) != 2 || types[0] != "temperature" || types[1] != "voltage" {
+		t.Errorf("DataTypes: %v", types)
+	}
+	if types := s.DataTypes("unknown"); len(types) != 0 {
+		t.Errorf("DataTypes of unknown node: %v", types)
+	}
+}
+
+func testNodes(t *testing.T, s meshdump.Store) {
+	s.Add(meshdump.Telemetry{NodeID: "n1", DataType: "voltage", Value: 4, Timestamp: base})
+	n, ok := s.Node("n1")
+	if !ok || n.ID != "n1" || !n.HasData {
+		t.Errorf("node discovered by telemetry: %+v %v", n, ok)
+	}
+
+	info := meshdump.NodeInfo{ID: "n2", LongName: "Node Two", ShortName: "N2", Firmware: "2.5", Hardware: "RAK4631", LastHeard: 1700000000}
+	s.SetNodeInfo(info, meshdump.SourceNodeInfo)
+	if got, ok := s.Node("n2"); !ok || got != info {
+		t.Errorf("Node: got %+v, want %+v", got, info)
+	}
+	info.LongName = "Renamed"
+	s.SetNodeInfo(info, meshdump.SourceNodeInfo)
+	nodes := s.Nodes()
+	if len(nodes) != 2 || nodes[0].ID != "n1" || nodes[1] != info {
+		t.Errorf("Nodes: %+v", nodes)
+	}
+	if _, ok := s.Node("missing"); ok {
+		t.Error("unknown node reported")
+	}
+}
+
+func testQuery(t *testing.T, s meshdump.Store) {
+	s.AddBatch([]meshdump.Telemetry{
+		{NodeID: "n1", DataType: "voltage", Value: 1, Timestamp: base.Add(2 * time.Minute)},
+		{NodeID: "n1", DataType: "voltage", Value: 0, Timestamp: base},
+		{NodeID: "n1", DataType: "temperature", Value: 20, Timestamp: base.Add(time.Minute)},
+		{NodeID: "n1", DataType: "voltage", Value: 3, Timestamp: base.Add(3 * time.Minute)},
+	})
+
+	values := func(ts []meshdump.Telemetry) []float64 {
+		out := []float64{}
+		for _, t := range ts {
+			out = append(out, t.Value)
+		}
+		return out
+	}
+	for _, tc := range []struct {
+		name string
+		q    meshdump.TelemetryQuery
+		want []float64
+	}{
+		{"all", meshdump.TelemetryQuery{}, []float64{0, 20, 1, 3}},
+		{"range", meshdump.TelemetryQuery{From: base.Add(time.Minute), To: base.Add(2 * time.Minute)}, []float64{20, 1}},
+		{"types", meshdump.TelemetryQuery{Types: []string{"voltage"}}, []float64{0, 1, 3}},
+		{"desc", meshdump.TelemetryQuery{Types: []string{"voltage"}, Desc: true, Limit: 2}, []float64{3, 1}},
+		{"limit", meshdump.TelemetryQuery{Limit: 1}, []float64{0}},
+	} {
+		got := s.Query("n1", tc.q)
+		if got == nil || !equal(values(got), tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, values(got), tc.want)
+		}
+	}
+	if got := s.Query("unknown", meshdump.TelemetryQuery{}); got == nil || len(got) != 0 {
+		t.Errorf("unknown node: %#v", got)
+	}
+}
+
+func testAggregate(t *testing.T, s meshdump.Store) {
+	s.AddBatch([]meshdump.Telemetry{
+		{NodeID: "n1", DataType: "voltage", Value: 4.0, Timestamp: base},
+		{NodeID: "n1", DataType: "voltage", Value: 3.0, Timestamp: base.Add(30 * time.Minute)},
+		{NodeID: "n1", DataType: "voltage", Value: 3.5, Timestamp: base.Add(90 * time.Minute)},
+	})
+	for agg, want := range map[string][]float64{
+		meshdump.AggAvg:   {3.5, 3.5},
+		meshdump.AggMin:   {3.0, 3.5},
+		meshdump.AggMax:   {4.0, 3.5},
+		meshdump.AggLast:  {3.0, 3.5},
+		meshdump.AggCount: {2, 1},
+	} {
+		got := s.Query("n1", meshdump.TelemetryQuery{Bucket: time.Hour, Agg: agg})
+		if len(got) != 2 || !got[0].Timestamp.Equal(base) || got[0].Value != want[0] || got[1].Value != want[1] {
+			t.Errorf("%s: %v", agg, got)
+		}
+	}
+}
+
+// testAggregateRollups checks that buckets spanning several rollups weight
+// each rollup by the number of points it summarises.
+func testAggregateRollups(t *testing.T, s meshdump.Store) {
+	s.AddBatch([]meshdump.Telemetry{
+		{NodeID: "n1", DataType: "voltage", Value: 1, Timestamp: base},
+		{NodeID: "n1", DataType: "voltage", Value: 1, Timestamp: base.Add(5 * time.Minute)},
+		{NodeID: "n1", DataType: "voltage", Value: 1, Timestamp: base.Add(10 * time.Minute)},
+		{NodeID: "n1", DataType: "voltage", Value: 5, Timestamp: base.Add(30 * time.Minute)},
+	})
+	tiers, err := meshdump.ParseRetention("raw:1h,15m:forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Compact(tiers, base.Add(2*time.Hour))
+	if rs := s.Rollups("n1"); len(rs) != 2 {
+		t.Fatalf("rollups: %+v", rs)
+	}
+	for agg, want := range map[string]float64{
+		meshdump.AggAvg:   2,
+		meshdump.AggMin:   1,
+		meshdump.AggMax:   5,
+		meshdump.AggCount: 4,
+	} {
+		got := s.Query("n1", meshdump.TelemetryQuery{Bucket: time.Hour, Agg: agg})
+		if len(got) != 1 || !got[0].Timestamp.Equal(base) || got[0].Value != want {
+			t.Errorf("%s: %v", agg, got)
+		}
+	}
+}
+
+func testCompact(t *testing.T, s meshdump.Store) {
+	s.AddBatch([]meshdump.Telemetry{
+		{NodeID: "n1", DataType: "voltage", Value: 4.0, Timestamp: base},
+		{NodeID: "n1", DataType: "voltage", Value: 3.0, Timestamp: base.Add(30 * time.Minute)},
+		{NodeID: "n1", DataType: "voltage", Value: 3.5, Timestamp: base.Add(3 * time.Hour)},
+	})
+	tiers, err := meshdump.ParseRetention("raw:1h,1h:forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := s.Compact(tiers, base.Add(3*time.Hour+time.Minute))
+	if st.RolledUp != 2 || st.Deleted != 2 {
+		t.Errorf("stats: %+v", st)
+	}
+	if got := s.Get("n1"); len(got) != 1 || got[0].Value != 3.5 {
+		t.Errorf("raw after compaction: %v", got)
+	}
+	rs := s.Rollups("n1")
+	if len(rs) != 1 || rs[0].Resolution != time.Hour || !rs[0].Timestamp.Equal(base) ||
+		rs[0].Count != 2 || rs[0].Min != 3 || rs[0].Max != 4 || rs[0].Avg != 3.5 {
+		t.Errorf("rollups: %+v", rs)
+	}
+	if got := s.Query("n1", meshdump.TelemetryQuery{}); len(got) != 2 || got[0].Value != 3.5 || !got[0].Timestamp.Equal(base) {
+		t.Errorf("query across tiers: %v", got)
+	}
+	if n, _ := s.Node("n1"); !n.HasData {
+		t.Error("node with rollups has no data")
+	}
+	if types := s.DataTypes("n1"); len(types) != 1 || types[0] != "voltage" {
+		t.Errorf("DataTypes across tiers: %v", types)
+	}
+
+	// packets are kept as long as raw points and the activity they were
+	// counted in remains; sent messages do not expire
+	s.AddPackets([]meshdump.PacketMeta{
+		{NodeID: "n1", Port: "TELEMETRY_APP", Timestamp: base},
+		{NodeID: "n1", Port: "TELEMETRY_APP", Timestamp: base.Add(3 * time.Hour)},
+	})
+	s.AddSentMessage(meshdump.SentMessage{ID: 1, To: "n1", Text: "old", Status: meshdump.SendPending, Timestamp: base})
+	s.AddSentMessage(meshdump.SentMessage{ID: 2, To: "n1", Text: "new", Status: meshdump.SendPending, Timestamp: base.Add(3 * time.Hour)})
+	if st := s.Compact(tiers, base.Add(3*time.Hour+time.Minute)); st.Pruned != 1 {
+		t.Errorf("pruned: %+v", st)
+	}
+	if ps := s.Packets(nil, 0); len(ps) != 1 || !ps[0].Timestamp.Equal(base.Add(3*time.Hour)) {
+		t.Errorf("packets after compaction: %+v", ps)
+	}
+	if msgs := s.SentMessages(); len(msgs) != 2 {
+		t.Errorf("sent messages after compaction: %+v", msgs)
+	}
+	if a, _ := s.Activity("n1"); a.Packets["TELEMETRY_APP"] != 2 {
+		t.Errorf("activity after compaction: %+v", a)
+	}
+
+	// without a following tier expired data is dropped
+	s.Add(meshdump.Telemetry{NodeID: "n3", DataType: "voltage", Value: 1, Timestamp: base})
+	drop, _ := meshdump.ParseRetention("raw:1h")
+	s.Compact(drop, base.Add(2*time.Hour))
+	if n, _ := s.Node("n3"); n.HasData || len(s.Get("n3")) != 0 {
+		t.Errorf("dropped data still reported: %+v %v", n, s.Get("n3"))
+	}
+}
+
+func testSentMessages(t *testing.T, s meshdump.Store) {
+	s.AddSentMessage(meshdump.SentMessage{ID: 1, To: "n1", Text: "one", Status: meshdump.SendPending, Timestamp: base})
+	s.AddSentMessage(meshdump.SentMessage{ID: 2, To: "n2", Text: "two", Status: meshdump.SendPending, Timestamp: base.Add(time.Second)})
+	if !s.AckSentMessage(1, "") || !s.AckSentMessage(2, "NO_ROUTE") {
+		t.Fatal("known messages not acknowledged")
+	}
+	if s.AckSentMessage(3, "") {
+		t.Error("unknown message acknowledged")
+	}
+	msgs := s.SentMessages()
+	if len(msgs) != 2 || msgs[0].Status != meshdump.SendAcked ||
+		msgs[1].Status != meshdump.SendFailed || msgs[1].Error != "NO_ROUTE" {
+		t.Errorf("sent messages: %+v", msgs)
+	}
+}
+
+func testPackets(t *testing.T, s meshdump.Store) {
+	s.AddPackets([]meshdump.PacketMeta{
+		{NodeID: "n1", TopicInfo: meshdump.TopicInfo{Channel: "LongFast"}, Timestamp: base},
+		{NodeID: "n2", TopicInfo: meshdump.TopicInfo{Channel: "Admin"}, Timestamp: base.Add(time.Second)},
+		{NodeID: "n1", TopicInfo: meshdump.TopicInfo{Channel: "LongFast"}, Timestamp: base.Add(2 * time.Second)},
+	})
+	if ps := s.Packets(nil, 0); len(ps) != 3 || !ps[0].Timestamp.Equal(base.Add(2*time.Second)) {
+		t.Errorf("newest first: %+v", ps)
+	}
+	ps := s.Packets(func(p meshdump.PacketMeta) bool { return p.NodeID == "n1" }, 1)
+	if len(ps) != 1 || !ps[0].Timestamp.Equal(base.Add(2*time.Second)) {
+		t.Errorf("filtered: %+v", ps)
+	}
+}
+
+func testActivity(t *testing.T, s meshdump.Store) {
+	if _, ok := s.Activity("n1"); ok {
+		t.Error("activity of a node never heard")
+	}
+	s.AddPackets([]meshdump.PacketMeta{
+		{NodeID: "n1", Port: "TELEMETRY_APP", Timestamp: base.Add(time.Minute)},
+		{NodeID: "n1", Port: "POSITION_APP", Timestamp: base},
+		{NodeID: "n1", Timestamp: base.Add(2 * time.Minute)},
+		{Port: "TEXT_MESSAGE_APP", Timestamp: base},
+	})
+	s.AddPackets([]meshdump.PacketMeta{{NodeID: "n1", Port: "TELEMETRY_APP", Timestamp: base.Add(3 * time.Minute)}})
+	a, ok := s.Activity("n1")
+	if !ok || a.FirstSeen != base.Unix() || a.LastSeen != base.Add(3*time.Minute).Unix() || a.LastPositionTime != base.Unix() {
+		t.Errorf("activity times: %+v", a)
+	}
+	if len(a.Packets) != 3 || a.Packets["TELEMETRY_APP"] != 2 || a.Packets["POSITION_APP"] != 1 || a.Packets["UNKNOWN_APP"] != 1 {
+		t.Errorf("packet counts: %v", a.Packets)
+	}
+	a.Packets["TELEMETRY_APP"] = 0
+	if a, _ := s.Activity("n1"); a.Packets["TELEMETRY_APP"] != 2 {
+		t.Error("Activity must return a copy")
+	}
+}
+
+func testHistory(t *testing.T, s meshdump.Store) {
+	// nodes discovered without metadata have no history
+	s.Add(meshdump.Telemetry{NodeID: "n1", DataType: "voltage", Value: 4, Timestamp: base})
+	if h := s.NodeHistory("n1"); len(h) != 0 {
+		t.Errorf("history of a discovered node: %+v", h)
+	}
+
+	start := time.Now().Add(-time.Second)
+	info := meshdump.NodeInfo{ID: "n1", LongName: "One", ShortName: "N1", Hardware: "TBEAM", Role: "CLIENT", LastHeard: 1700000000}
+	s.SetNodeInfo(info, meshdump.SourceNodeInfo)
+	info.LastHeard = 1700000100
+	s.SetNodeInfo(info, meshdump.SourceNodeInfo)
+	info.Firmware = "2.5"
+	s.SetNodeInfo(info, meshdump.SourceMapReport)
+	info.LongName, info.Role = "Uno", "ROUTER"
+	s.SetNodeInfo(info, meshdump.SourceAPI)
+
+	h := s.NodeHistory("n1")
+	if len(h) != 3 {
+		t.Fatalf("history: %+v", h)
+	}
+	for i, c := range h {
+		if c.Version != i+1 || c.Timestamp.Before(start) {
+			t.Errorf("version %d: %+v", i+1, c)
+		}
+	}
+	if h[0].Source != meshdump.SourceNodeInfo || h[0].LongName != "One" || len(h[0].Changed) != 4 {
+		t.Errorf("first version: %+v", h[0])
+	}
+	if h[1].Source != meshdump.SourceMapReport || h[1].Firmware != "2.5" || len(h[1].Changed) != 1 || h[1].Changed[0] != "firmware" {
+		t.Errorf("firmware change: %+v", h[1])
+	}
+	if h[2].Source != meshdump.SourceAPI || h[2].LongName != "Uno" || h[2].Role != "ROUTER" ||
+		len(h[2].Changed) != 2 || h[2].Changed[0] != "long_name" || h[2].Changed[1] != "role" {
+		t.Errorf("edit: %+v", h[2])
+	}
+	if h := s.NodeHistory("unknown"); len(h) != 0 {
+		t.Errorf("history of an unknown node: %+v", h)
+	}
+}
+
+// renameConcurrently gives node id n different names at once.
+func renameConcurrently(s meshdump.Store, id string, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.SetNodeInfo(meshdump.NodeInfo{ID: id, LongName: fmt.Sprintf("Node %d", i)}, meshdump.SourceAPI)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func testConcurrentHistory(t *testing.T, s meshdump.Store) {
+	const n = 20
+	renameConcurrently(s, "n1", n)
+
+	// every update is a version of its own, recorded in version order, and
+	// the latest version is the stored metadata
+	h := s.NodeHistory("n1")
+	if len(h) != n {
+		t.Fatalf("%d versions, want %d", len(h), n)
+	}
+	for i, c := range h {
+		if c.Version != i+1 {
+			t.Errorf("entry %d has version %d", i, c.Version)
+		}
+	}
+	if info, _ := s.Node("n1"); info.LongName != h[n-1].LongName {
+		t.Errorf("stored %q, latest version %q", info.LongName, h[n-1].LongName)
+	}
+}
+
+func testMergeNodeInfo(t *testing.T, s meshdump.Store) {
+	// node info packets carry the hardware but no firmware, map reports the
+	// firmware but no hardware
+	nodeInfo := meshdump.NodeInfo{ID: "n1", LongName: "One", ShortName: "N1", Hardware: "TBEAM", Role: "CLIENT", LastHeard: 1700000100}
+	mapReport := meshdump.NodeInfo{ID: "n1", LongName: "One", ShortName: "N1", Firmware: "2.5", Role: "CLIENT", LastHeard: 1700000000}
+	for range 3 {
+		s.SetNodeInfo(nodeInfo, meshdump.SourceNodeInfo)
+		s.SetNodeInfo(mapReport, meshdump.SourceMapReport)
+	}
+	want := meshdump.NodeInfo{ID: "n1", LongName: "One", ShortName: "N1", Firmware: "2.5", Hardware: "TBEAM", Role: "CLIENT", LastHeard: 1700000100}
+	if n, _ := s.Node("n1"); n != want {
+		t.Errorf("merged node: got %+v, want %+v", n, want)
+	}
+	h := s.NodeHistory("n1")
+	if len(h) != 2 || h[1].Source != meshdump.SourceMapReport || len(h[1].Changed) != 1 || h[1].Changed[0] != "firmware" {
+		t.Errorf("history: %+v", h)
+	}
+
+	// an edit replaces the metadata
+	s.SetNodeInfo(meshdump.NodeInfo{ID: "n1", LongName: "Uno"}, meshdump.SourceAPI)
+	if n, _ := s.Node("n1"); n != (meshdump.NodeInfo{ID: "n1", LongName: "Uno"}) {
+		t.Errorf("edited node: %+v", n)
+	}
+}
+
+func testAnnotations(t *testing.T, s meshdump.Store) {
+	if _, ok := s.Annotation("n1"); ok {
+		t.Error("annotation of a node never annotated")
+	}
+	s.SetNodeInfo(meshdump.NodeInfo{ID: "n1", LongName: "One"}, meshdump.SourceNodeInfo)
+	start := time.Now().Add(-time.Second)
+	s.SetAnnotation("n1", meshdump.NodeAnnotation{DisplayName: " Hilltop ", Tags: []string{"solar", " ", "backbone", "solar"},
+		Group: "north", Location: "Water tower", Owner: "ops@example.org", Notes: "Battery replaced in May"})
+	a, ok := s.Annotation("n1")
+	if !ok || a.DisplayName != "Hilltop" || a.Group != "north" || a.Location != "Water tower" ||
+		a.Owner != "ops@example.org" || a.Notes != "Battery replaced in May" || a.UpdatedAt.Before(start) {
+		t.Errorf("annotation: %+v", a)
+	}
+	if len(a.Tags) != 2 || a.Tags[0] != "backbone" || a.Tags[1] != "solar" {
+		t.Errorf("tags: %v", a.Tags)
+	}
+	a.Tags[0] = "changed"
+	if a, _ := s.Annotation("n1"); a.Tags[0] != "backbone" {
+		t.Error("Annotation must return a copy")
+	}
+
+	// metadata from the mesh leaves the annotation alone
+	s.SetNodeInfo(meshdump.NodeInfo{ID: "n1", LongName: "Renamed"}, meshdump.SourceNodeInfo)
+	if a, _ := s.Annotation("n1"); a.DisplayName != "Hilltop" {
+		t.Errorf("annotation after node info: %+v", a)
+	}
+
+	s.SetAnnotation("n1", meshdump.NodeAnnotation{Tags: []string{"spare"}})
+	if a, _ := s.Annotation("n1"); a.DisplayName != "" || len(a.Tags) != 1 || a.Tags[0] != "spare" {
+		t.Errorf("replaced annotation: %+v", a)
+	}
+	s.SetAnnotation("n1", meshdump.NodeAnnotation{Notes: "  "})
+	if a, ok := s.Annotation("n1"); ok {
+		t.Errorf("empty annotation kept: %+v", a)
+	}
+}
+
+func equal(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
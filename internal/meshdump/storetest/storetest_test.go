@@ -0,0 +1,29 @@
+package storetest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"meshdump/internal/meshdump"
+)
+
+func TestMemoryStore(t *testing.T) {
+	Run(t, func(t *testing.T) meshdump.Store { return meshdump.NewMemoryStore() })
+}
+
+func TestSQLiteStore(t *testing.T) {
+	open := func(t *testing.T, path string) meshdump.Store {
+		s, err := meshdump.OpenSQLiteStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	Run(t, func(t *testing.T) meshdump.Store {
+		return open(t, filepath.Join(t.TempDir(), "test.db"))
+	})
+	dir := t.TempDir()
+	RunPersistent(t, func(t *testing.T, name string) meshdump.Store {
+		return open(t, filepath.Join(dir, name+".db"))
+	})
+}
@@ -0,0 +1,452 @@
+package meshdump
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mpb "github.com/meshtastic/go/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// Framing of the Meshtastic stream protocol used over TCP and serial links:
+// two magic bytes followed by a big endian length and a protobuf payload.
+const (
+	streamStart1   = 0x94
+	streamStart2   = 0xc3
+	streamMaxFrame = 512
+	// DefaultRadioPort is the TCP port of the Meshtastic stream API.
+	DefaultRadioPort = "4403"
+)
+
+// writeFrame encodes msg and writes it as a single stream frame.
+func writeFrame(w io.Writer, msg proto.Message) error {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(b) > streamMaxFrame {
+		return fmt.Errorf("stream: frame of %d bytes too large", len(b))
+	}
+	frame := make([]byte, 0, 4+len(b))
+	frame = append(frame, streamStart1, streamStart2, byte(len(b)>>8), byte(len(b)))
+	frame = append(frame, b...)
+	_, err = w.Write(frame)
+	return err
+}
+
+// readFrame returns the payload of the next frame. Bytes outside of frames,
+// such as the debug console output of serial devices, are skipped.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != streamStart1 {
+			continue
+		}
+		b, err = r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != streamStart2 {
+			if b == streamStart1 {
+				_ = r.UnreadByte()
+			}
+			continue
+		}
+		var hdr [2]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		n := int(hdr[0])<<8 | int(hdr[1])
+		if n > streamMaxFrame {
+			// corrupted header, resynchronise on the next magic bytes
+			continue
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}
+}
+
+// RadioConfig configures a direct connection to a Meshtastic radio.
+type RadioConfig struct {
+	// Address is either a TCP address such as "192.168.1.20" or
+	// "tcp://radio.local:4403", or the path of a serial device such as
+	// "/dev/ttyUSB0" or "COM3".
+	Address string
+	// Baud is the serial line speed. Zero selects 115200.
+	Baud int
+	// HeartbeatInterval is how often a heartbeat is sent to keep the link
+	// open. Zero selects one minute.
+	HeartbeatInterval time.Duration
+	// ReconnectInterval is the delay before reconnecting after the link was
+	// lost. Zero selects five seconds.
+	ReconnectInterval time.Duration
+	// ProxyPublisher receives the MQTT messages a radio with client proxy
+	// enabled relays through the stream connection. When nil the messages
+	// are decoded directly; otherwise they are published unchanged and must
+	// reach the pipeline from there: MQTTClient receives them back through
+	// its subscription, and the embedded broker is passed as
+	// PublisherFunc(broker.Inject).
+	ProxyPublisher Publisher
+	// ProxySubscriber relays messages for the radio back to it, so that it
+	// acts as a full MQTT gateway: once the radio reported its
+	// configuration, the encrypted topics of its channels with downlink
+	// enabled are subscribed to. Nil disables the downlink.
+	ProxySubscriber Subscriber
+}
+
+// isSerialAddress reports whether addr names a serial device: a path, a
+// serial:// URL or a Windows port such as COM3.
+func isSerialAddress(addr string) bool {
+	return strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "serial://") || isCOMPort(addr)
+}
+
+// isCOMPort reports whether addr is COM followed by a port number, ignoring
+// case.
+func isCOMPort(addr string) bool {
+	if len(addr) <= 3 || !strings.EqualFold(addr[:3], "COM") {
+		return false
+	}
+	for _, c := range addr[3:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Radio ingests packets from a Meshtastic radio through the stream API.
+type Radio struct {
+	cfg      RadioConfig
+	pipeline *Pipeline
+
+	mu       sync.Mutex
+	conn     io.ReadWriteCloser
+	myNode   string
+	channels map[uint32]string
+	// downlink holds the names of the channels with downlink enabled by
+	// index, empty for a primary channel named after the modem preset
+	downlink map[uint32]string
+	preset   string
+	root     string
+	// subscribed holds the downlink topics subscribed to
+	subscribed map[string]bool
+}
+
+// StartRadio connects to the radio in the background and feeds everything it
+// reports into the pipeline until the context is cancelled. The connection is
+// re-established when it drops.
+func StartRadio(ctx context.Context, cfg RadioConfig, pipeline *Pipeline) (*Radio, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("radio: no address configured")
+	}
+	if cfg.Baud == 0 {
+		cfg.Baud = 115200
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = time.Minute
+	}
+	if cfg.ReconnectInterval <= 0 {
+		cfg.ReconnectInterval = 5 * time.Second
+	}
+	r := &Radio{cfg: cfg, pipeline: pipeline, channels: make(map[uint32]string),
+		downlink: make(map[uint32]string), subscribed: make(map[string]bool)}
+	go r.run(ctx)
+	return r, nil
+}
+
+// MyNodeID returns the node ID of the connected radio once it is known.
+func (r *Radio) MyNodeID() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.myNode
+}
+
+func (r *Radio) run(ctx context.Context) {
+	for {
+		if err := r.session(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("radio: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.cfg.ReconnectInterval):
+		}
+	}
+}
+
+// open establishes the link to the radio.
+func (r *Radio) open() (io.ReadWriteCloser, error) {
+	addr := r.cfg.Address
+	if isSerialAddress(addr) {
+		return openSerial(strings.TrimPrefix(addr, "serial://"), r.cfg.Baud)
+	}
+	addr = strings.TrimPrefix(addr, "tcp://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, DefaultRadioPort)
+	}
+	return net.DialTimeout("tcp", addr, 10*time.Second)
+}
+
+// session runs a single connection until it fails or ctx is cancelled.
+func (r *Radio) session(ctx context.Context) error {
+	conn, err := r.open()
+	if err != nil {
+		return err
+	}
+	log.Printf("radio: connected to %s", r.cfg.Address)
+	r.mu.Lock()
+	r.conn = conn
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	defer func() {
+		r.mu.Lock()
+		r.conn = nil
+		r.mu.Unlock()
+	}()
+
+	if err := r.send(&mpb.ToRadio{PayloadVariant: &mpb.ToRadio_WantConfigId{WantConfigId: newPacketID()}}); err != nil {
+		return err
+	}
+	go r.heartbeat(done)
+
+	br := bufio.NewReader(conn)
+	for {
+		b, err := readFrame(br)
+		if err != nil {
+			return fmt.Errorf("read: %v", err)
+		}
+		var fr mpb.FromRadio
+		if err := proto.Unmarshal(b, &fr); err != nil {
+			log.Printf("radio: decode: %v", err)
+			continue
+		}
+		r.handle(&fr)
+	}
+}
+
+func (r *Radio) heartbeat(done <-chan struct{}) {
+	t := time.NewTicker(r.cfg.HeartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if err := r.send(&mpb.ToRadio{PayloadVariant: &mpb.ToRadio_Heartbeat{Heartbeat: &mpb.Heartbeat{}}}); err != nil {
+				log.Printf("radio: heartbeat: %v", err)
+			}
+		}
+	}
+}
+
+// send writes a ToRadio message to the current connection.
+func (r *Radio) send(msg *mpb.ToRadio) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return fmt.Errorf("radio: not connected")
+	}
+	return writeFrame(r.conn, msg)
+}
+
+// handle processes a message received from the radio.
+func (r *Radio) handle(fr *mpb.FromRadio) {
+	store := r.pipeline.store
+	switch {
+	case fr.GetPacket() != nil:
+		pkt := fr.GetPacket()
+		r.mu.Lock()
+		channel := r.channels[pkt.GetChannel()]
+		r.mu.Unlock()
+		// packets that cannot be decoded still count towards the activity
+		// of their sender
+		dec, _ := r.pipeline.decoder.DecodePacket(pkt, channel)
+		dec.Packet = &PacketMeta{TopicInfo: TopicInfo{Channel: channel, Gateway: r.MyNodeID()},
+			NodeID: dec.From, Port: dec.Port, Timestamp: time.Now()}
+		r.pipeline.Handle(dec)
+	case fr.GetMyInfo() != nil:
+		id := fmt.Sprintf("%08x", fr.GetMyInfo().GetMyNodeNum())
+		r.mu.Lock()
+		r.myNode = id
+		r.mu.Unlock()
+		if _, ok := store.Node(id); !ok {
+			store.SetNodeInfo(NodeInfo{ID: id}, SourceRadio)
+		}
+		log.Printf("radio: local node %s", id)
+	case fr.GetNodeInfo() != nil:
+		r.pipeline.Handle(decodeRadioNodeInfo(fr.GetNodeInfo()))
+	case fr.GetMetadata() != nil:
+		id := r.MyNodeID()
+		if id == "" {
+			return
+		}
+		info, _ := store.Node(id)
+		info.ID = id
+		info.HasData = false
+		info.Firmware = fr.GetMetadata().GetFirmwareVersion()
+		store.SetNodeInfo(info, SourceRadio)
+	case fr.GetChannel() != nil:
+		ch := fr.GetChannel()
+		idx := uint32(ch.GetIndex())
+		r.mu.Lock()
+		if name := ch.GetSettings().GetName(); name != "" {
+			r.channels[idx] = name
+		}
+		if ch.GetRole() != mpb.Channel_DISABLED && ch.GetSettings().GetDownlinkEnabled() {
+			r.downlink[idx] = ch.GetSettings().GetName()
+		} else {
+			delete(r.downlink, idx)
+		}
+		r.mu.Unlock()
+	case fr.GetConfig().GetLora() != nil:
+		r.mu.Lock()
+		r.preset = presetChannelName(fr.GetConfig().GetLora())
+		r.mu.Unlock()
+	case fr.GetModuleConfig().GetMqtt() != nil:
+		r.mu.Lock()
+		r.root = fr.GetModuleConfig().GetMqtt().GetRoot()
+		r.mu.Unlock()
+	case fr.GetMqttClientProxyMessage() != nil:
+		r.handleProxyMessage(fr.GetMqttClientProxyMessage())
+	case fr.GetConfigCompleteId() != 0:
+		log.Printf("radio: configuration received")
+		r.subscribeDownlink()
+	}
+}
+
+// presetChannelName returns the name the firmware gives a primary channel
+// without a name: its modem preset such as LongFast, or Custom.
+func presetChannelName(lora *mpb.Config_LoRaConfig) string {
+	if !lora.GetUsePreset() {
+		return "Custom"
+	}
+	var b strings.Builder
+	for _, w := range strings.Split(lora.GetModemPreset().String(), "_") {
+		b.WriteString(w[:1] + strings.ToLower(w[1:]))
+	}
+	return b.String()
+}
+
+// subscribeDownlink subscribes to the encrypted topics of the channels with
+// downlink enabled that are not subscribed to yet. The subscriptions outlive
+// the connection, so reconnects only add channels enabled in between.
+func (r *Radio) subscribeDownlink() {
+	if r.cfg.ProxySubscriber == nil {
+		return
+	}
+	r.mu.Lock()
+	root, preset := r.root, r.preset
+	if root == "" {
+		root = "msh"
+	}
+	if preset == "" {
+		preset = "LongFast"
+	}
+	var filters []string
+	for _, name := range r.downlink {
+		if name == "" {
+			name = preset
+		}
+		filter := root + "/2/e/" + name + "/+"
+		if !r.subscribed[filter] {
+			r.subscribed[filter] = true
+			filters = append(filters, filter)
+		}
+	}
+	r.mu.Unlock()
+	for _, filter := range filters {
+		if err := r.cfg.ProxySubscriber.Subscribe(filter, r.handleDownlink); err != nil {
+			log.Printf("radio: downlink %s: %v", filter, err)
+			r.mu.Lock()
+			delete(r.subscribed, filter)
+			r.mu.Unlock()
+			continue
+		}
+		log.Printf("radio: relaying %s to the radio", filter)
+	}
+}
+
+// handleDownlink relays a message published on a downlink topic to the radio.
+func (r *Radio) handleDownlink(topic string, payload []byte) {
+	// the messages the radio published itself come back on its own topic
+	if id := r.MyNodeID(); id != "" && strings.HasSuffix(topic, "/!"+id) {
+		return
+	}
+	msg := &mpb.MqttClientProxyMessage{Topic: topic, PayloadVariant: &mpb.MqttClientProxyMessage_Data{Data: payload}}
+	if err := r.send(&mpb.ToRadio{PayloadVariant: &mpb.ToRadio_MqttClientProxyMessage{MqttClientProxyMessage: msg}}); err != nil {
+		log.Printf("radio: downlink %s: %v", topic, err)
+	}
+}
+
+// proxyPayload returns the payload of a client proxy message, which is either
+// binary data (protobuf topics) or text (JSON topics).
+func proxyPayload(m *mpb.MqttClientProxyMessage) []byte {
+	if d := m.GetData(); d != nil {
+		return d
+	}
+	return []byte(m.GetText())
+}
+
+// handleProxyMessage processes an MQTT message the radio would have published
+// itself if it had a direct broker connection.
+func (r *Radio) handleProxyMessage(m *mpb.MqttClientProxyMessage) {
+	topic := m.GetTopic()
+	payload := proxyPayload(m)
+	if r.cfg.ProxyPublisher != nil {
+		if err := r.cfg.ProxyPublisher.Publish(topic, payload, m.GetRetained()); err != nil {
+			log.Printf("radio: proxy publish %s: %v", topic, err)
+		}
+		return
+	}
+	r.pipeline.Submit(topic, payload)
+}
+
+// decodeRadioNodeInfo converts an entry of the radio's node database into
+// node metadata.
+func decodeRadioNodeInfo(ni *mpb.NodeInfo) *Decoded {
+	info := NodeInfo{ID: fmt.Sprintf("%08x", ni.GetNum()), LastHeard: int64(ni.GetLastHeard())}
+	if u := ni.GetUser(); u != nil {
+		info.LongName = u.GetLongName()
+		info.ShortName = u.GetShortName()
+		info.Hardware = hardwareName(u.GetHwModel())
+		info.Role = u.GetRole().String()
+	}
+	return &Decoded{NodeInfo: &info, Source: SourceRadio}
+}
+
+// openSerial opens a serial device and configures its line speed where the
+// platform supports it.
+func openSerial(path string, baud int) (io.ReadWriteCloser, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := configureSerial(f, baud); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("serial %s: %v", path, err)
+	}
+	return f, nil
+}
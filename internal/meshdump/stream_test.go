@@ -0,0 +1,285 @@
+package meshdump
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	mpb "github.com/meshtastic/go/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeRadio is an in-process Meshtastic device speaking the stream protocol.
+type fakeRadio struct {
+	ln       net.Listener
+	received chan *mpb.ToRadio
+}
+
+func newFakeRadio(t *testing.T, replies []*mpb.FromRadio) *fakeRadio {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	fr := &fakeRadio{ln: ln, received: make(chan *mpb.ToRadio, 16)}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			b, err := readFrame(br)
+			if err != nil {
+				return
+			}
+			var msg mpb.ToRadio
+			if err := proto.Unmarshal(b, &msg); err != nil {
+				return
+			}
+			fr.received <- &msg
+			if id := msg.GetWantConfigId(); id != 0 {
+				// serial devices interleave log output with frames
+				conn.Write([]byte("INFO | booting\r\n"))
+				for _, r := range replies {
+					if err := writeFrame(conn, r); err != nil {
+						return
+					}
+				}
+				writeFrame(conn, &mpb.FromRadio{PayloadVariant: &mpb.FromRadio_ConfigCompleteId{ConfigCompleteId: id}})
+			}
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return fr
+}
+
+func TestStreamFraming(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("garbage\x94")
+	msg := &mpb.ToRadio{PayloadVariant: &mpb.ToRadio_WantConfigId{WantConfigId: 42}}
+	if err := writeFrame(&buf, msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if buf.Bytes()[8] != streamStart1 || buf.Bytes()[9] != streamStart2 {
+		t.Fatalf("unexpected header %x", buf.Bytes()[8:12])
+	}
+	b, err := readFrame(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var got mpb.ToRadio
+	if err := proto.Unmarshal(b, &got); err != nil || got.GetWantConfigId() != 42 {
+		t.Fatalf("unexpected frame: %v err=%v", &got, err)
+	}
+}
+
+func TestRadioIngest(t *testing.T) {
+	batt := uint32(77)
+	tm, _ := proto.Marshal(&mpb.Telemetry{Time: 1700000000,
+		Variant: &mpb.Telemetry_DeviceMetrics{DeviceMetrics: &mpb.DeviceMetrics{BatteryLevel: &batt}}})
+	replies := []*mpb.FromRadio{
+		{PayloadVariant: &mpb.FromRadio_MyInfo{MyInfo: &mpb.MyNodeInfo{MyNodeNum: 0x0000abcd}}},
+		{PayloadVariant: &mpb.FromRadio_Metadata{Metadata: &mpb.DeviceMetadata{FirmwareVersion: "2.5.0"}}},
+		{PayloadVariant: &mpb.FromRadio_NodeInfo{NodeInfo: &mpb.NodeInfo{Num: 0x12345678,
+			User: &mpb.User{LongName: "Remote", ShortName: "RM"}}}},
+		{PayloadVariant: &mpb.FromRadio_Packet{Packet: &mpb.MeshPacket{From: 0x12345678,
+			PayloadVariant: &mpb.MeshPacket_Decoded{Decoded: &mpb.Data{Portnum: mpb.PortNum_TELEMETRY_APP, Payload: tm}}}}},
+	}
+	fr := newFakeRadio(t, replies)
+
+	st := NewMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	radio, err := StartRadio(ctx, RadioConfig{Address: fr.ln.Addr().String(), HeartbeatInterval: 50 * time.Millisecond}, NewPipeline(st))
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	select {
+	case msg := <-fr.received:
+		if msg.GetWantConfigId() == 0 {
+			t.Fatalf("expected want_config_id first, got %v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("radio did not request config")
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return len(st.Get("12345678")) == 1 }) {
+		t.Fatalf("packet not ingested")
+	}
+	if radio.MyNodeID() != "0000abcd" {
+		t.Errorf("unexpected local node %q", radio.MyNodeID())
+	}
+	if n, _ := st.Node("0000abcd"); n.Firmware != "2.5.0" {
+		t.Errorf("local node firmware not stored: %+v", n)
+	}
+	if n, _ := st.Node("12345678"); n.LongName != "Remote" {
+		t.Errorf("node info not stored: %+v", n)
+	}
+
+	select {
+	case msg := <-fr.received:
+		if msg.GetHeartbeat() == nil {
+			t.Errorf("expected heartbeat, got %v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no heartbeat sent")
+	}
+}
+
+func TestRadioClientProxy(t *testing.T) {
+	pos, _ := proto.Marshal(&mpb.Position{LatitudeI: proto.Int32(450000000), LongitudeI: proto.Int32(90000000), Time: 1700000000})
+	env, _ := proto.Marshal(&mpb.ServiceEnvelope{ChannelId: "LongFast", GatewayId: "!0000abcd",
+		Packet: &mpb.MeshPacket{From: 0x12345678,
+			PayloadVariant: &mpb.MeshPacket_Decoded{Decoded: &mpb.Data{Portnum: mpb.PortNum_POSITION_APP, Payload: pos}}}})
+	proxy := func(m *mpb.MqttClientProxyMessage) *mpb.FromRadio {
+		return &mpb.FromRadio{PayloadVariant: &mpb.FromRadio_MqttClientProxyMessage{MqttClientProxyMessage: m}}
+	}
+	replies := []*mpb.FromRadio{
+		proxy(&mpb.MqttClientProxyMessage{Topic: "msh/EU_868/2/e/LongFast/!0000abcd",
+			PayloadVariant: &mpb.MqttClientProxyMessage_Data{Data: env}}),
+		proxy(&mpb.MqttClientProxyMessage{Topic: "msh/EU_868/2/json/LongFast/!0000abcd",
+			PayloadVariant: &mpb.MqttClientProxyMessage_Text{Text: `{"NodeID":"0000abcd","DataType":"voltage","Value":4.2}`}}),
+	}
+
+	// without a proxy publisher the messages are decoded directly
+	st := NewMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fr := newFakeRadio(t, replies)
+	if _, err := StartRadio(ctx, RadioConfig{Address: fr.ln.Addr().String()}, NewPipeline(st)); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return len(st.Get("12345678")) == 2 && len(st.Get("0000abcd")) == 1 }) {
+		t.Fatalf("proxied messages not ingested: %v %v", st.Get("12345678"), st.Get("0000abcd"))
+	}
+
+	// with a proxy publisher they are forwarded unchanged
+	fp := &fakePublisher{}
+	fr = newFakeRadio(t, replies)
+	if _, err := StartRadio(ctx, RadioConfig{Address: fr.ln.Addr().String(), ProxyPublisher: fp}, NewPipeline(NewMemoryStore())); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return len(fp.messages()) == 2 }) {
+		t.Fatalf("proxied messages not forwarded: %+v", fp.messages())
+	}
+	msgs := fp.messages()
+	if msgs[0].topic != "msh/EU_868/2/e/LongFast/!0000abcd" || !bytes.Equal(msgs[0].payload, env) {
+		t.Errorf("unexpected forwarded message: %+v", msgs[0])
+	}
+
+	// forwarded to the embedded broker they reach its subscribers and are
+	// ingested like messages of its clients
+	st = NewMemoryStore()
+	pipeline := NewPipeline(st)
+	cfg := testBrokerConfig(freeAddr(t))
+	broker, err := StartMQTTServer(ctx, cfg, pipeline)
+	if err != nil {
+		t.Fatalf("start broker: %v", err)
+	}
+	sub := subscribe(t, cfg.Address, "msh/#")
+	fr = newFakeRadio(t, replies)
+	if _, err := StartRadio(ctx, RadioConfig{Address: fr.ln.Addr().String(), ProxyPublisher: PublisherFunc(broker.Inject)}, pipeline); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return len(st.Get("12345678")) == 2 && len(st.Get("0000abcd")) == 1 }) {
+		t.Fatalf("messages forwarded to the embedded broker not ingested: %v %v", st.Get("12345678"), st.Get("0000abcd"))
+	}
+	select {
+	case <-sub:
+	case <-time.After(5 * time.Second):
+		t.Error("forwarded message not delivered to subscribers")
+	}
+}
+
+func TestRadioClientProxyDownlink(t *testing.T) {
+	replies := []*mpb.FromRadio{
+		{PayloadVariant: &mpb.FromRadio_MyInfo{MyInfo: &mpb.MyNodeInfo{MyNodeNum: 0x0000abcd}}},
+		{PayloadVariant: &mpb.FromRadio_Config{Config: &mpb.Config{PayloadVariant: &mpb.Config_Lora{
+			Lora: &mpb.Config_LoRaConfig{UsePreset: true, ModemPreset: mpb.Config_LoRaConfig_MEDIUM_FAST}}}}},
+		{PayloadVariant: &mpb.FromRadio_ModuleConfig{ModuleConfig: &mpb.ModuleConfig{PayloadVariant: &mpb.ModuleConfig_Mqtt{
+			Mqtt: &mpb.ModuleConfig_MQTTConfig{Root: "msh/EU_868", ProxyToClientEnabled: true}}}}},
+		// the unnamed primary channel is named after the preset
+		{PayloadVariant: &mpb.FromRadio_Channel{Channel: &mpb.Channel{Index: 0, Role: mpb.Channel_PRIMARY,
+			Settings: &mpb.ChannelSettings{DownlinkEnabled: true}}}},
+		{PayloadVariant: &mpb.FromRadio_Channel{Channel: &mpb.Channel{Index: 1, Role: mpb.Channel_SECONDARY,
+			Settings: &mpb.ChannelSettings{Name: "Private"}}}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := testBrokerConfig(freeAddr(t))
+	broker, err := StartMQTTServer(ctx, cfg, nil)
+	if err != nil {
+		t.Fatalf("start broker: %v", err)
+	}
+	fr := newFakeRadio(t, replies)
+	if _, err := StartRadio(ctx, RadioConfig{Address: fr.ln.Addr().String(), ProxyPublisher: PublisherFunc(broker.Inject), ProxySubscriber: broker},
+		NewPipeline(NewMemoryStore())); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool {
+		broker.mu.RLock()
+		defer broker.mu.RUnlock()
+		return len(broker.subs) == 1
+	}) {
+		t.Fatal("downlink not subscribed")
+	}
+
+	// channels without downlink and the radio's own messages are not relayed
+	publish(t, cfg.Address, "msh/EU_868/2/e/Private/!11112222", []byte("private"))
+	publish(t, cfg.Address, "msh/EU_868/2/e/MediumFast/!0000abcd", []byte("own"))
+	publish(t, cfg.Address, "msh/EU_868/2/e/MediumFast/!11112222", []byte("down"))
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-fr.received:
+			m := msg.GetMqttClientProxyMessage()
+			if m == nil {
+				continue
+			}
+			if m.GetTopic() != "msh/EU_868/2/e/MediumFast/!11112222" || string(m.GetData()) != "down" {
+				t.Fatalf("unexpected downlink message: %v", m)
+			}
+			return
+		case <-deadline:
+			t.Fatal("downlink message not relayed to the radio")
+		}
+	}
+}
+
+func TestPresetChannelName(t *testing.T) {
+	for _, tc := range []struct {
+		lora *mpb.Config_LoRaConfig
+		want string
+	}{
+		{&mpb.Config_LoRaConfig{UsePreset: true}, "LongFast"},
+		{&mpb.Config_LoRaConfig{UsePreset: true, ModemPreset: mpb.Config_LoRaConfig_VERY_LONG_SLOW}, "VeryLongSlow"},
+		{&mpb.Config_LoRaConfig{}, "Custom"},
+	} {
+		if got := presetChannelName(tc.lora); got != tc.want {
+			t.Errorf("%v: got %s, want %s", tc.lora, got, tc.want)
+		}
+	}
+}
+
+func TestIsSerialAddress(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"/dev/ttyUSB0":          true,
+		"serial:///dev/ttyACM0": true,
+		"COM3":                  true,
+		"com12":                 true,
+		"192.168.1.5:4403":      false,
+		"community-node:4403":   false,
+		"compute.local":         false,
+		"COM":                   false,
+		"COM3:4403":             false,
+	} {
+		if got := isSerialAddress(addr); got != want {
+			t.Errorf("%s: got %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package meshdump
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TopicInfo is the information carried by the topic a message was received
+// on. Gateway and Node are node IDs without the leading "!".
+type TopicInfo struct {
+	Root    string `json:"root,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Format  string `json:"format,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Gateway string `json:"gateway,omitempty"`
+	Node    string `json:"node,omitempty"`
+}
+
+// NodeID returns the node a message is attributed to by its topic: the node
+// of a user pattern or the gateway of a map report, which publishes its own
+// reports. Other Meshtastic topics name the uplinking gateway, not the sender.
+func (ti TopicInfo) NodeID() (string, bool) {
+	if ti.Node != "" {
+		return ti.Node, true
+	}
+	if ti.Format == "map" && ti.Gateway != "" {
+		return ti.Gateway, true
+	}
+	return "", false
+}
+
+// PacketMeta records where a decoded message came from. Port is the
+// Meshtastic port of the packet, empty when the format has none.
+type PacketMeta struct {
+	TopicInfo
+	Topic     string    `json:"topic,omitempty"`
+	NodeID    string    `json:"node_id"`
+	Port      string    `json:"port,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Placeholders of a topic pattern.
+var topicPlaceholders = map[string]bool{
+	"{root}": true, "{region}": true, "{channel}": true, "{gateway}": true, "{node}": true,
+}
+
+// TopicParser extracts TopicInfo from topics. User patterns are tried first,
+// followed by the Meshtastic layout "<root>/2/<format>/<channel>/<gateway>".
+type TopicParser struct {
+	patterns [][]string
+}
+
+// defaultTopicParser only knows the Meshtastic layout.
+var defaultTopicParser = &TopicParser{}
+
+// NewTopicParser compiles user patterns such as
+// "sensors/{region}/{channel}/{gateway}" or "lab/{node}/#". Levels are
+// matched literally, by the MQTT wildcards "+" and "#", or by one of the
+// placeholders {root}, {region}, {channel}, {gateway} and {node}.
+func NewTopicParser(patterns []string) (*TopicParser, error) {
+	p := &TopicParser{}
+	for _, pat := range patterns {
+		pat = strings.TrimSpace(pat)
+		if pat == "" {
+			continue
+		}
+		segs := strings.Split(pat, "/")
+		for i, seg := range segs {
+			if seg == "#" && i != len(segs)-1 {
+				return nil, fmt.Errorf("topic pattern %q: # must be the last level", pat)
+			}
+			if strings.HasPrefix(seg, "{") && !topicPlaceholders[seg] {
+				return nil, fmt.Errorf("topic pattern %q: unknown placeholder %s", pat, seg)
+			}
+		}
+		p.patterns = append(p.patterns, segs)
+	}
+	return p, nil
+}
+
+// ParseTopicPatterns compiles a comma separated list of patterns.
+func ParseTopicPatterns(s string) (*TopicParser, error) {
+	if strings.TrimSpace(s) == "" {
+		return defaultTopicParser, nil
+	}
+	return NewTopicParser(strings.Split(s, ","))
+}
+
+// topicNodeID converts a "!abcd1234" style topic level to a node ID.
+func topicNodeID(s string) string {
+	s = strings.TrimPrefix(s, "!")
+	if !validNodeID(s) {
+		return ""
+	}
+	return strings.ToLower(s)
+}
+
+// Parse returns the information in topic. The result is false when neither a
+// user pattern nor the Meshtastic layout matches.
+func (p *TopicParser) Parse(topic string) (TopicInfo, bool) {
+	parts := strings.Split(topic, "/")
+	for _, pat := range p.patterns {
+		if ti, ok := matchTopicPattern(pat, parts); ok {
+			return ti, true
+		}
+	}
+	return parseMeshtasticTopic(parts)
+}
+
+func matchTopicPattern(pat, parts []string) (TopicInfo, bool) {
+	var ti TopicInfo
+	for i, seg := range pat {
+		if seg == "#" {
+			return ti, true
+		}
+		if i >= len(parts) {
+			return TopicInfo{}, false
+		}
+		v := parts[i]
+		switch seg {
+		case "+":
+		case "{root}":
+			ti.Root = v
+		case "{region}":
+			ti.Region = v
+		case "{channel}":
+			ti.Channel = v
+		case "{gateway}":
+			if ti.Gateway = topicNodeID(v); ti.Gateway == "" {
+				return TopicInfo{}, false
+			}
+		case "{node}":
+			if id := topicNodeID(v); id != "" {
+				ti.Node = id
+			} else {
+				ti.Node = v
+			}
+		default:
+			if seg != v {
+				return TopicInfo{}, false
+			}
+		}
+	}
+	if len(pat) != len(parts) {
+		return TopicInfo{}, false
+	}
+	return ti, true
+}
+
+// parseMeshtasticTopic understands the firmware layouts
+// "<root>/2/e|c|json/<channel>/<gateway>" and "<root>/2/map|stat/<gateway>"
+// where the root is "msh" followed by the region, which may itself contain
+// several levels such as "EU_868/DE".
+func parseMeshtasticTopic(parts []string) (TopicInfo, bool) {
+	for i := 1; i+1 < len(parts); i++ {
+		if parts[i] != "2" {
+			continue
+		}
+		format := parts[i+1]
+		ti := TopicInfo{Root: strings.Join(parts[:i], "/"), Region: strings.Join(parts[1:i], "/"), Format: format}
+		rest := parts[i+2:]
+		switch format {
+		case "e", "c", "json":
+			if len(rest) > 0 {
+				ti.Channel = rest[0]
+			}
+			if len(rest) > 1 {
+				ti.Gateway = topicNodeID(rest[1])
+			}
+		case "map", "stat":
+			if len(rest) > 0 {
+				ti.Gateway = topicNodeID(rest[0])
+			}
+		default:
+			continue
+		}
+		return ti, true
+	}
+	return TopicInfo{}, false
+}
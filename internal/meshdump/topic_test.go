@@ -0,0 +1,95 @@
+package meshdump
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMeshtasticTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  TopicInfo
+		ok    bool
+	}{
+		{"msh/EU_868/2/e/LongFast/!abcd1234", TopicInfo{Root: "msh/EU_868", Region: "EU_868", Format: "e", Channel: "LongFast", Gateway: "abcd1234"}, true},
+		{"msh/EU_868/DE/2/json/deadbeef/!ABCD1234", TopicInfo{Root: "msh/EU_868/DE", Region: "EU_868/DE", Format: "json", Channel: "deadbeef", Gateway: "abcd1234"}, true},
+		{"msh/US/2/map/!00000001", TopicInfo{Root: "msh/US", Region: "US", Format: "map", Gateway: "00000001"}, true},
+		{"msh/US/2/map/", TopicInfo{Root: "msh/US", Region: "US", Format: "map"}, true},
+		{"msh/00000001", TopicInfo{}, false},
+		{"sensors/garden/soil", TopicInfo{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := defaultTopicParser.Parse(tt.topic)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("Parse(%q) = %+v, %v; want %+v, %v", tt.topic, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTopicPatterns(t *testing.T) {
+	p, err := ParseTopicPatterns("gateways/{region}/{channel}/{gateway}, lab/+/{node}/#")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	ti, ok := p.Parse("gateways/EU_868/LongFast/!abcd1234")
+	if !ok || ti.Region != "EU_868" || ti.Channel != "LongFast" || ti.Gateway != "abcd1234" {
+		t.Errorf("unexpected info: %+v %v", ti, ok)
+	}
+	if _, ok := p.Parse("gateways/EU_868/LongFast/not-a-node"); ok {
+		t.Errorf("invalid gateway accepted")
+	}
+	ti, ok = p.Parse("lab/bench/probe-1/readings/now")
+	if id, _ := ti.NodeID(); !ok || id != "probe-1" {
+		t.Errorf("unexpected node: %+v %v", ti, ok)
+	}
+	// the built-in layout still applies
+	if ti, ok := p.Parse("msh/EU_868/2/e/LongFast/!abcd1234"); !ok || ti.Channel != "LongFast" {
+		t.Errorf("meshtastic layout not parsed: %+v", ti)
+	}
+	if _, err := NewTopicParser([]string{"a/#/b"}); err == nil {
+		t.Errorf("expected error for # before the last level")
+	}
+	if _, err := NewTopicParser([]string{"a/{bogus}"}); err == nil {
+		t.Errorf("expected error for unknown placeholder")
+	}
+}
+
+func TestDecodeTopicMetadata(t *testing.T) {
+	// a channel named like a node ID is not taken for the sender
+	if _, err := DecodeMessage("msh/EU_868/2/json/deadbeef/!abcd1234", `{"DataType":"voltage","Value":4}`); err == nil {
+		t.Errorf("channel name used as node id")
+	}
+	dec, err := DecodeMessage("msh/EU_868/2/json/LongFast/!abcd1234", `{"NodeID":"00000001","DataType":"voltage","Value":4}`)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if p := dec.Packet; p == nil || p.NodeID != "00000001" || p.Region != "EU_868" || p.Channel != "LongFast" || p.Gateway != "abcd1234" {
+		t.Errorf("unexpected packet metadata: %+v", dec.Packet)
+	}
+}
+
+func TestStorePackets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	st, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPipeline(st)
+	p.HandleMessage("msh/EU_868/2/json/LongFast/!abcd1234", []byte(`{"NodeID":"00000001","DataType":"voltage","Value":4}`))
+	p.HandleMessage("msh/US/2/json/MediumFast/!abcd1234", []byte(`{"NodeID":"00000002","DataType":"voltage","Value":4}`))
+	st.Close()
+
+	st, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	all := st.Packets(nil, 0)
+	if len(all) != 2 || all[0].NodeID != "00000002" || all[1].Channel != "LongFast" {
+		t.Fatalf("unexpected packets: %+v", all)
+	}
+	us := st.Packets(func(p PacketMeta) bool { return p.Region == "US" }, 10)
+	if len(us) != 1 || us[0].Channel != "MediumFast" {
+		t.Errorf("unexpected filtered packets: %+v", us)
+	}
+}